@@ -1,296 +1,331 @@
 package api
 
 import (
-	"bufio"
+	"context"
+	"csv-handler/broker"
+	"csv-handler/dataset"
+	"csv-handler/ingest"
 	"csv-handler/postgres"
-	"csv-handler/rabbitmq"
+	"csv-handler/query"
+	redisclient "csv-handler/redis"
+	"csv-handler/uploads"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
 
-	"github.com/spf13/viper"
+	"github.com/gorilla/mux"
 )
 
-func HandleGetData(w http.ResponseWriter, r *http.Request) {
-	// Parse and extract the filters from the request URL or request body
-	filters := parseFilters(r)
+// Handler serves the API endpoints
+type Handler struct {
+	// Broker receives the rows of uploaded files
+	Broker broker.Broker
+	// DB is the PostgreSQL connection pool shared by every request
+	DB *postgres.Client
+	// Datasets holds the dataset definitions that uploads and queries use
+	Datasets *dataset.Registry
+	// Cache holds records by id, it may be nil
+	Cache *redisclient.Client
+	// Uploads keeps the content of resumable uploads until they are finalized
+	Uploads uploads.Store
+}
 
-	// Get the limit and offset values for pagination
-	limit, offset := getPaginationParams(r)
+// NewHandler creates the API handler
+func NewHandler(messageBroker broker.Broker, db *postgres.Client, cache *redisclient.Client, datasets *dataset.Registry, uploadStore uploads.Store) *Handler {
+	return &Handler{
+		Broker:   messageBroker,
+		DB:       db,
+		Datasets: datasets,
+		Cache:    cache,
+		Uploads:  uploadStore,
+	}
+}
 
-	// Create an instance of the PostgreSQL client
-	pgClient, err := postgres.NewClient()
-	if err != nil {
-		// Handle the error and return an appropriate response
-		http.Error(w, "Failed to initialize PostgreSQL client", http.StatusInternalServerError)
+// HandleGetData handles the GET /datasets/{name}/records endpoint, and GET /data for
+// the default dataset. It returns a page of rows in a
+// {"data": [...], "page": {...}, "total": N} envelope, page.next_cursor and page.prev_cursor
+// are passed back as the cursor parameter to get the pages next to it.
+// count=exact|estimate|none decides how total is computed, it is null for none.
+func (h *Handler) HandleGetData(w http.ResponseWriter, r *http.Request) {
+	ds, ok := h.requestDataset(w, r, "")
+	if !ok {
 		return
 	}
-	defer pgClient.Close()
 
-	// Call the GetData method to retrieve the data from PostgreSQL
-	data, err := pgClient.GetData(filters, limit, offset)
+	// Parse and validate the filters from the request URL against the dataset columns
+	filters, err := query.ParseFilters(r.URL.Query(), ds.FilterColumns())
 	if err != nil {
-		// Handle the error and return an appropriate response
-		http.Error(w, "Failed to retrieve data from PostgreSQL", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Convert the data to JSON
-	// Check if there are no results
-	if len(data) == 0 {
-		// Return an empty JSON object
-		emptyData := make(map[string]interface{})
-		jsonData, err := json.Marshal(emptyData)
-		if err != nil {
-			fmt.Println("Failed to marshal JSON:", err)
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write(jsonData)
+	// Get the limit, sort and cursor for pagination
+	page, err := query.ParsePage(r.URL.Query(), ds.FilterColumns(), ds.Key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	responseJSON, err := json.Marshal(data)
+
+	// Get how the total should be counted
+	countMode, err := query.ParseCount(r.URL.Query())
 	if err != nil {
-		// Handle the error and return an appropriate response
-		http.Error(w, "Failed to convert data to JSON", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Set the response headers and write the JSON response
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(responseJSON)
-}
+	// Queries are cancelled when the client disconnects or postgres.query_timeout_ms passes
+	ctx, cancel := postgres.WithQueryTimeout(r.Context())
+	defer cancel()
 
-func getPaginationParams(r *http.Request) (int, int) {
-	// Extract the limit and offset values from the request URL or request body
-	limitStr := r.URL.Query().Get("limit")
-	offsetStr := r.URL.Query().Get("offset")
+	// Call the GetData method to retrieve the data from PostgreSQL
+	data, pageInfo, err := h.DB.GetData(ctx, ds, filters, page)
+	if err != nil {
+		// Handle the error and return an appropriate response
+		http.Error(w, "Failed to retrieve data from PostgreSQL", http.StatusInternalServerError)
+		return
+	}
 
-	// Parse and validate the limit and offset values
-	limit, err := strconv.Atoi(limitStr)
-	if err != nil || limit < 0 {
-		// Handle invalid limit value, return a default value or error
+	// Count the rows matching the filters
+	total, err := h.DB.CountData(ctx, ds, filters, countMode)
+	if err != nil {
+		http.Error(w, "Failed to count data in PostgreSQL", http.StatusInternalServerError)
+		return
 	}
+	pageInfo.Count = countMode
 
-	offset, err := strconv.Atoi(offsetStr)
-	if err != nil || offset < 0 {
-		// Handle invalid offset value, return a default value or error
+	// Always return an array, even when there are no results
+	if data == nil {
+		data = []map[string]interface{}{}
 	}
 
-	return limit, offset
+	writeJSON(w, http.StatusOK, dataResponse{
+		Data:  data,
+		Page:  pageInfo,
+		Total: total,
+	})
 }
 
-func parseFilters(r *http.Request) map[string]interface{} {
-	// Extract the filters from the request URL or request body and parse them as needed
-	values := r.URL.Query()
-
-	filters := make(map[string]interface{})
+// dataResponse is the envelope returned by GET /data
+type dataResponse struct {
+	Data []map[string]interface{} `json:"data"`
+	Page *query.PageInfo          `json:"page"`
+	// Total is the number of rows matching the filters, null when not counted
+	Total *int64 `json:"total"`
+}
 
-	// Extract and parse the "created_at" filter
-	createdAt := values.Get("created_at")
-	if createdAt != "" {
-		// Perform any necessary parsing or validation for the filter value
-		// Add the filter to the map
-		filters["created_at"] = createdAt
+// HandleFileUpload handles the POST /upload endpoint for file upload.
+// The optional dataset form field names the dataset of the file, the default dataset is used without it.
+// The optional mode form field is insert, upsert, skip_existing or fail_on_conflict
+// and decides what happens to rows whose id already exists.
+// Headers are matched to the dataset columns by name or alias, ignoring case and punctuation.
+// Rows that can't be parsed are skipped and saved with the rejects of the job, as failed rows.
+// The optional mapping form field is a JSON object from header to column that overrides
+// the match, an empty column ignores the header.
+// The delimiter, quote, charset and line terminator of the file are detected, the optional delimiter,
+// quote (" or '), charset and line_terminator (lf, crlf or cr) form fields override them.
+// Excel (.xlsx) and OpenDocument (.ods) spreadsheets are detected from their content, the optional
+// sheet form field picks the sheet by name or position counted from 1, the first sheet is the default.
+// Date cells are written in the format of their timestamp column.
+// NDJSON (application/x-ndjson) and JSON arrays of objects are detected from their first character,
+// every object is a row and the fields of the first objects are its headers.
+// gzip and zstd files are decompressed as they are read. A zip archive creates an import batch
+// with an import job per file, and the batch is returned instead of the job. A file that fails
+// only fails its own job, the other files of the archive are still imported.
+// With ?dry_run=true the file is only validated, see HandleValidateUpload.
+func (h *Handler) HandleFileUpload(w http.ResponseWriter, r *http.Request) {
+	// A dry run only validates the file
+	if r.URL.Query().Get("dry_run") == "true" {
+		h.HandleValidateUpload(w, r)
+		return
 	}
 
-	// Extract and parse the "deleted_at" filter
-	deletedAt := values.Get("deleted_at")
-	if deletedAt != "" {
-		// Perform any necessary parsing or validation for the filter value
-		// Add the filter to the map
-		filters["deleted_at"] = deletedAt
+	upload, ok := h.openUpload(w, r)
+	if !ok {
+		return
 	}
+	defer upload.file.Close()
 
-	// Extract and parse the "email_address" filter
-	emailAddress := values.Get("email_address")
-	if emailAddress != "" {
-		// Perform any necessary parsing or validation for the filter value
-		// Add the filter to the map
-		filters["email_address"] = emailAddress
-	}
+	h.importUpload(r.Context(), w, upload, strings.TrimSuffix(r.URL.Path, "/upload"))
+}
 
-	// Extract and parse the "first_name" filter
-	firstName := values.Get("first_name")
-	if firstName != "" {
-		// Perform any necessary parsing or validation for the filter value
-		// Add the filter to the map
-		filters["first_name"] = firstName
+// importUpload creates the import jobs of an upload, publishes its rows and writes the response.
+// basePath is the API prefix of the Location header. It returns false if the import failed.
+func (h *Handler) importUpload(ctx context.Context, w http.ResponseWriter, upload *uploadedFile, basePath string) bool {
+	// Create a publisher in confirm mode so rows are only reported once the broker has them
+	publisher, err := h.Broker.NewPublisher()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Failed to create publisher: %v", err)
+		return false
 	}
+	defer publisher.Close()
 
-	// Extract and parse the "last_name" filter
-	lastName := values.Get("last_name")
-	if lastName != "" {
-		// Perform any necessary parsing or validation for the filter value
-		// Add the filter to the map
-		filters["last_name"] = lastName
+	if upload.compression != ingest.CompressionZip {
+		job, err := h.publishFile(ctx, publisher, upload, upload.files[0], nil)
+		if err != nil {
+			writeImportError(w, err)
+			return false
+		}
+
+		// File upload and publishing successful
+		w.Header().Set("Location", fmt.Sprintf("%s/imports/%d", basePath, job.ID))
+		writeJSON(w, http.StatusAccepted, job)
+		return true
 	}
 
-	// Extract and parse the "id" filter
-	id := values.Get("id")
-	if id != "" {
-		// Perform any necessary parsing or validation for the filter value
-		// Add the filter to the map
-		filters["id"] = id
+	// Every file of the archive is imported as its own job of one batch
+	batch, err := h.DB.CreateImportBatch(ctx, upload.fileName)
+	if err != nil {
+		http.Error(w, "Failed to create import batch", http.StatusInternalServerError)
+		return false
+	}
+	for _, file := range upload.files {
+		// A file that can't be imported only fails its own job, the batch reports it
+		if _, err := h.publishFile(ctx, publisher, upload, file, &batch.ID); err != nil {
+			log.Printf("Import batch %d: %v", batch.ID, err)
+		}
 	}
 
-	// Extract and parse the "id" filter
-	parentId := values.Get("parent_user_id")
-	if parentId != "" {
-		// Perform any necessary parsing or validation for the filter value
-		// Add the filter to the map
-		filters["parent_user_id"] = parentId
+	batch, err = h.DB.GetImportBatch(ctx, batch.ID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve import batch", http.StatusInternalServerError)
+		return false
 	}
 
-	return filters
+	w.Header().Set("Location", fmt.Sprintf("%s/batches/%d", basePath, batch.ID))
+	writeJSON(w, http.StatusAccepted, batch)
+	return true
 }
 
-// HandleFileUpload handles the POST /upload endpoint for file upload
-func HandleFileUpload(w http.ResponseWriter, r *http.Request) {
-	// Retrieve the uploaded file from the request
-	file, _, err := r.FormFile("file")
+// HandleGetImport handles the GET /imports/{id} endpoint and reports the progress of an import job
+func (h *Handler) HandleGetImport(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Failed to retrieve file: %v", err)
+		http.Error(w, "Invalid import job ID", http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
-
-	// Create a new RabbitMQ instance
-	rabbitMQ := rabbitmq.GetRabbitMQInstance()
 
-	// Create a buffered reader to read the file in chunks
-	bufferedReader := bufio.NewReader(file)
+	ctx, cancel := postgres.WithQueryTimeout(r.Context())
+	defer cancel()
 
-	// Set the chunk size (adjust according to your requirements)
-	chunkSize := 100
-	count := 0
+	job, err := h.DB.GetImportJob(ctx, id)
+	if errors.Is(err, postgres.ErrNotFound) {
+		http.Error(w, "Import job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to retrieve import job", http.StatusInternalServerError)
+		return
+	}
 
-	// Buffer to hold the chunk data
-	chunk := make([]byte, chunkSize)
+	writeJSON(w, http.StatusOK, job)
+}
 
-	// Incomplete line buffer
-	incompleteLine := ""
+// HandleGetImportBatch handles the GET /batches/{id} endpoint and reports the progress
+// of the import jobs of a zip archive
+func (h *Handler) HandleGetImportBatch(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid import batch ID", http.StatusBadRequest)
+		return
+	}
 
-	queue_name := viper.GetString("rabbitmq.csv_rabbitmq")
+	ctx, cancel := postgres.WithQueryTimeout(r.Context())
+	defer cancel()
 
-	// Read the first line separately
-	firstLine, err := bufferedReader.ReadString('\n')
-	if err != nil && err != io.EOF {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Failed to read file: %v", err)
+	batch, err := h.DB.GetImportBatch(ctx, id)
+	if errors.Is(err, postgres.ErrNotFound) {
+		http.Error(w, "Import batch not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to retrieve import batch", http.StatusInternalServerError)
 		return
 	}
-	firstLine = strings.Trim(firstLine, "\ufeff")
-	firstLine = strings.TrimSpace(firstLine)
-	headers := strings.Split(firstLine, ",")
-
-	// Read and process the CSV data in chunks
-	for {
-		// Read a chunk from the file
-		numBytesRead, err := bufferedReader.Read(chunk)
-		if err != nil && err != io.EOF {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "Failed to read file: %v", err)
-			return
-		}
-
-		// Combine incomplete line from previous chunk, if any, with the current chunk
-		data := incompleteLine + string(chunk[:numBytesRead])
 
-		// Split the data into lines
-		lines := strings.Split(data, "\n")
+	writeJSON(w, http.StatusOK, batch)
+}
 
-		// If the last line is incomplete, store it for the next chunk
-		lastLine := lines[len(lines)-1]
-		if !strings.HasSuffix(data, "\n") {
-			incompleteLine = lastLine
-			lines = lines[:len(lines)-1] // Exclude the incomplete last line from processing
-		} else {
-			incompleteLine = "" // Clear the incomplete line buffer
-		}
+// writeJSON writes v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	responseJSON, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Failed to convert data to JSON", http.StatusInternalServerError)
+		return
+	}
 
-		// Process and publish each line individually
-		for _, line := range lines {
-			// Skip empty lines
-			if line == "" {
-				continue
-			}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(responseJSON)
+}
 
-			count = count + 1
+// HandleGetImportRejects handles the GET /imports/{id}/rejects endpoint.
+// It returns the failed rows of an import job as a CSV file that can be fixed and uploaded again,
+// with the line number and error reason appended to every row. Rows that couldn't be parsed have
+// empty columns and their text in the error reason.
+func (h *Handler) HandleGetImportRejects(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid import job ID", http.StatusBadRequest)
+		return
+	}
 
-			// Split the line into values
-			line = strings.ReplaceAll(line, "\r", "")
-			values := strings.Split(line, ",")
+	// The rejects are streamed, so only a client disconnect cancels the query
+	ctx := r.Context()
 
-			// Create an object to hold the line values
-			obj := make(map[string]string)
+	job, err := h.DB.GetImportJob(ctx, id)
+	if errors.Is(err, postgres.ErrNotFound) {
+		http.Error(w, "Import job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to retrieve import job", http.StatusInternalServerError)
+		return
+	}
 
-			// Assign values to keys from the first line
-			for i, key := range headers {
-				obj[key] = values[i]
-			}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"import-%d-rejects.csv\"", job.ID))
 
-			// Convert the object to JSON
-			jsonData, err := json.Marshal(obj)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				fmt.Fprintf(w, "Failed to convert object to JSON: %v", err)
-				return
-			}
+	// Write the original header row followed by the reject details
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Write(append(append([]string{}, job.Headers...), "line_number", "error"))
 
-			//Publish the line to RabbitMQ
-			err = rabbitMQ.Publish(queue_name, string(jsonData))
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				fmt.Fprintf(w, "Failed to publish line to RabbitMQ: %v", err)
-				return
+	err = h.DB.EachImportReject(ctx, job.ID, func(reject *postgres.ImportReject) error {
+		// Rows the consumer rejected are stored by column, rows that couldn't be parsed as their text
+		var values map[string]string
+		var rawRow string
+		if err := json.Unmarshal([]byte(reject.RawValues), &values); err != nil {
+			if err := json.Unmarshal([]byte(reject.RawValues), &rawRow); err != nil {
+				log.Println("Failed to decode reject values:", err)
 			}
 		}
 
-		// Check for end of file
-		if err == io.EOF {
-			break
-		}
-	}
-
-	// Publish the incomplete last line if it exists
-	if incompleteLine != "" {
-
-		// Split the line into values
-		incompleteLine = strings.ReplaceAll(incompleteLine, "\r", "")
-		values := strings.Split(incompleteLine, ",")
-
-		// Create an object to hold the line values
-		obj := make(map[string]string)
-
-		// Assign values to keys from the first line
-		for i, key := range headers {
-			obj[key] = values[i]
+		row := make([]string, 0, len(job.Headers)+2)
+		for i, header := range job.Headers {
+			// The rows are stored by column, ignored headers are left empty
+			column := header
+			if job.Columns != nil {
+				column = job.Columns[i]
+			}
+			row = append(row, values[column])
 		}
-
-		// Convert the object to JSON
-		jsonData, err := json.Marshal(obj)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "Failed to convert object to JSON: %v", err)
-			return
+		message := reject.Error
+		if rawRow != "" {
+			message += ", the row was: " + rawRow
 		}
+		row = append(row, strconv.Itoa(reject.Line), message)
 
-		err = rabbitMQ.Publish(queue_name, string(jsonData))
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "Failed to publish line to RabbitMQ: %v", err)
-			return
-		}
+		return csvWriter.Write(row)
+	})
+	if err != nil {
+		// The headers are already sent, so the error can only be logged
+		log.Println("Failed to write import rejects:", err)
 	}
 
-	// File upload and publishing successful
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, "File uploaded and processed in chunks, lines published successfully")
+	csvWriter.Flush()
 }
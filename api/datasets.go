@@ -0,0 +1,35 @@
+package api
+
+import (
+	"csv-handler/dataset"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// HandleListDatasets handles the GET /datasets endpoint and returns every dataset definition
+func (h *Handler) HandleListDatasets(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.Datasets.All())
+}
+
+// requestDataset returns the dataset named by the {name} path variable, or by fallback
+// for routes without one, and writes a 404 response if it is not defined.
+// An empty name selects the default dataset, which serves the /data routes.
+func (h *Handler) requestDataset(w http.ResponseWriter, r *http.Request, fallback string) (*dataset.Dataset, bool) {
+	name, ok := mux.Vars(r)["name"]
+	if !ok {
+		name = fallback
+	}
+
+	ds, err := h.Datasets.Get(name)
+	if errors.Is(err, dataset.ErrUnknown) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to find dataset", http.StatusInternalServerError)
+		return nil, false
+	}
+	return ds, true
+}
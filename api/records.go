@@ -0,0 +1,246 @@
+package api
+
+import (
+	"crypto/subtle"
+	"csv-handler/dataset"
+	"csv-handler/postgres"
+	redisclient "csv-handler/redis"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+// recordCacheTTL is how long a record stays in Redis, the same as the rows cached by the consumer
+const recordCacheTTL = time.Hour
+
+// maxPatchBodySize limits the size of a PATCH /records/{id} body
+const maxPatchBodySize = 1 << 20
+
+// HandleGetRecord handles the GET /datasets/{name}/records/{id} endpoint, and GET /data/{id}
+// for the default dataset. Records are read through the Redis cache that the consumer fills on insert.
+func (h *Handler) HandleGetRecord(w http.ResponseWriter, r *http.Request) {
+	ds, ok := h.requestDataset(w, r, "")
+	if !ok {
+		return
+	}
+	id, ok := recordID(w, r)
+	if !ok {
+		return
+	}
+	cacheKey := ds.CacheKey(id)
+
+	// Serve the record from the cache if it is there
+	if h.Cache != nil {
+		cached, err := h.Cache.Get(cacheKey)
+		if err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Cache", "HIT")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(cached))
+			return
+		}
+		if !errors.Is(err, redisclient.ErrCacheMiss) {
+			log.Println("Failed to read record from cache:", err)
+		}
+	}
+
+	ctx, cancel := postgres.WithQueryTimeout(r.Context())
+	defer cancel()
+
+	record, err := h.DB.GetRecord(ctx, ds, id)
+	if errors.Is(err, postgres.ErrNotFound) {
+		http.Error(w, "Record not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to retrieve record from PostgreSQL", http.StatusInternalServerError)
+		return
+	}
+
+	responseJSON, err := json.Marshal(record)
+	if err != nil {
+		http.Error(w, "Failed to convert data to JSON", http.StatusInternalServerError)
+		return
+	}
+
+	// Cache the record for the next read
+	if h.Cache != nil {
+		if err := h.Cache.Set(cacheKey, string(responseJSON), recordCacheTTL); err != nil {
+			log.Println("Failed to cache record:", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Cache", "MISS")
+	w.WriteHeader(http.StatusOK)
+	w.Write(responseJSON)
+}
+
+// HandlePatchRecord handles the PATCH /datasets/{name}/records/{id} endpoint, and PATCH /data/{id}
+// for the default dataset. The body is a JSON object with the columns to change, null clears
+// an optional column. The key can't be changed.
+func (h *Handler) HandlePatchRecord(w http.ResponseWriter, r *http.Request) {
+	ds, ok := h.requestDataset(w, r, "")
+	if !ok {
+		return
+	}
+	id, ok := recordID(w, r)
+	if !ok {
+		return
+	}
+
+	// Decode the body, keeping numbers as they were sent
+	var body map[string]interface{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPatchBodySize))
+	decoder.UseNumber()
+	if err := decoder.Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	fields, err := parsePatch(ds, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := postgres.WithQueryTimeout(r.Context())
+	defer cancel()
+
+	record, err := h.DB.UpdateRecord(ctx, ds, id, fields)
+	if errors.Is(err, postgres.ErrNotFound) {
+		http.Error(w, "Record not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update record in PostgreSQL", http.StatusInternalServerError)
+		return
+	}
+
+	h.invalidateRecord(ds, id)
+	writeJSON(w, http.StatusOK, record)
+}
+
+// HandleDeleteRecord handles the DELETE /datasets/{name}/records/{id} endpoint, and DELETE /data/{id}
+// for the default dataset. Records are soft deleted by setting the soft delete column of the dataset.
+// ?hard=true removes the row, which needs the api.admin_token in the X-Admin-Token header.
+func (h *Handler) HandleDeleteRecord(w http.ResponseWriter, r *http.Request) {
+	ds, ok := h.requestDataset(w, r, "")
+	if !ok {
+		return
+	}
+	id, ok := recordID(w, r)
+	if !ok {
+		return
+	}
+
+	hard := r.URL.Query().Get("hard") == "true"
+	if hard && !isAdmin(r) {
+		http.Error(w, "Hard delete requires an admin token", http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := postgres.WithQueryTimeout(r.Context())
+	defer cancel()
+
+	var err error
+	if hard {
+		err = h.DB.HardDeleteRecord(ctx, ds, id)
+	} else {
+		err = h.DB.SoftDeleteRecord(ctx, ds, id)
+	}
+	if errors.Is(err, postgres.ErrNotFound) {
+		http.Error(w, "Record not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, postgres.ErrNoSoftDelete) {
+		http.Error(w, "Records of this dataset can only be deleted with ?hard=true", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete record in PostgreSQL", http.StatusInternalServerError)
+		return
+	}
+
+	h.invalidateRecord(ds, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// recordID parses the {id} path variable and writes a 400 response if it is invalid
+func recordID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid record ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// parsePatch validates a PATCH body against the dataset columns and converts its values to the column types
+func parsePatch(ds *dataset.Dataset, body map[string]interface{}) (map[string]interface{}, error) {
+	if len(body) == 0 {
+		return nil, fmt.Errorf("no columns to update")
+	}
+
+	fields := make(map[string]interface{}, len(body))
+	for name, value := range body {
+		column, ok := ds.Column(name)
+		if !ok || name == ds.Key {
+			return nil, fmt.Errorf("column %q can't be updated", name)
+		}
+
+		var raw string
+		switch v := value.(type) {
+		case nil:
+			if column.Required {
+				return nil, fmt.Errorf("column %q can't be null", name)
+			}
+			fields[name] = nil
+			continue
+		case string:
+			raw = v
+		case json.Number:
+			raw = v.String()
+		default:
+			return nil, fmt.Errorf("column %q must be a string, number or null", name)
+		}
+
+		// Values are parsed like uploaded ones, with the timestamp formats and timezone of the column
+		parsed, err := column.ParseValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		if parsed == nil && column.Required {
+			return nil, fmt.Errorf("column %q can't be null", name)
+		}
+		fields[name] = parsed
+	}
+
+	return fields, nil
+}
+
+// isAdmin reports whether the request carries the configured admin token
+func isAdmin(r *http.Request) bool {
+	token := viper.GetString("api.admin_token")
+	if token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(token)) == 1
+}
+
+// invalidateRecord removes a changed record from the cache
+func (h *Handler) invalidateRecord(ds *dataset.Dataset, id int64) {
+	if h.Cache == nil {
+		return
+	}
+	if err := h.Cache.Del(ds.CacheKey(id)); err != nil {
+		log.Println("Failed to invalidate cached record:", err)
+	}
+}
@@ -0,0 +1,272 @@
+package api
+
+import (
+	"csv-handler/uploads"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+// tusVersion is the version of the tus resumable upload protocol the /uploads endpoints follow
+const tusVersion = "1.0.0"
+
+// tusExtensions are the optional parts of the protocol that are supported
+const tusExtensions = "creation,expiration,termination"
+
+// offsetContentType is the content type of the chunks of a resumable upload
+const offsetContentType = "application/offset+octet-stream"
+
+// finalizeFormMemory is how much of a multipart finalize form is kept in memory, as in net/http
+const finalizeFormMemory = 32 << 20
+
+// checkTus sets the protocol header of a resumable upload response and checks the protocol
+// version of the request. It writes a 412 response for a version that isn't supported.
+func checkTus(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if version := r.Header.Get("Tus-Resumable"); version != "" && version != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, fmt.Sprintf("Unsupported Tus-Resumable version %q", version), http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// setUploadHeaders sets the headers that describe the progress of an upload
+func setUploadHeaders(w http.ResponseWriter, upload *uploads.Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// writeUploadError writes the response of a failed upload store call
+func writeUploadError(w http.ResponseWriter, err error, action string) {
+	switch {
+	case errors.Is(err, uploads.ErrNotFound):
+		http.Error(w, "Upload not found", http.StatusNotFound)
+	case errors.Is(err, uploads.ErrLocked):
+		http.Error(w, "Upload is in use by another request", http.StatusLocked)
+	default:
+		log.Printf("Failed to %s: %v", action, err)
+		http.Error(w, fmt.Sprintf("Failed to %s", action), http.StatusInternalServerError)
+	}
+}
+
+// parseUploadMetadata parses an Upload-Metadata header, comma separated pairs of a key
+// and a base64 encoded value. The value may be left out.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("Invalid Upload-Metadata header: empty key")
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Upload-Metadata header: value of %s is not base64", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// HandleUploadOptions handles the OPTIONS /uploads endpoint and describes the supported protocol
+func (h *Handler) HandleUploadOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	if maxSize := viper.GetInt64("uploads.max_size"); maxSize > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxSize, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleCreateUpload handles the POST /uploads endpoint and creates a resumable upload.
+// The Upload-Length header is the size of the file. The Upload-Metadata header may hold its
+// filename and any form field of POST /upload, which finalize uses when the field isn't given.
+// The Location header is the URL the chunks are sent to.
+func (h *Handler) HandleCreateUpload(w http.ResponseWriter, r *http.Request) {
+	if !checkTus(w, r) {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length header, expected the size of the file in bytes", http.StatusBadRequest)
+		return
+	}
+	if maxSize := viper.GetInt64("uploads.max_size"); maxSize > 0 && length > maxSize {
+		http.Error(w, fmt.Sprintf("Upload-Length exceeds the maximum size of %d bytes", maxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	upload, err := h.Uploads.Create(length, metadata)
+	if err != nil {
+		writeUploadError(w, err, "create upload")
+		return
+	}
+
+	setUploadHeaders(w, upload)
+	w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+upload.ID)
+	writeJSON(w, http.StatusCreated, upload)
+}
+
+// HandleGetUpload handles the HEAD and GET /uploads/{id} endpoints. The Upload-Offset header
+// is how many bytes have been received, the next chunk starts there.
+func (h *Handler) HandleGetUpload(w http.ResponseWriter, r *http.Request) {
+	if !checkTus(w, r) {
+		return
+	}
+
+	upload, err := h.Uploads.Get(mux.Vars(r)["id"])
+	if err != nil {
+		writeUploadError(w, err, "retrieve upload")
+		return
+	}
+
+	setUploadHeaders(w, upload)
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	writeJSON(w, http.StatusOK, upload)
+}
+
+// HandlePatchUpload handles the PATCH /uploads/{id} endpoint and appends a chunk to an upload.
+// The Upload-Offset header must be the offset of the upload, and the content type application/offset+octet-stream.
+// The bytes received before a connection drops are kept, HEAD tells where to resume.
+func (h *Handler) HandlePatchUpload(w http.ResponseWriter, r *http.Request) {
+	if !checkTus(w, r) {
+		return
+	}
+
+	if contentType := r.Header.Get("Content-Type"); contentType != offsetContentType {
+		http.Error(w, fmt.Sprintf("Invalid Content-Type %q, expected %s", contentType, offsetContentType), http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid Upload-Offset header", http.StatusBadRequest)
+		return
+	}
+
+	upload, err := h.Uploads.Append(mux.Vars(r)["id"], offset, r.Body)
+	if upload != nil {
+		setUploadHeaders(w, upload)
+	}
+	switch {
+	case errors.Is(err, uploads.ErrOffsetMismatch):
+		http.Error(w, fmt.Sprintf("Upload-Offset %d does not match the upload offset %d", offset, upload.Offset), http.StatusConflict)
+		return
+	case errors.Is(err, uploads.ErrTooLarge):
+		http.Error(w, fmt.Sprintf("Chunk exceeds the upload length of %d bytes", upload.Length), http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		writeUploadError(w, err, "write chunk")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleDeleteUpload handles the DELETE /uploads/{id} endpoint and deletes an upload that won't be finished
+func (h *Handler) HandleDeleteUpload(w http.ResponseWriter, r *http.Request) {
+	if !checkTus(w, r) {
+		return
+	}
+
+	if err := h.Uploads.Delete(mux.Vars(r)["id"]); err != nil {
+		writeUploadError(w, err, "delete upload")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleFinalizeUpload handles the POST /uploads/{id}/finalize endpoint and imports a complete upload.
+// It takes the form fields of POST /upload, other than file, and falls back to the Upload-Metadata
+// values for the fields it doesn't have. The response is the one of POST /upload, and
+// ?dry_run=true only validates the file. The upload is deleted once it has been imported, and
+// a request made while another one finalizes the upload gets a 423 response.
+func (h *Handler) HandleFinalizeUpload(w http.ResponseWriter, r *http.Request) {
+	if !checkTus(w, r) {
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	maxErrors, sampleSize, ok := validationLimits(w, r)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	claim, err := h.Uploads.Claim(id)
+	if err != nil {
+		writeUploadError(w, err, "claim upload")
+		return
+	}
+	defer claim.Release()
+
+	upload, err := h.Uploads.Get(id)
+	if err != nil {
+		writeUploadError(w, err, "retrieve upload")
+		return
+	}
+	setUploadHeaders(w, upload)
+	if !upload.Complete() {
+		http.Error(w, fmt.Sprintf("Upload is incomplete, %d of %d bytes received", upload.Offset, upload.Length), http.StatusConflict)
+		return
+	}
+
+	file, err := h.Uploads.Open(id)
+	if err != nil {
+		writeUploadError(w, err, "open upload")
+		return
+	}
+
+	// The metadata fills in the form fields the request doesn't have
+	r.ParseMultipartForm(finalizeFormMemory)
+	for key, value := range upload.Metadata {
+		if _, ok := r.Form[key]; !ok {
+			r.Form.Set(key, value)
+		}
+	}
+
+	fileName := upload.Metadata["filename"]
+	if fileName == "" {
+		fileName = upload.ID
+	}
+	source, ok := h.openFile(w, r, file, fileName, upload.Length)
+	if !ok {
+		return
+	}
+	defer source.file.Close()
+
+	if dryRun {
+		writeValidation(w, source, maxErrors, sampleSize)
+		return
+	}
+
+	basePath := strings.TrimSuffix(r.URL.Path, "/uploads/"+id+"/finalize")
+	if h.importUpload(r.Context(), w, source, basePath) {
+		if err := claim.Delete(); err != nil {
+			log.Printf("Failed to delete upload %s: %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package api
+
+import (
+	"context"
+	"csv-handler/broker"
+	"csv-handler/dataset"
+	"csv-handler/ingest"
+	"csv-handler/postgres"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/spf13/viper"
+)
+
+// publishProgressInterval is how many rows are published between import job updates
+const publishProgressInterval = 1000
+
+// uploadedFile holds an upload whose files have been checked and are ready to be read
+type uploadedFile struct {
+	file        multipart.File
+	fileName    string
+	compression string
+	dataset     *dataset.Dataset
+	mode        string
+	// files holds the single file of the upload, or the files of a zip archive
+	files []*sourceFile
+}
+
+// sourceFile is a CSV, NDJSON or JSON file or a spreadsheet of an upload with its headers matched to the dataset columns
+type sourceFile struct {
+	*ingest.UploadFile
+	// options holds the form field overrides, and the whole CSV dialect once the file has been opened
+	options ingest.ReadOptions
+	// sheet is the name of the sheet read from a spreadsheet
+	sheet     string
+	headerMap *dataset.HeaderMap
+}
+
+// open returns a reader of the file positioned after the header row, the caller closes the stream
+func (f *sourceFile) open() (ingest.RowReader, io.Closer, error) {
+	return f.Rows(f.options)
+}
+
+// dialect returns the dialect a CSV file is read with, nil for a spreadsheet
+func (f *sourceFile) dialect() *ingest.Dialect {
+	if f.Format != ingest.FormatCSV {
+		return nil
+	}
+	return &f.options.Dialect
+}
+
+// sheetName returns the sheet read from a spreadsheet, nil for other files
+func (f *sourceFile) sheetName() *string {
+	if f.Format != ingest.FormatXLSX && f.Format != ingest.FormatODS {
+		return nil
+	}
+	return &f.sheet
+}
+
+// row converts a record to a row keyed by column, with spreadsheet dates written in the column formats
+func (f *sourceFile) row(record *ingest.Record) map[string]string {
+	row := f.headerMap.Apply(record.Values)
+	f.headerMap.ApplyDates(row, record.Dates)
+	return row
+}
+
+// openUpload reads the form fields of an upload, the header row of its files, and matches
+// the headers to the dataset columns. It writes a 400 response if any of them is invalid,
+// so nothing is queued for an archive with one bad file. The caller closes the file.
+func (h *Handler) openUpload(w http.ResponseWriter, r *http.Request) (*uploadedFile, bool) {
+	// Retrieve the uploaded file from the request
+	file, fileHeader, err := r.FormFile("file")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Failed to retrieve file: %v", err)
+		return nil, false
+	}
+
+	return h.openFile(w, r, file, fileHeader.Filename, fileHeader.Size)
+}
+
+// openFile checks an uploaded file of the given size against the form fields of the request,
+// like openUpload. The file is closed if it is invalid.
+func (h *Handler) openFile(w http.ResponseWriter, r *http.Request, file multipart.File, fileName string, size int64) (*uploadedFile, bool) {
+	ds, ok := h.requestDataset(w, r, r.FormValue("dataset"))
+	if !ok {
+		file.Close()
+		return nil, false
+	}
+
+	upload, err := checkUpload(r, ds, file, fileName, size)
+	if err != nil {
+		file.Close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return upload, true
+}
+
+// checkUpload validates the form fields and the headers of every file of an upload of the given size
+func checkUpload(r *http.Request, ds *dataset.Dataset, file multipart.File, fileName string, size int64) (*uploadedFile, error) {
+	// Get how rows with an existing key are handled
+	mode, err := postgres.ParseImportMode(r.FormValue("mode"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the header overrides, if any
+	var mapping map[string]string
+	if rawMapping := r.FormValue("mapping"); rawMapping != "" {
+		if err := json.Unmarshal([]byte(rawMapping), &mapping); err != nil {
+			return nil, fmt.Errorf("Invalid mapping, expected a JSON object from header to column")
+		}
+	}
+
+	// Get the dialect overrides, the rest of the dialect is detected for every CSV file
+	dialect, err := ingest.ParseDialect(r.FormValue("delimiter"), r.FormValue("quote"), r.FormValue("line_terminator"), r.FormValue("charset"))
+	if err != nil {
+		return nil, err
+	}
+	options := ingest.ReadOptions{Dialect: dialect, Sheet: r.FormValue("sheet")}
+
+	// List the files, a zip archive holds several and a spreadsheet is a single one
+	files, compression, err := ingest.UploadFiles(file, size, fileName)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read file: %v", err)
+	}
+
+	upload := &uploadedFile{
+		file:        file,
+		fileName:    fileName,
+		compression: compression,
+		dataset:     ds,
+		mode:        mode,
+	}
+
+	// Match the headers of every file to the dataset columns before anything is queued
+	for _, uploadFile := range files {
+		// Errors in an archive name the file they come from
+		prefix := ""
+		if compression == ingest.CompressionZip {
+			prefix = uploadFile.Name + ": "
+		}
+
+		file := &sourceFile{UploadFile: uploadFile, options: options}
+		rowReader, content, err := file.open()
+		if err != nil {
+			return nil, fmt.Errorf("%sFailed to read header: %v", prefix, err)
+		}
+		content.Close()
+
+		// The file is read again with the detected dialect, from the same sheet
+		switch reader := rowReader.(type) {
+		case *ingest.CSVReader:
+			file.options.Dialect = reader.Dialect()
+		case interface{ Sheet() string }:
+			file.sheet = reader.Sheet()
+		}
+		file.headerMap, err = ds.MapHeaders(rowReader.Headers(), mapping)
+		if err != nil {
+			return nil, fmt.Errorf("%s%v", prefix, err)
+		}
+
+		upload.files = append(upload.files, file)
+	}
+
+	return upload, nil
+}
+
+// importError is returned by publishFile when a file could not be imported.
+// Its import job, if it was created, is already marked as failed.
+type importError struct {
+	status  int
+	jobID   int64
+	message string
+}
+
+func (e *importError) Error() string {
+	if e.jobID == 0 {
+		return e.message
+	}
+	return fmt.Sprintf("Import job %d failed: %s", e.jobID, e.message)
+}
+
+// writeImportError writes the response of a failed import
+func writeImportError(w http.ResponseWriter, err error) {
+	var importErr *importError
+	if !errors.As(err, &importErr) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(importErr.status)
+	fmt.Fprint(w, importErr.Error())
+}
+
+// publishFile creates the import job of a file of an upload and publishes its rows.
+// batchID is the import batch of the archive the file came from, nil for a single file.
+func (h *Handler) publishFile(ctx context.Context, publisher broker.Publisher, upload *uploadedFile, file *sourceFile, batchID *int64) (*postgres.ImportJob, error) {
+	// Create the import job that tracks this file
+	job, err := h.DB.CreateImportJob(ctx, postgres.ImportJob{
+		Dataset:     upload.dataset.Name,
+		FileName:    file.Name,
+		Mode:        upload.mode,
+		BatchID:     batchID,
+		Compression: upload.compression,
+		Format:      file.Format,
+		Sheet:       file.sheetName(),
+		Dialect:     file.dialect(),
+		Headers:     file.headerMap.Headers,
+		Columns:     file.headerMap.Columns,
+	})
+	if err != nil {
+		return nil, &importError{status: http.StatusInternalServerError, message: "Failed to create import job"}
+	}
+
+	// failJob marks the import job as failed and returns the error
+	failJob := func(status int, format string, args ...interface{}) error {
+		message := fmt.Sprintf(format, args...)
+		// The failure is recorded even if the client has gone away
+		if err := h.DB.FailImportJob(context.Background(), job.ID, message); err != nil {
+			log.Println("Failed to update import job:", err)
+		}
+		return &importError{status: status, jobID: job.ID, message: message}
+	}
+
+	// Read the file again from the start, the headers were checked by openUpload
+	rowReader, content, err := file.open()
+	if err != nil {
+		return nil, failJob(http.StatusInternalServerError, "failed to read file: %v", err)
+	}
+	defer content.Close()
+
+	// malformed counts the rows that couldn't be parsed, they are saved as rejects instead of being published
+	var count, unreported, malformed int64
+	queue_name := viper.GetString("rabbitmq.csv_rabbitmq")
+
+	// Read and publish the records one at a time
+	for {
+		record, err := rowReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var rowErr *ingest.RowError
+			if !errors.As(err, &rowErr) {
+				return nil, failJob(http.StatusInternalServerError, "failed to read file: %v", err)
+			}
+
+			// Skip the row as the dry run does, it is saved with the rows the consumer rejects
+			rawRow, _ := json.Marshal(rowErr.Raw)
+			if err := h.DB.InsertImportReject(ctx, job.ID, rowErr.Line, string(rawRow), rowErr.Err.Error()); err != nil {
+				log.Println("Failed to save rejected row:", err)
+			}
+			malformed = malformed + 1
+			continue
+		}
+
+		message := ingest.Message{
+			JobID:   job.ID,
+			Dataset: job.Dataset,
+			Mode:    job.Mode,
+			Line:    record.Line,
+			Data:    file.row(record),
+		}
+
+		//Publish the line to the broker
+		err = publisher.Publish(queue_name, message)
+		if err != nil {
+			return nil, failJob(http.StatusInternalServerError, "failed to publish line: %v", err)
+		}
+
+		count = count + 1
+		unreported = unreported + 1
+
+		// Report progress periodically instead of once per row
+		if unreported == publishProgressInterval {
+			if err := h.DB.AddPublishedRows(ctx, job.ID, unreported); err != nil {
+				log.Println("Failed to update import job:", err)
+			}
+			unreported = 0
+		}
+	}
+
+	// Wait until the broker has confirmed every row
+	err = publisher.Wait()
+	if err != nil {
+		return nil, failJob(http.StatusInternalServerError, "failed to confirm published lines: %v", err)
+	}
+
+	// Malformed rows are handled already, they are failed rows of the total
+	if malformed > 0 {
+		if err := h.DB.RecordImportProgress(ctx, job.ID, postgres.ImportProgress{Failed: malformed}); err != nil {
+			log.Println("Failed to record import progress:", err)
+		}
+	}
+
+	// Record the total so the consumer can tell when the job is complete
+	err = h.DB.FinishPublishing(ctx, job.ID, count+malformed)
+	if err != nil {
+		return nil, failJob(http.StatusInternalServerError, "failed to update import job: %v", err)
+	}
+
+	job, err = h.DB.GetImportJob(ctx, job.ID)
+	if err != nil {
+		return nil, &importError{status: http.StatusInternalServerError, message: "Failed to retrieve import job"}
+	}
+	return job, nil
+}
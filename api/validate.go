@@ -0,0 +1,223 @@
+package api
+
+import (
+	"csv-handler/dataset"
+	"csv-handler/ingest"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// defaultValidateErrors and maxValidateErrors bound how many row errors a validation returns
+	defaultValidateErrors = 100
+	maxValidateErrors     = 1000
+	// defaultValidateSample and maxValidateSample bound how many parsed rows a validation returns
+	defaultValidateSample = 10
+	maxValidateSample     = 100
+)
+
+// validationReport is the response of POST /upload/validate
+type validationReport struct {
+	Dataset  string `json:"dataset"`
+	Mode     string `json:"mode"`
+	FileName string `json:"file_name"`
+	// Compression is the compression of the upload, zip for a file of an archive
+	Compression string `json:"compression"`
+	// Format is csv, ndjson, json, xlsx or ods, Dialect is set for a CSV file and Sheet for a spreadsheet
+	Format  string          `json:"format"`
+	Dialect *ingest.Dialect `json:"dialect,omitempty"`
+	Sheet   *string         `json:"sheet,omitempty"`
+	// Headers is the header row of the file and Columns the column every header maps to, empty if it is ignored
+	Headers        []string `json:"headers"`
+	Columns        []string `json:"columns"`
+	IgnoredHeaders []string `json:"ignored_headers"`
+
+	TotalRows int64 `json:"total_rows"`
+	ValidRows int64 `json:"valid_rows"`
+	// InvalidRows would be rejected by the consumer, the rest of the file is still imported
+	InvalidRows int64 `json:"invalid_rows"`
+	// MalformedRows can't be parsed, the import fails at the first one
+	MalformedRows int64 `json:"malformed_rows"`
+	// ColumnErrors counts the invalid rows by the column that failed
+	ColumnErrors map[string]int64 `json:"column_errors"`
+
+	// Errors holds the first row errors and ErrorsTruncated tells if there were more
+	Errors          []validationError `json:"errors"`
+	ErrorsTruncated bool              `json:"errors_truncated"`
+	// Sample holds the first valid rows as they would be written
+	Sample []map[string]interface{} `json:"sample"`
+}
+
+// archiveValidationReport is the response of POST /upload/validate for a zip archive
+type archiveValidationReport struct {
+	FileName    string              `json:"file_name"`
+	Compression string              `json:"compression"`
+	Files       []*validationReport `json:"files"`
+}
+
+// validationError describes a row that would not be imported
+type validationError struct {
+	Line   int    `json:"line"`
+	Column string `json:"column,omitempty"`
+	Error  string `json:"error"`
+}
+
+// HandleValidateUpload handles the POST /upload/validate endpoint, and POST /upload?dry_run=true.
+// It takes the same form fields as HandleFileUpload and parses the whole file with the same rules,
+// but creates no import job and publishes nothing. The report has the row counts, the header mapping,
+// the first max_errors row errors (default 100) and the first sample_size valid rows (default 10).
+// A zip archive gets a report per file.
+// Conflicts with rows that already exist in the dataset are not checked.
+func (h *Handler) HandleValidateUpload(w http.ResponseWriter, r *http.Request) {
+	maxErrors, sampleSize, ok := validationLimits(w, r)
+	if !ok {
+		return
+	}
+
+	upload, ok := h.openUpload(w, r)
+	if !ok {
+		return
+	}
+	defer upload.file.Close()
+
+	writeValidation(w, upload, maxErrors, sampleSize)
+}
+
+// validationLimits parses the max_errors and sample_size parameters of a validation
+func validationLimits(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	maxErrors, err := limitParam(r, "max_errors", defaultValidateErrors, maxValidateErrors)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return 0, 0, false
+	}
+	sampleSize, err := limitParam(r, "sample_size", defaultValidateSample, maxValidateSample)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return maxErrors, sampleSize, true
+}
+
+// writeValidation validates every file of an upload and writes the report
+func writeValidation(w http.ResponseWriter, upload *uploadedFile, maxErrors, sampleSize int) {
+	reports := make([]*validationReport, 0, len(upload.files))
+	for _, file := range upload.files {
+		report, err := validateFile(upload, file, maxErrors, sampleSize)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Failed to read file: %v", err)
+			return
+		}
+		reports = append(reports, report)
+	}
+
+	if upload.compression != ingest.CompressionZip {
+		writeJSON(w, http.StatusOK, reports[0])
+		return
+	}
+	writeJSON(w, http.StatusOK, archiveValidationReport{
+		FileName:    upload.fileName,
+		Compression: upload.compression,
+		Files:       reports,
+	})
+}
+
+// validateFile parses every row of a file of an upload the way the import does
+func validateFile(upload *uploadedFile, file *sourceFile, maxErrors, sampleSize int) (*validationReport, error) {
+	rowReader, content, err := file.open()
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	ds := upload.dataset
+	report := &validationReport{
+		Dataset:        ds.Name,
+		Mode:           upload.mode,
+		FileName:       file.Name,
+		Compression:    upload.compression,
+		Format:         file.Format,
+		Dialect:        file.dialect(),
+		Sheet:          file.sheetName(),
+		Headers:        file.headerMap.Headers,
+		Columns:        file.headerMap.Columns,
+		IgnoredHeaders: []string{},
+		ColumnErrors:   map[string]int64{},
+		Errors:         []validationError{},
+		Sample:         []map[string]interface{}{},
+	}
+	for i, column := range file.headerMap.Columns {
+		if column == "" {
+			report.IgnoredHeaders = append(report.IgnoredHeaders, file.headerMap.Headers[i])
+		}
+	}
+
+	// addError records a row error, only the first maxErrors are kept
+	addError := func(rowErr validationError) {
+		if len(report.Errors) < maxErrors {
+			report.Errors = append(report.Errors, rowErr)
+		} else {
+			report.ErrorsTruncated = true
+		}
+	}
+
+	// Read every record, malformed rows are reported and skipped
+	for {
+		record, err := rowReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var rowErr *ingest.RowError
+			if !errors.As(err, &rowErr) {
+				return nil, err
+			}
+			report.TotalRows++
+			report.MalformedRows++
+			addError(validationError{Line: rowErr.Line, Error: rowErr.Err.Error()})
+			continue
+		}
+		report.TotalRows++
+
+		// Convert the row the way the consumer does
+		values, err := ds.Values(file.row(record))
+		if err != nil {
+			report.InvalidRows++
+			rowErr := validationError{Line: record.Line, Error: err.Error()}
+			var columnErr *dataset.ColumnError
+			if errors.As(err, &columnErr) {
+				rowErr.Column = columnErr.Column
+				report.ColumnErrors[columnErr.Column]++
+			}
+			addError(rowErr)
+			continue
+		}
+
+		report.ValidRows++
+		if len(report.Sample) < sampleSize {
+			report.Sample = append(report.Sample, ds.Record(values))
+		}
+	}
+
+	return report, nil
+}
+
+// limitParam parses an optional positive count parameter, capped at max
+func limitParam(r *http.Request, name string, defaultValue, max int) (int, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return defaultValue, nil
+	}
+
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid %s: must be a non-negative integer", name)
+	}
+	if value > max {
+		value = max
+	}
+	return value, nil
+}
@@ -0,0 +1,127 @@
+package broker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// RetryCountHeader holds how many times a message has already been retried
+const RetryCountHeader = "x-retry-count"
+
+// defaultRetryDelays are used when broker.retry_delays_ms is not configured
+var defaultRetryDelays = []time.Duration{time.Second, 10 * time.Second, time.Minute}
+
+// Broker is a message broker the upload handler publishes rows to and the workers consume from
+type Broker interface {
+	// DeclareTopology declares the work queue together with its retry and dead-letter queues.
+	// Messages rejected from the work queue are moved to DeadLetterQueueName, messages
+	// published to RetryQueueName are moved back to the work queue after their delay.
+	DeclareTopology(queueName string) error
+
+	// NewPublisher creates a publisher whose messages are confirmed by the broker
+	NewPublisher() (Publisher, error)
+
+	// Consume delivers messages from the queue, with at most prefetch
+	// unacknowledged deliveries at a time (0 means unlimited)
+	Consume(queueName string, prefetch int) (<-chan Delivery, error)
+
+	// Close closes the broker connection
+	Close()
+}
+
+// Publisher publishes persistent messages to a queue
+type Publisher interface {
+	// Publish sends payload encoded as JSON
+	Publish(routingKey string, payload interface{}) error
+
+	// PublishRaw sends an already encoded message with the given headers
+	PublishRaw(routingKey string, body []byte, headers map[string]interface{}) error
+
+	// Wait blocks until every published message has been confirmed by the broker
+	Wait() error
+
+	// IsClosed reports whether the publisher can no longer be used
+	IsClosed() bool
+
+	// Close releases the publisher
+	Close() error
+}
+
+// Acknowledger settles a single delivery
+type Acknowledger interface {
+	Ack() error
+	Nack(requeue bool) error
+}
+
+// Delivery is a message received from a queue
+type Delivery struct {
+	Body    []byte
+	Headers map[string]interface{}
+
+	acknowledger Acknowledger
+}
+
+// NewDelivery creates a delivery that is settled through acknowledger
+func NewDelivery(body []byte, headers map[string]interface{}, acknowledger Acknowledger) Delivery {
+	return Delivery{
+		Body:         body,
+		Headers:      headers,
+		acknowledger: acknowledger,
+	}
+}
+
+// Ack acknowledges the delivery so it is removed from the queue
+func (d Delivery) Ack() error {
+	return d.acknowledger.Ack()
+}
+
+// Nack rejects the delivery. It is put back on the queue when requeue is set,
+// otherwise it is moved to the dead-letter queue.
+func (d Delivery) Nack(requeue bool) error {
+	return d.acknowledger.Nack(requeue)
+}
+
+// RetryCount returns how many times the delivery has already been retried
+func (d Delivery) RetryCount() int {
+	switch count := d.Headers[RetryCountHeader].(type) {
+	case int8:
+		return int(count)
+	case int16:
+		return int(count)
+	case int32:
+		return int(count)
+	case int64:
+		return int(count)
+	case int:
+		return count
+	default:
+		return 0
+	}
+}
+
+// RetryDelays reads the delay before each retry from the configuration.
+// The number of delays is the number of retries before a message is dead-lettered.
+func RetryDelays() []time.Duration {
+	delaysMs := viper.GetIntSlice("broker.retry_delays_ms")
+	if len(delaysMs) == 0 {
+		return defaultRetryDelays
+	}
+
+	delays := make([]time.Duration, len(delaysMs))
+	for i, ms := range delaysMs {
+		delays[i] = time.Duration(ms) * time.Millisecond
+	}
+	return delays
+}
+
+// RetryQueueName returns the name of the delay queue used for the given retry (starting at 1)
+func RetryQueueName(queueName string, retry int) string {
+	return fmt.Sprintf("%s.retry.%d", queueName, retry)
+}
+
+// DeadLetterQueueName returns the name of the queue that holds messages that gave up
+func DeadLetterQueueName(queueName string) string {
+	return queueName + ".dead"
+}
@@ -0,0 +1,300 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// defaultMemoryQueueSize is the number of messages a memory queue holds before Publish blocks
+const defaultMemoryQueueSize = 100000
+
+// Memory is an in-process Broker backed by Go channels.
+// Messages are lost when the process exits, so it is meant for local development and tests.
+type Memory struct {
+	queueSize int
+
+	lock   sync.Mutex
+	queues map[string]*memoryQueue
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// memoryQueue is a queue of a Memory broker
+type memoryQueue struct {
+	messages chan memoryMessage
+	// ttl is set on retry queues, their messages are moved to deadLetter once it expires
+	ttl time.Duration
+	// deadLetter is the queue that rejected or expired messages are moved to
+	deadLetter string
+}
+
+// memoryMessage is a message stored in a memory queue
+type memoryMessage struct {
+	body    []byte
+	headers map[string]interface{}
+}
+
+// NewMemory creates an in-process broker. queueSize is the capacity of every queue,
+// 0 uses the default.
+func NewMemory(queueSize int) *Memory {
+	if queueSize <= 0 {
+		queueSize = defaultMemoryQueueSize
+	}
+
+	return &Memory{
+		queueSize: queueSize,
+		queues:    make(map[string]*memoryQueue),
+		done:      make(chan struct{}),
+	}
+}
+
+// DeclareTopology declares the work queue together with its retry and dead-letter queues
+func (m *Memory) DeclareTopology(queueName string) error {
+	deadLetterQueue := DeadLetterQueueName(queueName)
+	m.declareQueue(deadLetterQueue, 0, "")
+	m.declareQueue(queueName, 0, deadLetterQueue)
+
+	for i, delay := range RetryDelays() {
+		m.declareQueue(RetryQueueName(queueName, i+1), delay, queueName)
+	}
+	return nil
+}
+
+// declareQueue creates a queue unless it already exists
+func (m *Memory) declareQueue(queueName string, ttl time.Duration, deadLetter string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.queues[queueName]; ok {
+		return
+	}
+
+	m.queues[queueName] = &memoryQueue{
+		messages:   make(chan memoryMessage, m.queueSize),
+		ttl:        ttl,
+		deadLetter: deadLetter,
+	}
+}
+
+// getQueue returns a declared queue
+func (m *Memory) getQueue(queueName string) (*memoryQueue, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	queue, ok := m.queues[queueName]
+	if !ok {
+		return nil, fmt.Errorf("queue %s is not declared", queueName)
+	}
+	return queue, nil
+}
+
+// route stores a message in a queue. Messages sent to a queue with a TTL
+// are moved to its dead-letter queue once the TTL expires.
+func (m *Memory) route(queueName string, message memoryMessage) error {
+	queue, err := m.getQueue(queueName)
+	if err != nil {
+		return err
+	}
+
+	// Nothing consumes from TTL queues, so the message only waits for its TTL
+	if queue.ttl > 0 {
+		time.AfterFunc(queue.ttl, func() {
+			m.deadLetter(queue, message)
+		})
+		return nil
+	}
+
+	select {
+	case queue.messages <- message:
+		return nil
+	case <-m.done:
+		return fmt.Errorf("broker closed")
+	}
+}
+
+// deadLetter moves a message to the dead-letter queue of the queue it came from
+func (m *Memory) deadLetter(queue *memoryQueue, message memoryMessage) {
+	if queue.deadLetter == "" {
+		return
+	}
+	// Errors only happen once the broker is closed, the message is lost with it
+	m.route(queue.deadLetter, message)
+}
+
+// offer stores a message in a queue without waiting for room. Nack runs on the consumer and
+// nothing may consume the dead-letter queue, so a message that finds it full is dropped and logged.
+func (m *Memory) offer(queueName string, message memoryMessage) {
+	if queueName == "" {
+		return
+	}
+	queue, err := m.getQueue(queueName)
+	if err != nil {
+		log.Printf("Dropped a dead-lettered message: %v", err)
+		return
+	}
+
+	select {
+	case queue.messages <- message:
+	default:
+		log.Printf("Dropped a dead-lettered message, queue %s is full", queueName)
+	}
+}
+
+// NewPublisher creates a publisher, messages are confirmed as soon as they are queued
+func (m *Memory) NewPublisher() (Publisher, error) {
+	return &memoryPublisher{broker: m}, nil
+}
+
+// Consume delivers messages from the queue, with at most prefetch unacknowledged deliveries at a time
+func (m *Memory) Consume(queueName string, prefetch int) (<-chan Delivery, error) {
+	queue, err := m.getQueue(queueName)
+	if err != nil {
+		return nil, err
+	}
+
+	// inFlight limits the unacknowledged deliveries, nil means unlimited
+	var inFlight chan struct{}
+	if prefetch > 0 {
+		inFlight = make(chan struct{}, prefetch)
+	}
+
+	deliveries := make(chan Delivery)
+	go func() {
+		defer close(deliveries)
+
+		for {
+			// Wait for a free prefetch slot
+			if inFlight != nil {
+				select {
+				case inFlight <- struct{}{}:
+				case <-m.done:
+					return
+				}
+			}
+
+			var message memoryMessage
+			select {
+			case message = <-queue.messages:
+			case <-m.done:
+				return
+			}
+
+			acknowledger := &memoryAcknowledger{
+				broker:   m,
+				queue:    queue,
+				message:  message,
+				inFlight: inFlight,
+			}
+
+			select {
+			case deliveries <- NewDelivery(message.body, message.headers, acknowledger):
+			case <-m.done:
+				return
+			}
+		}
+	}()
+
+	return deliveries, nil
+}
+
+// Close stops every consumer, messages still queued are dropped
+func (m *Memory) Close() {
+	m.closeOnce.Do(func() {
+		close(m.done)
+	})
+}
+
+// memoryAcknowledger settles a delivery from a memory queue
+type memoryAcknowledger struct {
+	broker   *Memory
+	queue    *memoryQueue
+	message  memoryMessage
+	inFlight chan struct{}
+
+	lock    sync.Mutex
+	settled bool
+}
+
+// settle marks the delivery as settled and frees its prefetch slot
+func (a *memoryAcknowledger) settle() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.settled {
+		return fmt.Errorf("delivery already acknowledged")
+	}
+	a.settled = true
+
+	if a.inFlight != nil {
+		<-a.inFlight
+	}
+	return nil
+}
+
+func (a *memoryAcknowledger) Ack() error {
+	return a.settle()
+}
+
+func (a *memoryAcknowledger) Nack(requeue bool) error {
+	if err := a.settle(); err != nil {
+		return err
+	}
+
+	if !requeue {
+		a.broker.offer(a.queue.deadLetter, a.message)
+		return nil
+	}
+
+	// Requeue without blocking the consumer in case the queue is full
+	go func() {
+		select {
+		case a.queue.messages <- a.message:
+		case <-a.broker.done:
+		}
+	}()
+	return nil
+}
+
+// memoryPublisher publishes to a Memory broker
+type memoryPublisher struct {
+	broker *Memory
+}
+
+func (p *memoryPublisher) Publish(routingKey string, payload interface{}) error {
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON payload: %v", err)
+	}
+
+	return p.PublishRaw(routingKey, jsonPayload, nil)
+}
+
+func (p *memoryPublisher) PublishRaw(routingKey string, body []byte, headers map[string]interface{}) error {
+	err := p.broker.route(routingKey, memoryMessage{body: body, headers: headers})
+	if err != nil {
+		return fmt.Errorf("failed to publish message: %v", err)
+	}
+	return nil
+}
+
+// Wait returns right away, messages are queued by the time PublishRaw returns
+func (p *memoryPublisher) Wait() error {
+	return nil
+}
+
+func (p *memoryPublisher) IsClosed() bool {
+	select {
+	case <-p.broker.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *memoryPublisher) Close() error {
+	return nil
+}
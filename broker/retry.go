@@ -0,0 +1,83 @@
+package broker
+
+import (
+	"fmt"
+	"time"
+)
+
+// Retrier schedules failed deliveries for another attempt through the retry queues
+type Retrier struct {
+	broker    Broker
+	publisher Publisher
+	queueName string
+	delays    []time.Duration
+}
+
+// NewRetrier creates a Retrier for messages consumed from queueName
+func NewRetrier(b Broker, queueName string) (*Retrier, error) {
+	publisher, err := b.NewPublisher()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Retrier{
+		broker:    b,
+		publisher: publisher,
+		queueName: queueName,
+		delays:    RetryDelays(),
+	}, nil
+}
+
+// MaxAttempts is the number of times a message is processed before it is dead-lettered
+func (rt *Retrier) MaxAttempts() int {
+	return len(rt.delays) + 1
+}
+
+// Retry publishes the delivery to the next retry queue and acknowledges it.
+// It returns false without touching the delivery once every retry has been used,
+// the caller should then reject it so it is dead-lettered.
+func (rt *Retrier) Retry(delivery Delivery) (bool, error) {
+	retries := delivery.RetryCount()
+	if retries >= len(rt.delays) {
+		return false, nil
+	}
+
+	// Copy the headers so the retry count of the original delivery isn't changed
+	headers := map[string]interface{}{}
+	for key, value := range delivery.Headers {
+		headers[key] = value
+	}
+	headers[RetryCountHeader] = int32(retries + 1)
+
+	// Replace the publisher if its channel was lost with the connection
+	if rt.publisher.IsClosed() {
+		publisher, err := rt.broker.NewPublisher()
+		if err != nil {
+			return false, err
+		}
+		rt.publisher.Close()
+		rt.publisher = publisher
+	}
+
+	err := rt.publisher.PublishRaw(RetryQueueName(rt.queueName, retries+1), delivery.Body, headers)
+	if err != nil {
+		return false, err
+	}
+
+	// Only drop the original once the broker has the retry
+	err = rt.publisher.Wait()
+	if err != nil {
+		return false, err
+	}
+
+	err = delivery.Ack()
+	if err != nil {
+		return true, fmt.Errorf("failed to acknowledge retried message: %v", err)
+	}
+	return true, nil
+}
+
+// Close closes the retry publisher
+func (rt *Retrier) Close() error {
+	return rt.publisher.Close()
+}
@@ -1,102 +1,359 @@
 package consumer
 
 import (
+	"context"
+	"csv-handler/broker"
+	"csv-handler/dataset"
+	"csv-handler/ingest"
 	"csv-handler/postgres"
-	"csv-handler/rabbitmq"
 	redisclient "csv-handler/redis"
 	"encoding/json"
 	"fmt"
 	"log"
-	"strings"
 	"time"
 
 	"github.com/spf13/viper"
 )
 
-// StartWorker starts the consumer worker to consume messages
-func StartWorker() {
-	// Get the RabbitMQ instance
-	rabbitMQ := rabbitmq.GetRabbitMQInstance()
+// worker holds the clients used by a single consumer goroutine
+type worker struct {
+	id       int
+	pgClient *postgres.Client
+	myredis  *redisclient.Client
+	retrier  *broker.Retrier
+	datasets *dataset.Registry
 
-	// Create a new PostgreSQL client
-	pgClient, err := postgres.NewClient()
+	// failedJobs holds the fail_on_conflict import jobs known to have failed, their rows are not written
+	failedJobs map[int64]bool
+}
+
+// StartWorker starts the consumer worker to consume messages.
+// Several workers can run at once, each on its own channel, sharing the broker, PostgreSQL and Redis clients.
+// rdb may be nil, rows are then not cached.
+// When worker.batch_size is greater than 1 deliveries are written in batches,
+// otherwise every delivery is inserted on its own.
+//
+// Rows are validated against the dataset of their job and written using its import mode,
+// see postgres.MergeRecords.
+// Rows that fail because of the data are saved as rejects and dead-lettered right away.
+// Once an existing key fails a fail_on_conflict job, its remaining rows are rejected without being written.
+// Rows that fail because PostgreSQL is unavailable are retried through the retry queues
+// and only rejected once every retry has been used.
+// Every query is bounded by postgres.query_timeout_ms.
+func StartWorker(id int, messageBroker broker.Broker, pgClient *postgres.Client, rdb *redisclient.Client, datasets *dataset.Registry) {
+	queueName := viper.GetString("rabbitmq.csv_rabbitmq")
+
+	// Create the retrier used for temporary failures
+	retrier, err := broker.NewRetrier(messageBroker, queueName)
 	if err != nil {
-		log.Fatalf("Failed to initialize PostgreSQL client: %v", err)
+		log.Printf("Worker %d failed to create retrier: %v", id, err)
+		return
 	}
-	defer pgClient.Close()
+	defer retrier.Close()
 
-	// Create a new Redis client
-	rdb, err := redisclient.NewClient()
+	// Create a channel to receive delivery notifications
+	deliveryChan, err := messageBroker.Consume(queueName, viper.GetInt("worker.prefetch"))
 	if err != nil {
-		fmt.Println("Failed to create Redis client:", err)
+		log.Printf("Worker %d failed to start consumer: %v", id, err)
 		return
 	}
-	defer rdb.Close()
+	log.Printf("Worker %d started", id)
 
-	// Declare and publish to Queue1
-	err = rabbitMQ.DeclareQueue(viper.GetString("rabbitmq.csv_rabbitmq"))
-	if err != nil {
-		log.Fatalf("Failed to declare queue: %v", err)
+	w := &worker{
+		id:         id,
+		pgClient:   pgClient,
+		myredis:    rdb,
+		retrier:    retrier,
+		datasets:   datasets,
+		failedJobs: make(map[int64]bool),
 	}
 
-	// Create a channel to receive delivery notifications
-	deliveryChan, err := rabbitMQ.Consume(viper.GetString("rabbitmq.csv_rabbitmq"))
-	if err != nil {
-		log.Println("Failed to start consumer:", err)
+	batchSize := viper.GetInt("worker.batch_size")
+	if batchSize > 1 {
+		flushInterval := time.Duration(viper.GetInt("worker.flush_interval_ms")) * time.Millisecond
+		w.consumeBatches(deliveryChan, batchSize, flushInterval)
 		return
 	}
 
 	// Start processing messages
 	for delivery := range deliveryChan {
-		// Process the message
-		err := processMessage(delivery.Body, pgClient, rdb)
-		if err != nil {
-			log.Println("Failed to process message:", err)
+		w.handleDelivery(delivery)
+	}
+}
+
+// consumeBatches collects up to batchSize deliveries, or whatever arrived within
+// flushInterval of the first one, and writes them together
+func (w *worker) consumeBatches(deliveryChan <-chan broker.Delivery, batchSize int, flushInterval time.Duration) {
+	batch := make([]broker.Delivery, 0, batchSize)
+
+	// flushTimer is nil while the batch is empty
+	var flushTimer <-chan time.Time
+
+	flush := func() {
+		if len(batch) > 0 {
+			w.processBatch(batch)
+		}
+		batch = batch[:0]
+		flushTimer = nil
+	}
+
+	for {
+		select {
+		case delivery, ok := <-deliveryChan:
+			if !ok {
+				// The channel was closed, write what is left
+				flush()
+				return
+			}
+
+			batch = append(batch, delivery)
+			if len(batch) == 1 {
+				flushTimer = time.After(flushInterval)
+			}
+			if len(batch) >= batchSize {
+				flush()
+			}
 
-			// Nack the message
-			err := delivery.Nack(false, false)
-			if err != nil {
+		case <-flushTimer:
+			flush()
+		}
+	}
+}
+
+// handleDelivery processes a single delivery and acknowledges it
+func (w *worker) handleDelivery(delivery broker.Delivery) {
+	// Process the message
+	message, err := w.processMessage(delivery.Body)
+	if err != nil {
+		w.handleFailure(delivery, message, err)
+		return
+	}
+
+	//Explicitly acknowledge the message
+	err = delivery.Ack()
+	if err != nil {
+		log.Println("consumer Failed to acknowledge message:", err)
+	}
+}
+
+// handleFailure retries a delivery that failed for a temporary reason, and rejects it otherwise.
+// message is nil when the delivery could not be decoded.
+func (w *worker) handleFailure(delivery broker.Delivery, message *ingest.Message, err error) {
+	log.Println("Failed to process message:", err)
+
+	if postgres.IsTemporary(err) {
+		retried, retryErr := w.retrier.Retry(delivery)
+		if retryErr != nil {
+			// The retry could not be published, put the message back on the queue instead
+			log.Println("Failed to retry message:", retryErr)
+			if err := delivery.Nack(true); err != nil {
 				log.Println("Failed to nack message:", err)
 			}
+			return
+		}
+		if retried {
+			return
+		}
+		err = fmt.Errorf("giving up after %d attempts: %w", w.retrier.MaxAttempts(), err)
+	}
 
+	// Save the row and dead-letter the message
+	if message != nil {
+		w.rejectMessage(message, err)
+	} else {
+		w.saveReject(0, 0, string(delivery.Body), err)
+	}
+
+	err = delivery.Nack(false)
+	if err != nil {
+		log.Println("Failed to nack message:", err)
+	}
+}
+
+// processBatch writes a batch of deliveries and acknowledges them together.
+// Rows are grouped by dataset and import mode and every group is written in one transaction.
+// Rows that can't be decoded or validated are rejected on their own. If a group fails
+// because PostgreSQL is unavailable it is retried, otherwise its rows are written
+// one by one so a single bad row doesn't reject the whole group.
+func (w *worker) processBatch(batch []broker.Delivery) {
+	groups := make(map[string]*batchGroup)
+	var order []string
+
+	for _, delivery := range batch {
+		message, ds, values, err := w.decodeMessage(delivery.Body)
+		if err != nil {
+			w.handleFailure(delivery, message, err)
 			continue
 		}
 
-		//Explicitly acknowledge the message
-		err = delivery.Ack(false)
-		if err != nil {
+		mode := importMode(message)
+		groupKey := ds.Name + "/" + mode
+		group, ok := groups[groupKey]
+		if !ok {
+			group = &batchGroup{dataset: ds, mode: mode}
+			groups[groupKey] = group
+			order = append(order, groupKey)
+		}
+		group.deliveries = append(group.deliveries, delivery)
+		group.messages = append(group.messages, message)
+		group.rows = append(group.rows, values)
+	}
+
+	for _, groupKey := range order {
+		w.processGroup(groups[groupKey])
+	}
+}
+
+// batchGroup holds the rows of a batch that share a dataset and an import mode
+type batchGroup struct {
+	dataset    *dataset.Dataset
+	mode       string
+	deliveries []broker.Delivery
+	messages   []*ingest.Message
+	rows       [][]interface{}
+}
+
+// processGroup writes the rows of a batch group and acknowledges them
+func (w *worker) processGroup(group *batchGroup) {
+	// Write every row in one transaction
+	ctx, cancel := postgres.WithQueryTimeout(context.Background())
+	outcomes, err := w.pgClient.MergeRecords(ctx, group.dataset, group.mode, group.rows)
+	cancel()
+	if err != nil && postgres.IsTemporary(err) {
+		for i, delivery := range group.deliveries {
+			w.handleFailure(delivery, group.messages[i], err)
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to write batch of %d rows, writing them one by one: %v", len(group.rows), err)
+		for _, delivery := range group.deliveries {
+			w.handleDelivery(delivery)
+		}
+		return
+	}
+
+	// Count the written rows per import job
+	progress := make(map[int64]*postgres.ImportProgress)
+	for i, message := range group.messages {
+		if progress[message.JobID] == nil {
+			progress[message.JobID] = &postgres.ImportProgress{}
+		}
+		progress[message.JobID].Add(outcomes[i])
+		if outcomes[i] != postgres.RowSkipped {
+			w.cacheRow(group.dataset, group.rows[i])
+		}
+	}
+	for jobID, jobProgress := range progress {
+		w.recordProgress(jobID, *jobProgress)
+	}
+
+	// Acknowledge the whole group
+	for _, delivery := range group.deliveries {
+		if err := delivery.Ack(); err != nil {
 			log.Println("consumer Failed to acknowledge message:", err)
 		}
 	}
 }
 
-func processMessage(message []byte, pgClient *postgres.Client, myredis *redisclient.Client) error {
-	str := string(message)
+// processMessage writes a single row using the import mode of its job. The decoded
+// message is returned together with the error when the write fails.
+func (w *worker) processMessage(body []byte) (*ingest.Message, error) {
+	message, ds, values, err := w.decodeMessage(body)
+	if err != nil {
+		return message, err
+	}
 
-	// Remove escape characters from the string
-	str = strings.ReplaceAll(str, `\"`, `"`)
+	// Write the data into PostgreSQL
+	ctx, cancel := postgres.WithQueryTimeout(context.Background())
+	outcome, err := w.pgClient.WriteRecord(ctx, ds, importMode(message), values)
+	cancel()
+	if err != nil {
+		return message, fmt.Errorf("Failed to insert data into PostgreSQL: %w", err)
+	}
+
+	var progress postgres.ImportProgress
+	progress.Add(outcome)
+	w.recordProgress(message.JobID, progress)
+
+	if outcome != postgres.RowSkipped {
+		w.cacheRow(ds, values)
+	}
+	return message, nil
+}
 
-	// Remove surrounding double quotes
-	str = strings.Trim(str, `"`)
+// importMode returns the import mode of a message, messages without one are inserted
+func importMode(message *ingest.Message) string {
+	if message.Mode == "" {
+		return postgres.ImportModeInsert
+	}
+	return message.Mode
+}
 
-	// Create a variable to hold the JSON data
-	var data map[string]interface{}
+// decodeMessage decodes a row published by the upload handler and validates it against its dataset.
+// The message is nil if the body could not be decoded.
+func (w *worker) decodeMessage(body []byte) (*ingest.Message, *dataset.Dataset, []interface{}, error) {
+	var message ingest.Message
+	err := json.Unmarshal(body, &message)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Failed to unmarshal JSON: %w", err)
+	}
 
-	// Unmarshal the string into the data variable
-	err := json.Unmarshal([]byte(str), &data)
+	// Messages without a dataset were published before datasets existed
+	ds, err := w.datasets.Get(message.Dataset)
 	if err != nil {
-		//fmt.Println("Failed to unmarshal JSON:", err)
-		return fmt.Errorf("Failed to unmarshal JSON: %w", err)
+		return &message, nil, nil, err
+	}
+
+	if importMode(&message) == postgres.ImportModeFailOnConflict && w.jobFailed(message.JobID) {
+		return &message, nil, nil, fmt.Errorf("import job %d failed on an existing row, the row was not written", message.JobID)
 	}
 
-	// Insert the data into PostgreSQL
-	err = pgClient.InsertCsvData(data)
+	values, err := ds.Values(message.Data)
 	if err != nil {
-		return fmt.Errorf("Failed to insert data into PostgreSQL: %w", err)
+		return &message, nil, nil, fmt.Errorf("Invalid row: %w", err)
 	}
 
-	// // Set a key-value pair
-	err = myredis.Set(data["id"].(string), str, time.Hour)
+	return &message, ds, values, nil
+}
+
+// jobFailed reports whether an import job has failed. Failed jobs are remembered,
+// the state of the others is read again for every row since another worker may fail them.
+func (w *worker) jobFailed(jobID int64) bool {
+	if jobID == 0 {
+		return false
+	}
+	if w.failedJobs[jobID] {
+		return true
+	}
+
+	ctx, cancel := postgres.WithQueryTimeout(context.Background())
+	defer cancel()
+
+	job, err := w.pgClient.GetImportJob(ctx, jobID)
+	if err != nil {
+		log.Println("Failed to read import job:", err)
+		return false
+	}
+	if job.State == postgres.ImportStateFailed {
+		w.failedJobs[jobID] = true
+	}
+	return w.failedJobs[jobID]
+}
+
+// cacheRow stores the written row in Redis by its key, in the same form GET /records/{id} returns it
+func (w *worker) cacheRow(ds *dataset.Dataset, values []interface{}) {
+	if w.myredis == nil {
+		return
+	}
+
+	str, err := json.Marshal(ds.Record(values))
+	if err != nil {
+		fmt.Println("Failed to marshal row for cache:", err)
+		return
+	}
+
+	err = w.myredis.Set(ds.CacheKey(values[ds.Index(ds.Key)].(int64)), string(str), time.Hour)
 	if err != nil {
 		fmt.Println("Failed to set key-value pair:", err)
 	}
@@ -109,5 +366,49 @@ func processMessage(message []byte, pgClient *postgres.Client, myredis *rediscli
 	// if err != nil {
 	// 	log.Fatalf("Failed to add member to sorted set: %v", err)
 	// }
-	return nil
+}
+
+// rejectMessage saves a decoded row as a reject and counts it as failed on its import job
+func (w *worker) rejectMessage(message *ingest.Message, reason error) {
+	rawValues, _ := json.Marshal(message.Data)
+	w.saveReject(message.JobID, message.Line, string(rawValues), reason)
+	w.recordProgress(message.JobID, postgres.ImportProgress{Failed: 1})
+
+	// In fail_on_conflict mode an existing key fails the whole import job
+	if importMode(message) == postgres.ImportModeFailOnConflict && postgres.IsUniqueViolation(reason) {
+		ctx, cancel := postgres.WithQueryTimeout(context.Background())
+		defer cancel()
+		err := w.pgClient.FailImportJob(ctx, message.JobID, fmt.Sprintf("line %d: the row already exists", message.Line))
+		if err != nil {
+			log.Println("Failed to update import job:", err)
+		}
+		w.failedJobs[message.JobID] = true
+	}
+}
+
+// saveReject stores a failed row so it can be downloaded with the import job rejects
+func (w *worker) saveReject(jobID int64, line int, rawValues string, reason error) {
+	ctx, cancel := postgres.WithQueryTimeout(context.Background())
+	defer cancel()
+
+	err := w.pgClient.InsertImportReject(ctx, jobID, line, rawValues, reason.Error())
+	if err != nil {
+		log.Println("Failed to save rejected row:", err)
+	}
+}
+
+// recordProgress updates the import job counters for processed rows
+func (w *worker) recordProgress(jobID int64, progress postgres.ImportProgress) {
+	// Rows published before import jobs existed have no job to update
+	if jobID == 0 {
+		return
+	}
+
+	ctx, cancel := postgres.WithQueryTimeout(context.Background())
+	defer cancel()
+
+	err := w.pgClient.RecordImportProgress(ctx, jobID, progress)
+	if err != nil {
+		log.Println("Failed to record import progress:", err)
+	}
 }
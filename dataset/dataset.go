@@ -0,0 +1,292 @@
+package dataset
+
+import (
+	"csv-handler/query"
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Column types accepted in dataset definitions
+const (
+	TypeInt       = "int"
+	TypeText      = "text"
+	TypeTimestamp = "timestamp"
+)
+
+// FormatEmail requires text values to be a single email address
+const FormatEmail = "email"
+
+// identifierPattern limits table and column names, they are still quoted in every query
+var identifierPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+// ErrUnknown is returned when a dataset name is not defined
+var ErrUnknown = errors.New("unknown dataset")
+
+// ColumnError is returned by Values when a column of a row is missing or invalid
+type ColumnError struct {
+	Column string
+	Err    error
+}
+
+func (e *ColumnError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ColumnError) Unwrap() error {
+	return e.Err
+}
+
+// Column is a column of a dataset
+type Column struct {
+	Name string `mapstructure:"name" json:"name"`
+	// Type is int, text or timestamp
+	Type string `mapstructure:"type" json:"type"`
+	// Required columns must be in every row and can't be null
+	Required bool `mapstructure:"required" json:"required"`
+	// MaxLength limits text values, 0 is unlimited
+	MaxLength int `mapstructure:"max_length" json:"max_length,omitempty"`
+	// Format validates text values, only email is supported
+	Format string `mapstructure:"format" json:"format,omitempty"`
+	// NullValues are raw values stored as NULL, such as -1
+	NullValues []string `mapstructure:"null_values" json:"null_values,omitempty"`
+	// Aliases are other header names the column is uploaded under, matched like the column name
+	Aliases []string `mapstructure:"aliases" json:"aliases,omitempty"`
+	// Formats are the accepted timestamp formats, tried in order: epoch_s, epoch_ms, epoch_us,
+	// rfc3339 or a Go time layout such as "2006-01-02 15:04:05". The default is epoch_ms.
+	Formats []string `mapstructure:"formats" json:"formats,omitempty"`
+	// Timezone is the IANA timezone of timestamps parsed with a layout that has no offset, UTC by default
+	Timezone string `mapstructure:"timezone" json:"timezone,omitempty"`
+
+	columnType query.ColumnType
+	// location is the loaded Timezone
+	location *time.Location
+}
+
+// Dataset describes one shape of uploaded file and the table its rows are written to
+type Dataset struct {
+	Name  string `mapstructure:"name" json:"name"`
+	Table string `mapstructure:"table" json:"table"`
+	// Key is the int column that identifies a row
+	Key string `mapstructure:"key" json:"key"`
+	// VersionColumns are timestamp columns, an upsert only replaces a row
+	// when the newest of them is newer than in the existing row
+	VersionColumns []string `mapstructure:"version_columns" json:"version_columns,omitempty"`
+	// SoftDeleteColumn is the timestamp column DELETE sets, empty if rows can only be hard deleted
+	SoftDeleteColumn string   `mapstructure:"soft_delete_column" json:"soft_delete_column,omitempty"`
+	Columns          []Column `mapstructure:"columns" json:"columns"`
+
+	// index maps column names to their position in Columns
+	index map[string]int
+	// names maps the normalized names and aliases of the columns to the column names
+	names map[string]string
+}
+
+// Validate checks the definition and prepares it for use
+func (d *Dataset) Validate() error {
+	if d.Name == "" {
+		return fmt.Errorf("dataset has no name")
+	}
+	if !identifierPattern.MatchString(d.Table) {
+		return fmt.Errorf("dataset %s: invalid table name %q", d.Name, d.Table)
+	}
+	if len(d.Columns) == 0 {
+		return fmt.Errorf("dataset %s has no columns", d.Name)
+	}
+
+	d.index = make(map[string]int, len(d.Columns))
+	d.names = make(map[string]string, len(d.Columns))
+	for i := range d.Columns {
+		column := &d.Columns[i]
+		if !identifierPattern.MatchString(column.Name) {
+			return fmt.Errorf("dataset %s: invalid column name %q", d.Name, column.Name)
+		}
+		if _, ok := d.index[column.Name]; ok {
+			return fmt.Errorf("dataset %s: column %s is defined twice", d.Name, column.Name)
+		}
+
+		switch column.Type {
+		case TypeInt:
+			column.columnType = query.Int
+		case TypeText:
+			column.columnType = query.Text
+		case TypeTimestamp:
+			column.columnType = query.Timestamp
+		default:
+			return fmt.Errorf("dataset %s: column %s has invalid type %q, expected int, text or timestamp",
+				d.Name, column.Name, column.Type)
+		}
+		if column.Format != "" && (column.Format != FormatEmail || column.Type != TypeText) {
+			return fmt.Errorf("dataset %s: column %s has invalid format %q", d.Name, column.Name, column.Format)
+		}
+		if err := column.prepareTimestamp(); err != nil {
+			return fmt.Errorf("dataset %s: column %s: %w", d.Name, column.Name, err)
+		}
+
+		d.index[column.Name] = i
+
+		// Headers are matched by normalized name, so two columns can't share one
+		for _, name := range append([]string{column.Name}, column.Aliases...) {
+			normalized := normalizeName(name)
+			if other, ok := d.names[normalized]; ok && other != column.Name {
+				return fmt.Errorf("dataset %s: %q matches both column %s and column %s", d.Name, name, other, column.Name)
+			}
+			d.names[normalized] = column.Name
+		}
+	}
+
+	key, ok := d.Column(d.Key)
+	if !ok || key.Type != TypeInt || !key.Required {
+		return fmt.Errorf("dataset %s: key %q must be a required int column", d.Name, d.Key)
+	}
+	for _, name := range d.VersionColumns {
+		if column, ok := d.Column(name); !ok || column.Type != TypeTimestamp {
+			return fmt.Errorf("dataset %s: version column %q must be a timestamp column", d.Name, name)
+		}
+	}
+	if d.SoftDeleteColumn != "" {
+		column, ok := d.Column(d.SoftDeleteColumn)
+		if !ok || column.Type != TypeTimestamp || column.Required {
+			return fmt.Errorf("dataset %s: soft delete column %q must be an optional timestamp column",
+				d.Name, d.SoftDeleteColumn)
+		}
+	}
+
+	return nil
+}
+
+// Column returns the column with the given name
+func (d *Dataset) Column(name string) (*Column, bool) {
+	i, ok := d.index[name]
+	if !ok {
+		return nil, false
+	}
+	return &d.Columns[i], true
+}
+
+// Index returns the position of a column in Columns and in the values returned by Values
+func (d *Dataset) Index(name string) int {
+	return d.index[name]
+}
+
+// ColumnNames returns the column names in definition order
+func (d *Dataset) ColumnNames() []string {
+	names := make([]string, len(d.Columns))
+	for i, column := range d.Columns {
+		names[i] = column.Name
+	}
+	return names
+}
+
+// FilterColumns returns the columns GET /records can filter and sort on
+func (d *Dataset) FilterColumns() query.Columns {
+	columns := make(query.Columns, len(d.Columns))
+	for _, column := range d.Columns {
+		columns[column.Name] = column.columnType
+	}
+	return columns
+}
+
+// ColumnType returns the query type of the column
+func (c *Column) ColumnType() query.ColumnType {
+	return c.columnType
+}
+
+// CacheKey is the Redis key a record is cached under
+func (d *Dataset) CacheKey(id int64) string {
+	return d.Name + ":" + strconv.FormatInt(id, 10)
+}
+
+// Values validates an uploaded row and converts it to the column values, in Columns order.
+// Ints are int64, timestamps time.Time in UTC and missing optional values nil.
+// Invalid rows return a *ColumnError.
+func (d *Dataset) Values(data map[string]string) ([]interface{}, error) {
+	values := make([]interface{}, len(d.Columns))
+	for i := range d.Columns {
+		column := &d.Columns[i]
+
+		raw, ok := data[column.Name]
+		if !ok && column.Required {
+			return nil, &ColumnError{Column: column.Name, Err: fmt.Errorf("missing required column %s", column.Name)}
+		}
+
+		value, err := column.ParseValue(raw)
+		if err != nil {
+			return nil, &ColumnError{Column: column.Name, Err: fmt.Errorf("invalid %s: %w", column.Name, err)}
+		}
+		if value == nil && column.Required {
+			return nil, &ColumnError{Column: column.Name, Err: fmt.Errorf("column %s can't be empty", column.Name)}
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// ParseValue converts a raw value of an uploaded row or a PATCH body to the column type.
+// Null values and empty ints and timestamps are nil, timestamps are parsed with the column
+// formats and timezone, and text is checked against the column length and format.
+func (c *Column) ParseValue(raw string) (interface{}, error) {
+	for _, nullValue := range c.NullValues {
+		if raw == nullValue {
+			return nil, nil
+		}
+	}
+
+	switch c.Type {
+	case TypeInt:
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			return nil, nil
+		}
+		value, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an integer", raw)
+		}
+		return value, nil
+
+	case TypeTimestamp:
+		return c.parseTimestamp(raw)
+
+	default:
+		// Empty text is stored as is, like the original csv_data import
+		return raw, c.checkText(raw)
+	}
+}
+
+// checkText validates a text value against the column length and format
+func (c *Column) checkText(value string) error {
+	if c.MaxLength > 0 && len(value) > c.MaxLength {
+		return fmt.Errorf("value is longer than %d characters", c.MaxLength)
+	}
+	if c.Format == FormatEmail && value != "" {
+		if address, err := mail.ParseAddress(value); err != nil || address.Address != value {
+			return fmt.Errorf("%q is not a valid email address", value)
+		}
+	}
+	return nil
+}
+
+// Record converts values returned by Values to the record returned by the API,
+// so cached rows look the same as rows read from PostgreSQL
+func (d *Dataset) Record(values []interface{}) map[string]interface{} {
+	record := make(map[string]interface{}, len(d.Columns))
+	for i, column := range d.Columns {
+		record[column.Name] = values[i]
+	}
+	return record
+}
+
+// Version returns the newest value of the version columns, or the zero time if they are all null
+func (d *Dataset) Version(values []interface{}) time.Time {
+	var version time.Time
+	for _, name := range d.VersionColumns {
+		if t, ok := values[d.index[name]].(time.Time); ok && t.After(version) {
+			version = t
+		}
+	}
+	return version
+}
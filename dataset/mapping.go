@@ -0,0 +1,156 @@
+package dataset
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// HeaderMap maps the headers of an uploaded file to dataset columns
+type HeaderMap struct {
+	Headers []string
+	// Columns holds the column of each header, empty for headers that are ignored
+	Columns []string
+
+	dataset *Dataset
+	// overrides are the normalized mapping entries, known the headers and mapped the columns they map to
+	overrides map[string]string
+	known     map[string]bool
+	mapped    map[string]bool
+}
+
+// normalizeName lowercases a header or column name and drops everything but letters and digits,
+// so "E-mail Address", "email_address" and "EmailAddress" all match
+func normalizeName(name string) string {
+	var normalized strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			normalized.WriteRune(r)
+		}
+	}
+	return normalized.String()
+}
+
+// MapHeaders matches the headers of an uploaded file to the dataset columns.
+// mapping overrides the match of individual headers with a column name, or with an empty
+// name to ignore the header. Other headers match a column when their normalized name equals
+// the normalized name or an alias of the column, and are ignored otherwise.
+// It fails if a column is matched twice or a required column is not matched.
+func (d *Dataset) MapHeaders(headers []string, mapping map[string]string) (*HeaderMap, error) {
+	// Normalize the mapping so it matches headers the same way columns do
+	overrides := make(map[string]string, len(mapping))
+	for header, column := range mapping {
+		if _, ok := d.Column(column); column != "" && !ok {
+			return nil, fmt.Errorf("mapping of %q: unknown column %q", header, column)
+		}
+		overrides[normalizeName(header)] = column
+	}
+
+	headerMap := &HeaderMap{
+		Headers:   headers,
+		Columns:   make([]string, len(headers)),
+		dataset:   d,
+		overrides: overrides,
+		known:     make(map[string]bool, len(headers)),
+		mapped:    make(map[string]bool),
+	}
+	mappedBy := make(map[string]string)
+	used := make(map[string]bool)
+
+	for i, header := range headers {
+		headerMap.known[header] = true
+		normalized := normalizeName(header)
+		if _, ok := overrides[normalized]; ok {
+			used[normalized] = true
+		}
+
+		column := headerMap.column(header)
+		if column == "" {
+			continue
+		}
+
+		if previous, ok := mappedBy[column]; ok {
+			return nil, fmt.Errorf("headers %q and %q both map to column %s", previous, header, column)
+		}
+		mappedBy[column] = header
+		headerMap.mapped[column] = true
+		headerMap.Columns[i] = column
+	}
+
+	// Every mapping entry must be used, a typo would otherwise go unnoticed
+	for header := range mapping {
+		if !used[normalizeName(header)] {
+			return nil, fmt.Errorf("mapping of %q: the file has no such header", header)
+		}
+	}
+
+	var missing []string
+	for _, column := range d.Columns {
+		if _, ok := mappedBy[column.Name]; column.Required && !ok {
+			missing = append(missing, column.Name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("missing required columns: %s", strings.Join(missing, ", "))
+	}
+
+	return headerMap, nil
+}
+
+// column returns the column a header maps to, or an empty string for a header that is ignored
+func (m *HeaderMap) column(header string) string {
+	normalized := normalizeName(header)
+	if column, ok := m.overrides[normalized]; ok {
+		return column
+	}
+	return m.dataset.names[normalized]
+}
+
+// Apply converts a row keyed by header to a row keyed by column, dropping ignored headers.
+// The objects of a JSON file may have fields that aren't headers: they are matched like headers,
+// and ignored when they match no column or a column another field already maps to.
+func (m *HeaderMap) Apply(values map[string]string) map[string]string {
+	mapped := make(map[string]string, len(values))
+	for i, header := range m.Headers {
+		if column := m.Columns[i]; column != "" {
+			if value, ok := values[header]; ok {
+				mapped[column] = value
+			}
+		}
+	}
+
+	var fields []string
+	for field := range values {
+		if !m.known[field] {
+			fields = append(fields, field)
+		}
+	}
+	// Sorted so the same field wins a column on every row
+	sort.Strings(fields)
+	for _, field := range fields {
+		column := m.column(field)
+		if _, ok := mapped[column]; column == "" || m.mapped[column] || ok {
+			continue
+		}
+		mapped[column] = values[field]
+	}
+	return mapped
+}
+
+// ApplyDates replaces the values of spreadsheet date cells, keyed by header, in a row returned by Apply.
+// Dates are wall times: they are taken in the timezone of their timestamp column and written in its
+// first format, so they are parsed like any other value. Dates mapped to other columns are kept as text.
+func (m *HeaderMap) ApplyDates(row map[string]string, dates map[string]time.Time) {
+	for i, header := range m.Headers {
+		date, ok := dates[header]
+		if !ok || m.Columns[i] == "" {
+			continue
+		}
+		if column, ok := m.dataset.Column(m.Columns[i]); ok && column.Type == TypeTimestamp {
+			row[column.Name] = column.formatWallTime(date)
+		}
+	}
+}
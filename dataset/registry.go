@@ -0,0 +1,73 @@
+package dataset
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/spf13/viper"
+)
+
+// Registry holds the dataset definitions by name
+type Registry struct {
+	datasets    map[string]*Dataset
+	defaultName string
+}
+
+// Load reads the dataset definitions from the datasets config key.
+// default_dataset names the dataset used when a request doesn't name one.
+func Load() (*Registry, error) {
+	var definitions []*Dataset
+	if err := viper.UnmarshalKey("datasets", &definitions); err != nil {
+		return nil, fmt.Errorf("failed to read dataset definitions: %w", err)
+	}
+	return NewRegistry(viper.GetString("default_dataset"), definitions...)
+}
+
+// NewRegistry validates the definitions and creates a registry.
+// defaultName may be empty if every request names its dataset.
+func NewRegistry(defaultName string, definitions ...*Dataset) (*Registry, error) {
+	registry := &Registry{
+		datasets:    make(map[string]*Dataset, len(definitions)),
+		defaultName: defaultName,
+	}
+
+	for _, definition := range definitions {
+		if err := definition.Validate(); err != nil {
+			return nil, err
+		}
+		if _, ok := registry.datasets[definition.Name]; ok {
+			return nil, fmt.Errorf("dataset %s is defined twice", definition.Name)
+		}
+		registry.datasets[definition.Name] = definition
+	}
+
+	if _, ok := registry.datasets[defaultName]; defaultName != "" && !ok {
+		return nil, fmt.Errorf("default dataset %s is not defined", defaultName)
+	}
+	return registry, nil
+}
+
+// Get returns the dataset with the given name, or the default dataset for an empty name
+func (r *Registry) Get(name string) (*Dataset, error) {
+	if name == "" {
+		name = r.defaultName
+	}
+
+	dataset, ok := r.datasets[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknown, name)
+	}
+	return dataset, nil
+}
+
+// All returns every dataset sorted by name
+func (r *Registry) All() []*Dataset {
+	datasets := make([]*Dataset, 0, len(r.datasets))
+	for _, dataset := range r.datasets {
+		datasets = append(datasets, dataset)
+	}
+	sort.Slice(datasets, func(i, j int) bool {
+		return datasets[i].Name < datasets[j].Name
+	})
+	return datasets
+}
@@ -0,0 +1,150 @@
+package dataset
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Timestamp formats accepted in column definitions, any other format is a Go time layout
+const (
+	FormatEpochSeconds = "epoch_s"
+	FormatEpochMillis  = "epoch_ms"
+	FormatEpochMicros  = "epoch_us"
+	FormatRFC3339      = "rfc3339"
+)
+
+// epochUnits maps the epoch formats to their unit
+var epochUnits = map[string]time.Duration{
+	FormatEpochSeconds: time.Second,
+	FormatEpochMillis:  time.Millisecond,
+	FormatEpochMicros:  time.Microsecond,
+}
+
+// prepareTimestamp checks the timestamp formats and timezone of a column
+func (c *Column) prepareTimestamp() error {
+	if c.Type != TypeTimestamp {
+		if len(c.Formats) > 0 || c.Timezone != "" {
+			return fmt.Errorf("formats and timezone are only allowed on timestamp columns")
+		}
+		return nil
+	}
+
+	// The default keeps the original upload format
+	if len(c.Formats) == 0 {
+		c.Formats = []string{FormatEpochMillis}
+	}
+	for _, format := range c.Formats {
+		if _, ok := epochUnits[format]; ok || format == FormatRFC3339 {
+			continue
+		}
+		// A layout without a year can't describe a point in time
+		if !strings.Contains(format, "06") {
+			return fmt.Errorf("invalid timestamp format %q, expected epoch_s, epoch_ms, epoch_us, rfc3339 or a Go time layout", format)
+		}
+	}
+
+	c.location = time.UTC
+	if c.Timezone != "" {
+		location, err := time.LoadLocation(c.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid timezone %q: %w", c.Timezone, err)
+		}
+		c.location = location
+	}
+	return nil
+}
+
+// parseTimestamp converts a raw timestamp using the first column format that accepts it.
+// The result is in UTC, an empty value is nil.
+func (c *Column) parseTimestamp(raw string) (interface{}, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+
+	for _, format := range c.Formats {
+		var value time.Time
+		var err error
+		if unit, ok := epochUnits[format]; ok {
+			value, err = parseEpoch(raw, unit)
+		} else if format == FormatRFC3339 {
+			value, err = time.Parse(time.RFC3339Nano, raw)
+		} else {
+			// Layouts with an offset keep it, the column timezone is used otherwise
+			value, err = time.ParseInLocation(format, raw, c.location)
+		}
+		if err == nil {
+			return value.UTC(), nil
+		}
+	}
+
+	return nil, fmt.Errorf("%q is not a timestamp in any of the formats %s", raw, strings.Join(c.Formats, ", "))
+}
+
+// formatWallTime writes a wall time, taken in the column timezone, in the first column format
+func (c *Column) formatWallTime(wall time.Time) string {
+	value := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), wall.Nanosecond(), c.location)
+
+	switch format := c.Formats[0]; format {
+	case FormatEpochSeconds:
+		return strconv.FormatFloat(float64(value.UnixMilli())/1000, 'f', -1, 64)
+	case FormatEpochMillis:
+		return strconv.FormatInt(value.UnixMilli(), 10)
+	case FormatEpochMicros:
+		return strconv.FormatInt(value.UnixMicro(), 10)
+	case FormatRFC3339:
+		return value.Format(time.RFC3339Nano)
+	default:
+		return value.Format(format)
+	}
+}
+
+// parseEpoch converts a number of units since the epoch, keeping the fractional part
+// to the nanosecond. Numbers in exponent form are parsed as floats.
+func parseEpoch(raw string, unit time.Duration) (time.Time, error) {
+	number := raw
+	negative := strings.HasPrefix(number, "-")
+	if negative {
+		number = number[1:]
+	}
+
+	whole, fraction, hasFraction := strings.Cut(number, ".")
+	if whole == "" || (hasFraction && fraction == "") || !isDigits(whole) || !isDigits(fraction) {
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(0, 0).Add(time.Duration(f * float64(unit))), nil
+	}
+
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// The fraction of a unit, as a number of nanounits
+	if len(fraction) > 9 {
+		fraction = fraction[:9]
+	}
+	nanoUnits, _ := strconv.ParseInt(fraction+strings.Repeat("0", 9-len(fraction)), 10, 64)
+
+	perSecond := int64(time.Second / unit)
+	seconds := units / perSecond
+	nanos := (units%perSecond)*int64(unit) + nanoUnits*int64(unit)/int64(time.Second)
+	if negative {
+		seconds, nanos = -seconds, -nanos
+	}
+	return time.Unix(seconds, nanos), nil
+}
+
+// isDigits reports whether s only holds ASCII digits
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
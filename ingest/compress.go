@@ -0,0 +1,275 @@
+package ingest
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression formats detected from the first bytes of an upload
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionZip  = "zip"
+)
+
+// Magic numbers of the supported formats
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	// zipMagic starts a local file header, zipEmptyMagic an archive without entries
+	zipMagic      = []byte("PK\x03\x04")
+	zipEmptyMagic = []byte("PK\x05\x06")
+)
+
+// zstdMaxWindow limits the memory a zstd stream can ask the decoder for
+const zstdMaxWindow = 64 << 20
+
+// DetectCompression returns the compression format of a stream by peeking at its first bytes
+func DetectCompression(r *bufio.Reader) string {
+	prefix, _ := r.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(prefix, gzipMagic):
+		return CompressionGzip
+	case bytes.HasPrefix(prefix, zstdMagic):
+		return CompressionZstd
+	case bytes.HasPrefix(prefix, zipMagic), bytes.HasPrefix(prefix, zipEmptyMagic):
+		return CompressionZip
+	}
+	return CompressionNone
+}
+
+// Decompress returns a stream of the content of r, decompressing gzip and zstd as it is read.
+// Other content is returned as is, zip archives can't be streamed and are an error.
+func Decompress(r io.Reader) (io.ReadCloser, error) {
+	bufferedReader := bufio.NewReader(r)
+
+	switch DetectCompression(bufferedReader) {
+	case CompressionGzip:
+		gzipReader, err := gzip.NewReader(bufferedReader)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip stream: %w", err)
+		}
+		return gzipReader, nil
+
+	case CompressionZstd:
+		zstdReader, err := zstd.NewReader(bufferedReader, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdMaxWindow))
+		if err != nil {
+			return nil, fmt.Errorf("invalid zstd stream: %w", err)
+		}
+		return zstdReadCloser{zstdReader}, nil
+
+	case CompressionZip:
+		return nil, fmt.Errorf("zip archives can't be nested")
+	}
+
+	return io.NopCloser(bufferedReader), nil
+}
+
+// zstdReadCloser adapts a zstd decoder, whose Close returns nothing, to io.ReadCloser
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+// File formats of an upload, detected from their content
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+	FormatJSON   = "json"
+	FormatXLSX   = "xlsx"
+	FormatODS    = "ods"
+)
+
+// UploadFile is a file of an upload. An upload holds a single file, or one per entry of a zip archive.
+type UploadFile struct {
+	// Name is the name of the uploaded file, or the path of the entry in the archive
+	Name string
+	// Format is csv, ndjson or json, or xlsx and ods for a spreadsheet
+	Format string
+	open   func() (io.ReadCloser, error)
+	// archive is the content of a spreadsheet
+	archive *zip.Reader
+}
+
+// ReadOptions tells how the rows of a file are read
+type ReadOptions struct {
+	// Dialect holds the dialect overrides of a CSV file
+	Dialect Dialect
+	// Sheet is the sheet of a spreadsheet, by name or position counted from 1
+	Sheet string
+}
+
+// Open returns a decompressed stream of the file content, every call reads the file from the start
+func (f *UploadFile) Open() (io.ReadCloser, error) {
+	return f.open()
+}
+
+// Rows returns a reader of the rows of the file positioned after the header row, a *CSVReader for a CSV file.
+// The fields of the first objects of a JSON file are its header row.
+// Every call reads the file from the start, the caller closes the returned stream.
+func (f *UploadFile) Rows(options ReadOptions) (RowReader, io.Closer, error) {
+	switch f.Format {
+	case FormatXLSX:
+		xlsxReader, err := NewXLSXReader(f.archive, options.Sheet)
+		if err != nil {
+			return nil, nil, err
+		}
+		return xlsxReader, xlsxReader, nil
+
+	case FormatODS:
+		odsReader, err := NewODSReader(f.archive, options.Sheet)
+		if err != nil {
+			return nil, nil, err
+		}
+		return odsReader, odsReader, nil
+	}
+
+	content, err := f.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if f.Format == FormatNDJSON || f.Format == FormatJSON {
+		jsonReader, err := NewJSONReader(content, f.Format)
+		if err != nil {
+			content.Close()
+			return nil, nil, err
+		}
+		return jsonReader, content, nil
+	}
+
+	csvReader, err := NewCSVReaderDialect(content, options.Dialect)
+	if err != nil {
+		content.Close()
+		return nil, nil, err
+	}
+	return csvReader, content, nil
+}
+
+// UploadFiles lists the files of an upload of the given size. A zip archive, detected by its content,
+// has a file per entry, entries that are directories or macOS metadata are skipped.
+// Each entry may itself be gzip or zstd compressed. Any other upload is a single file.
+// Excel and OpenDocument spreadsheets are zip archives too, they are a single file and not compressed.
+// Other files are NDJSON or a JSON array when they start with { or [, and CSV otherwise.
+// The returned compression is the one of the upload itself.
+func UploadFiles(r io.ReaderAt, size int64, name string) ([]*UploadFile, string, error) {
+	compression := DetectCompression(bufio.NewReader(io.NewSectionReader(r, 0, size)))
+	if compression != CompressionZip {
+		file := &UploadFile{
+			Name: name,
+			open: func() (io.ReadCloser, error) {
+				return Decompress(io.NewSectionReader(r, 0, size))
+			},
+		}
+		if err := file.detectFormat(); err != nil {
+			return nil, compression, err
+		}
+		return []*UploadFile{file}, compression, nil
+	}
+
+	// The central directory is at the end of the archive, so the entries are read in place
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, compression, fmt.Errorf("invalid zip archive: %w", err)
+	}
+
+	// A spreadsheet is read as a whole, not per entry
+	if format := spreadsheetFormat(archive); format != "" {
+		file := &UploadFile{
+			Name:    name,
+			Format:  format,
+			archive: archive,
+			open: func() (io.ReadCloser, error) {
+				return io.NopCloser(io.NewSectionReader(r, 0, size)), nil
+			},
+		}
+		return []*UploadFile{file}, CompressionNone, nil
+	}
+
+	var files []*UploadFile
+	for _, entry := range archive.File {
+		if entry.FileInfo().IsDir() || strings.HasPrefix(entry.Name, "__MACOSX/") || strings.HasPrefix(path.Base(entry.Name), ".") {
+			continue
+		}
+
+		entry := entry
+		file := &UploadFile{
+			Name: entry.Name,
+			open: func() (io.ReadCloser, error) {
+				entryReader, err := entry.Open()
+				if err != nil {
+					return nil, fmt.Errorf("failed to open %s: %w", entry.Name, err)
+				}
+				content, err := Decompress(entryReader)
+				if err != nil {
+					entryReader.Close()
+					return nil, fmt.Errorf("%s: %w", entry.Name, err)
+				}
+				return multiCloser{content, entryReader}, nil
+			},
+		}
+		if err := file.detectFormat(); err != nil {
+			return nil, compression, err
+		}
+		files = append(files, file)
+	}
+	if len(files) == 0 {
+		return nil, compression, fmt.Errorf("zip archive has no files")
+	}
+	return files, compression, nil
+}
+
+// detectFormat sets the format of a text file from its first character that isn't a space or a BOM
+func (f *UploadFile) detectFormat() error {
+	content, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	f.Format = FormatCSV
+	bufferedReader := bufio.NewReader(content)
+	for {
+		r, _, err := bufferedReader.ReadRune()
+		if err != nil {
+			// An empty file is left to the CSV reader to report
+			return nil
+		}
+		switch r {
+		case ' ', '\t', '\r', '\n', '\ufeff':
+			continue
+		case '{':
+			f.Format = FormatNDJSON
+		case '[':
+			f.Format = FormatJSON
+		}
+		return nil
+	}
+}
+
+// multiCloser reads from the first stream and closes every stream
+type multiCloser struct {
+	io.ReadCloser
+	inner io.Closer
+}
+
+func (m multiCloser) Close() error {
+	err := m.ReadCloser.Close()
+	if innerErr := m.inner.Close(); err == nil {
+		err = innerErr
+	}
+	return err
+}
@@ -0,0 +1,188 @@
+package ingest
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// utf8BOM is the byte order mark some editors (Excel) put at the start of a file
+const utf8BOM = "\ufeff"
+
+// Record is a single row keyed by its header names
+type Record struct {
+	// Line is the line number the row starts on in the original file, or the row number of a spreadsheet
+	Line   int
+	Values map[string]string
+	// Dates holds the date cells of a spreadsheet by header, as wall times without a timezone.
+	// Values holds them as text as well.
+	Dates map[string]time.Time
+}
+
+// RowReader streams the records of an uploaded file
+type RowReader interface {
+	// Headers returns the column names from the header row
+	Headers() []string
+	// Read returns the next record, or io.EOF when the file is exhausted.
+	// Malformed rows are reported as a *RowError.
+	Read() (*Record, error)
+}
+
+// RowError describes a row that could not be parsed
+type RowError struct {
+	Line int
+	Err  error
+	// Raw is the text of the row, empty when the reader couldn't tell where the row ends
+	Raw string
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+// CSVReader streams records from an RFC 4180 CSV file.
+// Quoted fields may contain delimiters, escaped quotes ("") and newlines.
+type CSVReader struct {
+	reader  *csv.Reader
+	headers []string
+	dialect Dialect
+	// swapQuotes is set for files quoted with ', whose quotes are swapped with " while they are parsed
+	swapQuotes bool
+}
+
+// NewCSVReader creates a CSV reader that detects the dialect of the file and consumes the header row
+func NewCSVReader(r io.Reader) (*CSVReader, error) {
+	return NewCSVReaderDialect(r, Dialect{})
+}
+
+// NewCSVReaderDialect creates a CSV reader and consumes the header row.
+// The empty fields of dialect are detected from the start of the file.
+func NewCSVReaderDialect(r io.Reader, dialect Dialect) (*CSVReader, error) {
+	// Transcode the file to UTF-8, this also drops a leading BOM
+	decoded, charset := decodeCharset(r, dialect.Charset)
+	dialect.Charset = charset
+
+	bufferedReader := bufio.NewReaderSize(decoded, sniffSize)
+	sample, err := bufferedReader.Peek(sniffSize)
+	dialect = detectDialect(sample, err == nil, dialect)
+
+	// encoding/csv only knows " quotes and \n or \r\n line endings, other dialects are mapped to them
+	var content io.Reader = bufferedReader
+	if dialect.Quote == "'" || dialect.LineTerminator == "\r" {
+		content = &dialectReader{
+			reader:     bufferedReader,
+			quote:      dialect.Quote[0],
+			swapQuotes: dialect.Quote == "'",
+			crLines:    dialect.LineTerminator == "\r",
+		}
+	}
+
+	reader := csv.NewReader(content)
+	reader.Comma = rune(dialect.Delimiter[0])
+	// Field counts are checked in Read to return a clearer error
+	reader.FieldsPerRecord = -1
+
+	c := &CSVReader{
+		reader:     reader,
+		dialect:    dialect,
+		swapQuotes: dialect.Quote == "'",
+	}
+
+	headers, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("file is empty")
+	}
+	if err != nil {
+		return nil, wrapParseError(err)
+	}
+
+	c.unswap(headers)
+	for i, header := range headers {
+		headers[i] = strings.TrimSpace(header)
+	}
+	c.headers = headers
+
+	return c, nil
+}
+
+// Dialect returns the dialect the file is read with
+func (c *CSVReader) Dialect() Dialect {
+	return c.dialect
+}
+
+// unswap restores the quotes of values read from a file quoted with '
+func (c *CSVReader) unswap(values []string) {
+	if !c.swapQuotes {
+		return
+	}
+	for i, value := range values {
+		values[i] = strings.Map(func(r rune) rune {
+			switch r {
+			case '"':
+				return '\''
+			case '\'':
+				return '"'
+			}
+			return r
+		}, value)
+	}
+}
+
+// Headers returns the column names from the header row
+func (c *CSVReader) Headers() []string {
+	return c.headers
+}
+
+// Read returns the next record, or io.EOF when the file is exhausted.
+// Malformed rows are reported as a *RowError.
+func (c *CSVReader) Read() (*Record, error) {
+	values, err := c.reader.Read()
+	if err != nil {
+		return nil, wrapParseError(err)
+	}
+
+	c.unswap(values)
+	line, _ := c.reader.FieldPos(0)
+	if len(values) != len(c.headers) {
+		return nil, &RowError{
+			Line: line,
+			Err:  fmt.Errorf("expected %d fields, got %d", len(c.headers), len(values)),
+			Raw:  csvText(values, c.reader.Comma),
+		}
+	}
+
+	// Assign values to keys from the header row
+	obj := make(map[string]string, len(c.headers))
+	for i, key := range c.headers {
+		obj[key] = values[i]
+	}
+
+	return &Record{Line: line, Values: obj}, nil
+}
+
+// csvText writes the values of a row as a line of CSV, without the line terminator
+func csvText(values []string, comma rune) string {
+	var text strings.Builder
+	writer := csv.NewWriter(&text)
+	writer.Comma = comma
+	writer.Write(values)
+	writer.Flush()
+	return strings.TrimSuffix(text.String(), "\n")
+}
+
+// wrapParseError converts encoding/csv errors into a RowError
+func wrapParseError(err error) error {
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return &RowError{Line: parseErr.StartLine, Err: parseErr.Err}
+	}
+	return err
+}
@@ -0,0 +1,326 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// Charsets a file can be transcoded from
+const (
+	CharsetUTF8        = "utf-8"
+	CharsetUTF16LE     = "utf-16le"
+	CharsetUTF16BE     = "utf-16be"
+	CharsetWindows1252 = "windows-1252"
+	CharsetISO88591    = "iso-8859-1"
+)
+
+// sniffSize is how much of a file is read to detect its dialect
+const sniffSize = 64 << 10
+
+// sniffRecords is how many records the delimiter has to be consistent on
+const sniffRecords = 20
+
+// delimiterCandidates are the delimiters tried by the sniffer, in order of preference
+var delimiterCandidates = []byte{',', ';', '\t', '|'}
+
+// Dialect describes how a CSV file is written. Empty fields are detected from the file content.
+type Dialect struct {
+	// Delimiter separates the fields of a record
+	Delimiter string `json:"delimiter"`
+	// Quote is " or '
+	Quote string `json:"quote"`
+	// LineTerminator is \n, \r\n or \r
+	LineTerminator string `json:"line_terminator"`
+	// Charset is the encoding of the file, it is transcoded to UTF-8 when read
+	Charset string `json:"charset"`
+}
+
+// ParseDialect validates the dialect overrides of an upload, empty values are detected.
+// The delimiter may be given as "tab" and the line terminator as lf, crlf or cr.
+func ParseDialect(delimiter, quote, lineTerminator, charset string) (Dialect, error) {
+	var dialect Dialect
+
+	if delimiter == "tab" || delimiter == `\t` {
+		delimiter = "\t"
+	}
+	if delimiter != "" {
+		if len(delimiter) != 1 || delimiter[0] >= utf8.RuneSelf || delimiter == `"` || delimiter == "'" || delimiter == "\r" || delimiter == "\n" {
+			return dialect, fmt.Errorf("invalid delimiter %q, expected a single character", delimiter)
+		}
+		dialect.Delimiter = delimiter
+	}
+
+	switch quote {
+	case "", `"`, "'":
+		dialect.Quote = quote
+	default:
+		return dialect, fmt.Errorf(`invalid quote %q, expected " or '`, quote)
+	}
+
+	switch lineTerminator {
+	case "":
+	case "lf":
+		dialect.LineTerminator = "\n"
+	case "crlf":
+		dialect.LineTerminator = "\r\n"
+	case "cr":
+		dialect.LineTerminator = "\r"
+	default:
+		return dialect, fmt.Errorf("invalid line terminator %q, expected lf, crlf or cr", lineTerminator)
+	}
+
+	if charset != "" {
+		if _, ok := charsetEncoding(charset); !ok {
+			return dialect, fmt.Errorf("invalid charset %q, expected %s, %s, %s, %s or %s", charset,
+				CharsetUTF8, CharsetUTF16LE, CharsetUTF16BE, CharsetWindows1252, CharsetISO88591)
+		}
+		dialect.Charset = charset
+	}
+
+	return dialect, nil
+}
+
+// charsetEncoding returns the decoder of a charset, nil for UTF-8
+func charsetEncoding(charset string) (encoding.Encoding, bool) {
+	switch charset {
+	case CharsetUTF8:
+		return nil, true
+	case CharsetUTF16LE:
+		return unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), true
+	case CharsetUTF16BE:
+		return unicode.UTF16(unicode.BigEndian, unicode.UseBOM), true
+	case CharsetWindows1252:
+		return charmap.Windows1252, true
+	case CharsetISO88591:
+		return charmap.ISO8859_1, true
+	}
+	return nil, false
+}
+
+// decodeCharset detects the charset of r, unless it is set, and returns r transcoded to UTF-8
+// without a byte order mark
+func decodeCharset(r io.Reader, charset string) (io.Reader, string) {
+	bufferedReader := bufio.NewReaderSize(r, sniffSize)
+	sample, _ := bufferedReader.Peek(sniffSize)
+
+	if charset == "" {
+		charset = detectCharset(sample)
+	}
+
+	decoder, _ := charsetEncoding(charset)
+	if decoder == nil {
+		// Drop a leading BOM so it doesn't end up in the first header name
+		if bytes.HasPrefix(sample, []byte(utf8BOM)) {
+			bufferedReader.Discard(len(utf8BOM))
+		}
+		return bufferedReader, charset
+	}
+	return transform.NewReader(bufferedReader, decoder.NewDecoder()), charset
+}
+
+// detectCharset guesses the charset of the start of a file. A byte order mark decides it,
+// otherwise zero bytes point to UTF-16, and text that isn't valid UTF-8 is Windows-1252.
+func detectCharset(sample []byte) string {
+	switch {
+	case bytes.HasPrefix(sample, []byte(utf8BOM)):
+		return CharsetUTF8
+	case bytes.HasPrefix(sample, []byte{0xff, 0xfe}):
+		return CharsetUTF16LE
+	case bytes.HasPrefix(sample, []byte{0xfe, 0xff}):
+		return CharsetUTF16BE
+	}
+
+	// ASCII text in UTF-16 has a zero byte in every other position
+	var evenZeros, oddZeros int
+	for i, b := range sample {
+		if b == 0 {
+			if i%2 == 0 {
+				evenZeros++
+			} else {
+				oddZeros++
+			}
+		}
+	}
+	if oddZeros > len(sample)/4 {
+		return CharsetUTF16LE
+	}
+	if evenZeros > len(sample)/4 {
+		return CharsetUTF16BE
+	}
+
+	// The sample may end in the middle of a character
+	for i := len(sample) - 1; i >= 0 && i >= len(sample)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(sample[i]) {
+			if !utf8.FullRune(sample[i:]) {
+				sample = sample[:i]
+			}
+			break
+		}
+	}
+	if utf8.Valid(sample) {
+		return CharsetUTF8
+	}
+	return CharsetWindows1252
+}
+
+// detectDialect fills the empty fields of dialect from a sample of UTF-8 text
+func detectDialect(sample []byte, truncated bool, dialect Dialect) Dialect {
+	if dialect.Quote == "" {
+		dialect.Quote = detectQuote(sample)
+	}
+	quote := dialect.Quote[0]
+
+	if dialect.LineTerminator == "" {
+		dialect.LineTerminator = detectLineTerminator(sample, quote)
+	}
+
+	if dialect.Delimiter == "" {
+		dialect.Delimiter = detectDelimiter(sample, truncated, quote)
+	}
+
+	return dialect
+}
+
+// detectQuote returns ' when only single quotes open fields in the sample, and " otherwise
+func detectQuote(sample []byte) string {
+	counts := make(map[byte]int)
+	fieldStart := true
+	for _, b := range sample {
+		if fieldStart && (b == '"' || b == '\'') {
+			counts[b]++
+		}
+		fieldStart = b == '\n' || b == '\r' || bytes.IndexByte(delimiterCandidates, b) >= 0
+	}
+
+	if counts['\''] > 0 && counts['"'] == 0 {
+		return "'"
+	}
+	return `"`
+}
+
+// detectLineTerminator returns the first line ending outside a quoted field, \n if there is none
+func detectLineTerminator(sample []byte, quote byte) string {
+	inQuotes := false
+	for i, b := range sample {
+		switch {
+		case b == quote:
+			inQuotes = !inQuotes
+		case inQuotes:
+		case b == '\n':
+			return "\n"
+		case b == '\r':
+			if i+1 < len(sample) && sample[i+1] == '\n' {
+				return "\r\n"
+			}
+			if i+1 < len(sample) {
+				return "\r"
+			}
+		}
+	}
+	return "\n"
+}
+
+// detectDelimiter counts every candidate outside quoted fields in the first records of the sample.
+// The candidate found the same number of times in every record wins, the most frequent one if several do.
+// Without one, the candidate found most in the header row wins, and a comma if there is none.
+func detectDelimiter(sample []byte, truncated bool, quote byte) string {
+	var records []map[byte]int
+	counts := make(map[byte]int)
+	inQuotes := false
+	for i, b := range sample {
+		switch {
+		case b == quote:
+			inQuotes = !inQuotes
+		case inQuotes:
+		case b == '\n' || b == '\r':
+			// A \r\n ends a single record
+			if b == '\r' && i+1 < len(sample) && sample[i+1] == '\n' {
+				continue
+			}
+			records = append(records, counts)
+			counts = make(map[byte]int)
+		default:
+			if bytes.IndexByte(delimiterCandidates, b) >= 0 {
+				counts[b]++
+			}
+		}
+		if len(records) == sniffRecords {
+			break
+		}
+	}
+	// The last record is only complete if the whole file was read, it is still used if it is the only one
+	if len(records) < sniffRecords && len(counts) > 0 && (!truncated || len(records) == 0) {
+		records = append(records, counts)
+	}
+	if len(records) == 0 {
+		return ","
+	}
+
+	best, bestCount := byte(0), 0
+	for _, candidate := range delimiterCandidates {
+		count := records[0][candidate]
+		consistent := count > 0
+		for _, record := range records[1:] {
+			if record[candidate] != count {
+				consistent = false
+				break
+			}
+		}
+		if consistent && count > bestCount {
+			best, bestCount = candidate, count
+		}
+	}
+	if best != 0 {
+		return string(best)
+	}
+
+	for _, candidate := range delimiterCandidates {
+		if records[0][candidate] > bestCount {
+			best, bestCount = candidate, records[0][candidate]
+		}
+	}
+	if best != 0 {
+		return string(best)
+	}
+	return ","
+}
+
+// dialectReader maps a stream to the " quotes and \n line endings that encoding/csv knows.
+// ' and " are swapped everywhere, which the values undo once they are parsed,
+// and a \r only becomes \n outside quoted fields, so the ones inside a value are kept.
+type dialectReader struct {
+	reader     io.Reader
+	quote      byte
+	swapQuotes bool
+	crLines    bool
+	// inQuotes carries the quote state over from the previous Read
+	inQuotes bool
+}
+
+func (d *dialectReader) Read(p []byte) (int, error) {
+	n, err := d.reader.Read(p)
+	for i := 0; i < n; i++ {
+		b := p[i]
+		// A doubled quote toggles twice, it doesn't end the field
+		if b == d.quote {
+			d.inQuotes = !d.inQuotes
+		}
+		switch {
+		case d.swapQuotes && b == '\'':
+			p[i] = '"'
+		case d.swapQuotes && b == '"':
+			p[i] = '\''
+		case d.crLines && b == '\r' && !d.inQuotes:
+			p[i] = '\n'
+		}
+	}
+	return n, err
+}
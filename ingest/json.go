@@ -0,0 +1,284 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// JSONReader streams the objects of an NDJSON file, one object per line, or of a JSON array.
+// Every object is a record keyed by its field names. The headers are the fields found in the
+// first objects, in the order they are first seen. Later objects may have other fields, they
+// are returned like the others and mapped to the dataset columns by name.
+type JSONReader struct {
+	format  string
+	headers []string
+	// pending holds the first objects, read ahead to find the headers
+	pending []jsonResult
+	done    bool
+
+	// lines and line read NDJSON, decoder and counter read a JSON array
+	lines   *bufio.Reader
+	line    int
+	decoder *json.Decoder
+	counter *lineCounter
+}
+
+// jsonResult is an object read from the file, or the error of a malformed one
+type jsonResult struct {
+	line   int
+	fields []string
+	values map[string]string
+	err    error
+	// raw is the text of the object, kept for the error of a malformed one
+	raw string
+}
+
+// NewJSONReader creates a reader of a file in the ndjson or json format and reads
+// the first objects to find the headers
+func NewJSONReader(r io.Reader, format string) (*JSONReader, error) {
+	bufferedReader := bufio.NewReader(r)
+	// JSON is UTF-8, a BOM is allowed but isn't part of the content
+	if prefix, _ := bufferedReader.Peek(len(utf8BOM)); string(prefix) == utf8BOM {
+		bufferedReader.Discard(len(utf8BOM))
+	}
+
+	reader := &JSONReader{format: format}
+	switch format {
+	case FormatNDJSON:
+		reader.lines = bufferedReader
+	case FormatJSON:
+		reader.counter = &lineCounter{reader: bufferedReader}
+		reader.decoder = json.NewDecoder(reader.counter)
+		token, err := reader.decoder.Token()
+		if delim, ok := token.(json.Delim); err != nil || !ok || delim != '[' {
+			return nil, fmt.Errorf("expected a JSON array of objects")
+		}
+	default:
+		return nil, fmt.Errorf("unknown JSON format %q", format)
+	}
+
+	// The fields of the first objects are the headers
+	seen := make(map[string]bool)
+	for len(reader.pending) < sniffRecords {
+		result, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		reader.pending = append(reader.pending, result)
+
+		for _, field := range result.fields {
+			if !seen[field] {
+				seen[field] = true
+				reader.headers = append(reader.headers, field)
+			}
+		}
+	}
+	if len(reader.headers) == 0 {
+		// Report why the first values aren't usable objects
+		for _, result := range reader.pending {
+			if result.err != nil {
+				return nil, &RowError{Line: result.line, Err: result.err, Raw: result.raw}
+			}
+		}
+		return nil, fmt.Errorf("no object with fields in the first %d values", sniffRecords)
+	}
+
+	return reader, nil
+}
+
+// Headers returns the fields found in the first objects
+func (r *JSONReader) Headers() []string {
+	return r.headers
+}
+
+// Read returns the next object, or io.EOF at the end of the file
+func (r *JSONReader) Read() (*Record, error) {
+	var result jsonResult
+	if len(r.pending) > 0 {
+		result, r.pending = r.pending[0], r.pending[1:]
+	} else {
+		var err error
+		if result, err = r.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	if result.err != nil {
+		return nil, &RowError{Line: result.line, Err: result.err, Raw: result.raw}
+	}
+	return &Record{Line: result.line, Values: result.values}, nil
+}
+
+// next reads the next object, a malformed one is returned as a result with an error
+func (r *JSONReader) next() (jsonResult, error) {
+	if r.done {
+		return jsonResult{}, io.EOF
+	}
+	if r.format == FormatNDJSON {
+		return r.nextLine()
+	}
+	return r.nextElement()
+}
+
+// nextLine reads the next line of an NDJSON file that isn't blank
+func (r *JSONReader) nextLine() (jsonResult, error) {
+	for {
+		content, err := r.lines.ReadBytes('\n')
+		if err == io.EOF {
+			r.done = true
+			if len(bytes.TrimSpace(content)) == 0 {
+				return jsonResult{}, io.EOF
+			}
+		} else if err != nil {
+			return jsonResult{}, err
+		}
+
+		r.line++
+		content = bytes.TrimSpace(content)
+		if len(content) == 0 {
+			continue
+		}
+		return parseObject(r.line, content), nil
+	}
+}
+
+// nextElement reads the next element of a JSON array. A syntax error ends the file,
+// as the rest of the array can't be parsed.
+func (r *JSONReader) nextElement() (jsonResult, error) {
+	if !r.decoder.More() {
+		r.done = true
+		// The array has to be closed, with nothing after it
+		if token, err := r.decoder.Token(); err != nil || token != json.Delim(']') {
+			return jsonResult{line: r.counter.lineAt(r.decoder.InputOffset()), err: fmt.Errorf("unterminated JSON array")}, nil
+		}
+		if _, err := r.decoder.Token(); err != io.EOF {
+			return jsonResult{line: r.counter.lineAt(r.decoder.InputOffset()), err: fmt.Errorf("unexpected content after the JSON array")}, nil
+		}
+		return jsonResult{}, io.EOF
+	}
+
+	var raw json.RawMessage
+	if err := r.decoder.Decode(&raw); err != nil {
+		r.done = true
+		return jsonResult{line: r.counter.valueLineAt(r.decoder.InputOffset()), err: fmt.Errorf("%v, the rest of the file can't be read", err)}, nil
+	}
+
+	// The element ends at the decoder offset, the line is the one it starts on
+	start := r.decoder.InputOffset() - int64(len(raw))
+	return parseObject(r.counter.lineAt(start), raw), nil
+}
+
+// parseObject converts a JSON object to its fields in order and their values as text
+func parseObject(line int, raw []byte) jsonResult {
+	result := jsonResult{line: line, values: make(map[string]string), raw: string(raw)}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		result.err = fmt.Errorf("expected a JSON object")
+		return result
+	}
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			result.err = err
+			return result
+		}
+		field := token.(string)
+
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			result.err = err
+			return result
+		}
+		if _, ok := result.values[field]; ok {
+			result.err = fmt.Errorf("duplicate field %q", field)
+			return result
+		}
+
+		result.fields = append(result.fields, field)
+		if result.values[field], err = jsonText(value); err != nil {
+			result.err = fmt.Errorf("field %q: %w", field, err)
+			return result
+		}
+	}
+
+	// The closing brace, then nothing else on an NDJSON line
+	if _, err := decoder.Token(); err != nil {
+		result.err = err
+		return result
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		result.err = fmt.Errorf("unexpected content after the JSON object")
+	}
+	return result
+}
+
+// jsonText converts a JSON value to the text a CSV field would hold.
+// Null is empty, numbers are kept as written, and arrays and objects are kept as compact JSON.
+func jsonText(value json.RawMessage) (string, error) {
+	switch value[0] {
+	case '"':
+		var text string
+		err := json.Unmarshal(value, &text)
+		return text, err
+	case 'n':
+		return "", nil
+	case '{', '[':
+		var compact bytes.Buffer
+		err := json.Compact(&compact, value)
+		return compact.String(), err
+	}
+	return string(value), nil
+}
+
+// lineCounter counts the lines of a stream up to an offset. It keeps the content
+// read past the last offset, offsets must not go back.
+type lineCounter struct {
+	reader io.Reader
+	// pending is the content read from offset start on
+	pending []byte
+	start   int64
+	lines   int
+}
+
+func (c *lineCounter) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.pending = append(c.pending, p[:n]...)
+	return n, err
+}
+
+// lineAt returns the line, counted from 1, of a byte offset of the stream
+func (c *lineCounter) lineAt(offset int64) int {
+	counted := int(offset - c.start)
+	if counted < 0 {
+		counted = 0
+	}
+	if counted > len(c.pending) {
+		counted = len(c.pending)
+	}
+
+	c.lines += bytes.Count(c.pending[:counted], []byte("\n"))
+	c.pending = append(c.pending[:0], c.pending[counted:]...)
+	c.start += int64(counted)
+	return c.lines + 1
+}
+
+// valueLineAt returns the line of the first value after a byte offset, skipping spaces and commas
+func (c *lineCounter) valueLineAt(offset int64) int {
+	line := c.lineAt(offset)
+	for _, b := range c.pending {
+		if b == '\n' {
+			line++
+		} else if b != ' ' && b != '\t' && b != '\r' && b != ',' {
+			break
+		}
+	}
+	return line
+}
@@ -0,0 +1,14 @@
+package ingest
+
+// Message is the payload published to the queue for every uploaded row
+type Message struct {
+	// JobID is the import job the row belongs to
+	JobID int64 `json:"job_id"`
+	// Dataset is the dataset the row is written to, empty for the default dataset
+	Dataset string `json:"dataset,omitempty"`
+	// Mode is the import mode of the job, empty for messages published before import modes existed
+	Mode string `json:"mode,omitempty"`
+	// Line is the line number of the row in the uploaded file
+	Line int               `json:"line"`
+	Data map[string]string `json:"data"`
+}
@@ -0,0 +1,302 @@
+package ingest
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ODSReader streams the rows of a sheet of an OpenDocument spreadsheet
+type ODSReader struct {
+	rows    spreadsheetRows
+	sheet   string
+	content io.ReadCloser
+	decoder *xml.Decoder
+
+	// line is the number of the last row read, counting repeated rows
+	line int
+	// done is set at the end of the sheet, the content goes on with the next sheet
+	done bool
+	// repeated holds the cells of a repeated row and how many copies are left to return
+	repeated      []cell
+	repeatedCount int
+}
+
+// NewODSReader opens a sheet of an OpenDocument spreadsheet and consumes its header row.
+// sheet is a sheet name or its position counted from 1, the first sheet is read without it.
+func NewODSReader(archive *zip.Reader, sheet string) (*ODSReader, error) {
+	var contentFile *zip.File
+	for _, entry := range archive.File {
+		if entry.Name == "content.xml" {
+			contentFile = entry
+		}
+	}
+	if contentFile == nil {
+		return nil, fmt.Errorf("invalid spreadsheet: missing content.xml")
+	}
+
+	content, err := contentFile.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spreadsheet content: %w", err)
+	}
+	r := &ODSReader{content: content, decoder: xml.NewDecoder(content)}
+
+	// Skip the sheets before the chosen one
+	for index, found := 0, false; !found; {
+		token, err := r.decoder.Token()
+		if err == io.EOF {
+			r.Close()
+			return nil, sheetNotFound(sheet)
+		}
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("invalid spreadsheet content: %w", err)
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "table" {
+			continue
+		}
+		name := xmlAttr(start, "name")
+		if sheetMatches(index, name, sheet) {
+			r.sheet, found = name, true
+			continue
+		}
+		if err := r.decoder.Skip(); err != nil {
+			r.Close()
+			return nil, fmt.Errorf("invalid spreadsheet content: %w", err)
+		}
+		index++
+	}
+
+	// The first row with a value holds the headers
+	for {
+		_, cells, err := r.readRow()
+		if err == io.EOF {
+			r.Close()
+			return nil, fmt.Errorf("sheet is empty")
+		}
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		if r.rows.headerRow(cells) {
+			return r, nil
+		}
+	}
+}
+
+// Headers returns the column names from the header row
+func (r *ODSReader) Headers() []string {
+	return r.rows.headers
+}
+
+// Sheet returns the name of the sheet being read
+func (r *ODSReader) Sheet() string {
+	return r.sheet
+}
+
+// Read returns the next row with a value, or io.EOF at the end of the sheet
+func (r *ODSReader) Read() (*Record, error) {
+	for {
+		line, cells, err := r.readRow()
+		if err != nil {
+			return nil, err
+		}
+		record, err := r.rows.record(line, cells)
+		if record != nil || err != nil {
+			return record, err
+		}
+	}
+}
+
+// Close closes the spreadsheet content
+func (r *ODSReader) Close() error {
+	return r.content.Close()
+}
+
+// readRow returns the next row of the sheet with its number, or io.EOF at the end of the sheet.
+// Empty rows repeated many times, as spreadsheets pad their sheets, are skipped at once.
+func (r *ODSReader) readRow() (int, []cell, error) {
+	if r.done {
+		return 0, nil, io.EOF
+	}
+	if r.repeatedCount > 0 {
+		r.repeatedCount--
+		r.line++
+		return r.line, r.repeated, nil
+	}
+
+	for {
+		token, err := r.decoder.Token()
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid spreadsheet content: %w", err)
+		}
+
+		switch element := token.(type) {
+		case xml.EndElement:
+			if element.Name.Local == "table" {
+				r.done = true
+				return 0, nil, io.EOF
+			}
+		case xml.StartElement:
+			if element.Name.Local != "table-row" {
+				continue
+			}
+
+			repeat := repeatCount(element, "number-rows-repeated")
+			if repeat > maxSheetRows-r.line {
+				r.done = true
+				return 0, nil, &RowError{Line: r.line + 1, Err: fmt.Errorf("row repeated %d times goes past the %d rows of a sheet", repeat, maxSheetRows)}
+			}
+			cells, err := r.readCells()
+			if err != nil {
+				r.done = true
+				r.line++
+				return 0, nil, &RowError{Line: r.line, Err: err}
+			}
+			if isEmptyRow(cells) {
+				r.line += repeat
+				continue
+			}
+
+			r.repeated, r.repeatedCount = cells, repeat-1
+			r.line++
+			return r.line, cells, nil
+		}
+	}
+}
+
+// readCells reads the cells of a row up to its end. Empty cells repeated at the end of the row are dropped.
+func (r *ODSReader) readCells() ([]cell, error) {
+	var cells []cell
+	blanks := 0
+	for {
+		token, err := r.decoder.Token()
+		if err != nil {
+			return nil, fmt.Errorf("invalid spreadsheet content: %w", err)
+		}
+
+		switch element := token.(type) {
+		case xml.EndElement:
+			if element.Name.Local == "table-row" {
+				return cells, nil
+			}
+		case xml.StartElement:
+			if element.Name.Local != "table-cell" && element.Name.Local != "covered-table-cell" {
+				continue
+			}
+
+			repeat := repeatCount(element, "number-columns-repeated")
+			if repeat > maxSheetColumns-len(cells)-blanks {
+				return nil, fmt.Errorf("cell repeated %d times goes past the %d columns of a sheet", repeat, maxSheetColumns)
+			}
+			value, err := r.readCell(element)
+			if err != nil {
+				return nil, err
+			}
+			if value.text == "" {
+				blanks += repeat
+				continue
+			}
+
+			for ; blanks > 0; blanks-- {
+				cells = append(cells, cell{})
+			}
+			for i := 0; i < repeat; i++ {
+				cells = append(cells, value)
+			}
+		}
+	}
+}
+
+// readCell reads a cell and converts its value by its value type
+func (r *ODSReader) readCell(start xml.StartElement) (cell, error) {
+	text, err := r.readCellText()
+	if err != nil {
+		return cell{}, err
+	}
+
+	switch xmlAttr(start, "value-type") {
+	case "float", "percentage", "currency":
+		if value := xmlAttr(start, "value"); value != "" {
+			return cell{text: value}, nil
+		}
+	case "date":
+		if date, ok := parseDateCell(xmlAttr(start, "date-value")); ok {
+			return cell{text: dateText(date), date: &date}, nil
+		}
+	case "boolean":
+		if value := xmlAttr(start, "boolean-value"); value != "" {
+			return cell{text: value}, nil
+		}
+	}
+
+	// Strings, times and cells without a value type are kept as displayed
+	return cell{text: text}, nil
+}
+
+// readCellText reads the paragraphs of a cell up to its end, joined by new lines
+func (r *ODSReader) readCellText() (string, error) {
+	var paragraphs []string
+	var text strings.Builder
+	depth, inParagraph := 0, false
+	for {
+		token, err := r.decoder.Token()
+		if err != nil {
+			return "", fmt.Errorf("invalid spreadsheet content: %w", err)
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			depth++
+			switch element.Name.Local {
+			case "p":
+				inParagraph = true
+				text.Reset()
+			case "s":
+				// Runs of spaces are stored as a count
+				spaces := repeatCount(element, "c")
+				if spaces > maxCellLength-text.Len() {
+					return "", fmt.Errorf("cell text goes past %d characters", maxCellLength)
+				}
+				text.WriteString(strings.Repeat(" ", spaces))
+			case "tab":
+				text.WriteString("\t")
+			case "line-break":
+				text.WriteString("\n")
+			case "annotation":
+				// Comments are not part of the value
+				if err := r.decoder.Skip(); err != nil {
+					return "", fmt.Errorf("invalid spreadsheet content: %w", err)
+				}
+				depth--
+			}
+		case xml.EndElement:
+			if depth == 0 {
+				return strings.Join(paragraphs, "\n"), nil
+			}
+			depth--
+			if element.Name.Local == "p" {
+				inParagraph = false
+				paragraphs = append(paragraphs, text.String())
+			}
+		case xml.CharData:
+			if inParagraph {
+				text.Write(element)
+			}
+		}
+	}
+}
+
+// repeatCount returns a repeat attribute of an element, 1 if it isn't set
+func repeatCount(element xml.StartElement, name string) int {
+	count, err := strconv.Atoi(xmlAttr(element, name))
+	if err != nil || count < 1 {
+		return 1
+	}
+	return count
+}
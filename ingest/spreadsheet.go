@@ -0,0 +1,169 @@
+package ingest
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// odsMimeType is the content of the mimetype entry of an OpenDocument spreadsheet
+const odsMimeType = "application/vnd.oasis.opendocument.spreadsheet"
+
+// The size limits of a sheet and of the text of a cell in Excel and LibreOffice.
+// Repeat counts that go past them are rejected rather than expanded.
+const (
+	maxSheetColumns = 16384
+	maxSheetRows    = 1048576
+	maxCellLength   = 32767
+)
+
+// spreadsheetFormat returns the format of a zip archive that is a spreadsheet, or an empty string
+func spreadsheetFormat(archive *zip.Reader) string {
+	for _, entry := range archive.File {
+		switch entry.Name {
+		case "xl/workbook.xml":
+			return FormatXLSX
+		case "mimetype":
+			content, err := entry.Open()
+			if err != nil {
+				continue
+			}
+			mimeType, _ := io.ReadAll(io.LimitReader(content, int64(len(odsMimeType))))
+			content.Close()
+			if string(mimeType) == odsMimeType {
+				return FormatODS
+			}
+		}
+	}
+	return ""
+}
+
+// sheetMatches reports whether the sheet at index, counted from 0, with the given name is the chosen one.
+// sheet is a sheet name, or its position counted from 1 when it is a number. The first sheet is the default.
+func sheetMatches(index int, name string, sheet string) bool {
+	if sheet == "" {
+		return index == 0
+	}
+	if position, err := strconv.Atoi(sheet); err == nil {
+		return position == index+1
+	}
+	return name == sheet
+}
+
+// sheetNotFound is the error of a sheet that isn't in the workbook
+func sheetNotFound(sheet string) error {
+	return fmt.Errorf("sheet %q not found", sheet)
+}
+
+// cell is a value read from a spreadsheet, date is set for date cells
+type cell struct {
+	text string
+	date *time.Time
+}
+
+// spreadsheetRows turns rows of cells into records. The first row with a value is the header row,
+// and rows without a value are skipped like empty lines in a CSV file.
+type spreadsheetRows struct {
+	headers []string
+}
+
+// headerRow sets the header row, it returns false if the row is empty
+func (s *spreadsheetRows) headerRow(cells []cell) bool {
+	if isEmptyRow(cells) {
+		return false
+	}
+	s.headers = make([]string, len(cells))
+	for i, c := range cells {
+		s.headers[i] = strings.TrimSpace(c.text)
+	}
+	return true
+}
+
+// record converts a row of cells to a record, it returns nil for an empty row
+func (s *spreadsheetRows) record(line int, cells []cell) (*Record, error) {
+	if isEmptyRow(cells) {
+		return nil, nil
+	}
+
+	// Cells past the header row are fine as long as they are empty
+	for i := len(s.headers); i < len(cells); i++ {
+		if cells[i].text != "" {
+			return nil, &RowError{
+				Line: line,
+				Err:  fmt.Errorf("expected %d fields, got a value in column %d", len(s.headers), i+1),
+				Raw:  csvText(cellTexts(cells), ','),
+			}
+		}
+	}
+
+	record := &Record{Line: line, Values: make(map[string]string, len(s.headers))}
+	for i, header := range s.headers {
+		if i >= len(cells) {
+			record.Values[header] = ""
+			continue
+		}
+		record.Values[header] = cells[i].text
+		if cells[i].date != nil {
+			if record.Dates == nil {
+				record.Dates = make(map[string]time.Time)
+			}
+			record.Dates[header] = *cells[i].date
+		}
+	}
+	return record, nil
+}
+
+// cellTexts returns the text of every cell of a row
+func cellTexts(cells []cell) []string {
+	texts := make([]string, len(cells))
+	for i, c := range cells {
+		texts[i] = c.text
+	}
+	return texts
+}
+
+// isEmptyRow reports whether every cell of a row is empty
+func isEmptyRow(cells []cell) bool {
+	for _, c := range cells {
+		if c.text != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// dateText is how date cells are written in the record values
+func dateText(date time.Time) string {
+	return date.Format("2006-01-02 15:04:05.999999999")
+}
+
+// excelSerialDate converts an Excel serial date, days since the start of the workbook date system
+// with the time as the fraction, to a wall time. It is rounded to the millisecond.
+func excelSerialDate(serial float64, date1904 bool) time.Time {
+	base := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	if date1904 {
+		base = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+	} else if serial < 61 {
+		// Excel counts a February 29th in 1900, so earlier serials are one day off
+		base = base.AddDate(0, 0, 1)
+	}
+
+	days := math.Floor(serial)
+	millis := math.Round((serial - days) * 24 * 60 * 60 * 1000)
+	return base.AddDate(0, 0, int(days)).Add(time.Duration(millis) * time.Millisecond)
+}
+
+// parseDateCell parses the ISO 8601 value of a date cell as a wall time
+func parseDateCell(value string) (time.Time, bool) {
+	for _, layout := range []string{"2006-01-02T15:04:05.999999999", "2006-01-02T15:04:05Z07:00", "2006-01-02"} {
+		if date, err := time.Parse(layout, value); err == nil {
+			// A cell with an offset keeps its wall time
+			return time.Date(date.Year(), date.Month(), date.Day(), date.Hour(), date.Minute(), date.Second(), date.Nanosecond(), time.UTC), true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,447 @@
+package ingest
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// builtinDateFormats are the ids of the built-in number formats that show a date or time
+var builtinDateFormats = map[int]bool{
+	14: true, 15: true, 16: true, 17: true, 18: true, 19: true, 20: true, 21: true, 22: true,
+	27: true, 28: true, 29: true, 30: true, 31: true, 32: true, 33: true, 34: true, 35: true, 36: true,
+	45: true, 46: true, 47: true,
+	50: true, 51: true, 52: true, 53: true, 54: true, 55: true, 56: true, 57: true, 58: true,
+}
+
+// XLSXReader streams the rows of a sheet of an Excel workbook.
+// Only the sheet is streamed, the shared strings and styles are loaded up front.
+type XLSXReader struct {
+	rows    spreadsheetRows
+	sheet   string
+	content io.ReadCloser
+	decoder *xml.Decoder
+
+	sharedStrings []string
+	// dateStyles tells, by style index, whether a number cell is a date
+	dateStyles []bool
+	date1904   bool
+
+	// lastRow is the number of the last row read, for rows without a number
+	lastRow int
+}
+
+// NewXLSXReader opens a sheet of an Excel workbook and consumes its header row.
+// sheet is a sheet name or its position counted from 1, the first sheet is read without it.
+func NewXLSXReader(archive *zip.Reader, sheet string) (*XLSXReader, error) {
+	files := make(map[string]*zip.File, len(archive.File))
+	for _, entry := range archive.File {
+		files[entry.Name] = entry
+	}
+
+	var workbook struct {
+		Properties struct {
+			Date1904 string `xml:"date1904,attr"`
+		} `xml:"workbookPr"`
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+			ID   string `xml:"id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	if err := decodeXMLFile(files["xl/workbook.xml"], &workbook); err != nil {
+		return nil, fmt.Errorf("invalid workbook: %w", err)
+	}
+
+	var relationships struct {
+		Relationships []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	if err := decodeXMLFile(files["xl/_rels/workbook.xml.rels"], &relationships); err != nil {
+		return nil, fmt.Errorf("invalid workbook relationships: %w", err)
+	}
+
+	// Find the part of the chosen sheet
+	var sheetName, sheetPath string
+	for i, candidate := range workbook.Sheets {
+		if !sheetMatches(i, candidate.Name, sheet) {
+			continue
+		}
+		for _, relationship := range relationships.Relationships {
+			if relationship.ID == candidate.ID {
+				sheetName = candidate.Name
+				sheetPath = resolvePart(relationship.Target)
+			}
+		}
+		break
+	}
+	if files[sheetPath] == nil {
+		return nil, sheetNotFound(sheet)
+	}
+
+	r := &XLSXReader{
+		sheet:    sheetName,
+		date1904: workbook.Properties.Date1904 == "1" || workbook.Properties.Date1904 == "true",
+	}
+
+	var err error
+	if r.sharedStrings, err = readSharedStrings(files["xl/sharedStrings.xml"]); err != nil {
+		return nil, fmt.Errorf("invalid shared strings: %w", err)
+	}
+	if r.dateStyles, err = readDateStyles(files["xl/styles.xml"]); err != nil {
+		return nil, fmt.Errorf("invalid styles: %w", err)
+	}
+
+	r.content, err = files[sheetPath].Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sheet: %w", err)
+	}
+	r.decoder = xml.NewDecoder(r.content)
+
+	// The first row with a value holds the headers
+	for {
+		_, cells, err := r.readRow()
+		if err == io.EOF {
+			r.Close()
+			return nil, fmt.Errorf("sheet is empty")
+		}
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		if r.rows.headerRow(cells) {
+			return r, nil
+		}
+	}
+}
+
+// Headers returns the column names from the header row
+func (r *XLSXReader) Headers() []string {
+	return r.rows.headers
+}
+
+// Sheet returns the name of the sheet being read
+func (r *XLSXReader) Sheet() string {
+	return r.sheet
+}
+
+// Read returns the next row with a value, or io.EOF at the end of the sheet
+func (r *XLSXReader) Read() (*Record, error) {
+	for {
+		line, cells, err := r.readRow()
+		if err != nil {
+			return nil, err
+		}
+		record, err := r.rows.record(line, cells)
+		if record != nil || err != nil {
+			return record, err
+		}
+	}
+}
+
+// Close closes the sheet
+func (r *XLSXReader) Close() error {
+	return r.content.Close()
+}
+
+// readRow reads the next <row> element of the sheet and returns its number and cells
+func (r *XLSXReader) readRow() (int, []cell, error) {
+	for {
+		token, err := r.decoder.Token()
+		if err == io.EOF {
+			return 0, nil, io.EOF
+		}
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid sheet: %w", err)
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "row" {
+			continue
+		}
+
+		line := r.lastRow + 1
+		if number, err := strconv.Atoi(xmlAttr(start, "r")); err == nil {
+			line = number
+		}
+		r.lastRow = line
+
+		cells, err := r.readCells()
+		if err != nil {
+			return 0, nil, &RowError{Line: line, Err: err}
+		}
+		return line, cells, nil
+	}
+}
+
+// readCells reads the <c> elements of a row up to its end
+func (r *XLSXReader) readCells() ([]cell, error) {
+	var cells []cell
+	for {
+		token, err := r.decoder.Token()
+		if err != nil {
+			return nil, fmt.Errorf("invalid sheet: %w", err)
+		}
+
+		switch element := token.(type) {
+		case xml.EndElement:
+			if element.Name.Local == "row" {
+				return cells, nil
+			}
+		case xml.StartElement:
+			if element.Name.Local != "c" {
+				continue
+			}
+
+			// Cells without a reference follow the previous one
+			column := len(cells)
+			if reference := xmlAttr(element, "r"); reference != "" {
+				if index, ok := columnIndex(reference); ok {
+					column = index
+				}
+			}
+
+			value, err := r.readCell(element)
+			if err != nil {
+				return nil, err
+			}
+			for len(cells) <= column {
+				cells = append(cells, cell{})
+			}
+			cells[column] = value
+		}
+	}
+}
+
+// readCell reads a <c> element and converts its value by the cell type
+func (r *XLSXReader) readCell(start xml.StartElement) (cell, error) {
+	var content struct {
+		Value  string `xml:"v"`
+		Inline struct {
+			Text string `xml:",innerxml"`
+		} `xml:"is"`
+	}
+	if err := r.decoder.DecodeElement(&content, &start); err != nil {
+		return cell{}, fmt.Errorf("invalid cell: %w", err)
+	}
+
+	switch xmlAttr(start, "t") {
+	case "s":
+		index, err := strconv.Atoi(content.Value)
+		if err != nil || index < 0 || index >= len(r.sharedStrings) {
+			return cell{}, fmt.Errorf("invalid shared string %q", content.Value)
+		}
+		return cell{text: r.sharedStrings[index]}, nil
+
+	case "inlineStr":
+		text, err := richText(content.Inline.Text)
+		if err != nil {
+			return cell{}, fmt.Errorf("invalid inline string: %w", err)
+		}
+		return cell{text: text}, nil
+
+	case "b":
+		if content.Value == "1" {
+			return cell{text: "true"}, nil
+		}
+		return cell{text: "false"}, nil
+
+	case "d":
+		if date, ok := parseDateCell(content.Value); ok {
+			return cell{text: dateText(date), date: &date}, nil
+		}
+		return cell{text: content.Value}, nil
+
+	case "", "n":
+		// Numbers with a date format are serial dates
+		style, err := strconv.Atoi(xmlAttr(start, "s"))
+		if err == nil && style >= 0 && style < len(r.dateStyles) && r.dateStyles[style] && content.Value != "" {
+			if serial, err := strconv.ParseFloat(content.Value, 64); err == nil {
+				date := excelSerialDate(serial, r.date1904)
+				return cell{text: dateText(date), date: &date}, nil
+			}
+		}
+	}
+
+	// Formula strings, errors and plain numbers are kept as written
+	return cell{text: content.Value}, nil
+}
+
+// readSharedStrings loads the shared string table, a workbook without strings has none
+func readSharedStrings(file *zip.File) ([]string, error) {
+	if file == nil {
+		return nil, nil
+	}
+
+	var table struct {
+		Items []struct {
+			Text string `xml:",innerxml"`
+		} `xml:"si"`
+	}
+	if err := decodeXMLFile(file, &table); err != nil {
+		return nil, err
+	}
+
+	sharedStrings := make([]string, len(table.Items))
+	for i, item := range table.Items {
+		text, err := richText(item.Text)
+		if err != nil {
+			return nil, err
+		}
+		sharedStrings[i] = text
+	}
+	return sharedStrings, nil
+}
+
+// richText joins the <t> elements of a string item, which holds a single <t> or runs of
+// formatted text. Phonetic hints (<rPh>) are not part of the text.
+func richText(innerXML string) (string, error) {
+	decoder := xml.NewDecoder(strings.NewReader(innerXML))
+	var text strings.Builder
+	inText, phonetic := false, 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return text.String(), nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			switch element.Name.Local {
+			case "t":
+				inText = true
+			case "rPh":
+				phonetic++
+			}
+		case xml.EndElement:
+			switch element.Name.Local {
+			case "t":
+				inText = false
+			case "rPh":
+				phonetic--
+			}
+		case xml.CharData:
+			if inText && phonetic == 0 {
+				text.Write(element)
+			}
+		}
+	}
+}
+
+// readDateStyles tells for every cell style whether its number format shows a date or time
+func readDateStyles(file *zip.File) ([]bool, error) {
+	if file == nil {
+		return nil, nil
+	}
+
+	var styles struct {
+		NumberFormats []struct {
+			ID   int    `xml:"numFmtId,attr"`
+			Code string `xml:"formatCode,attr"`
+		} `xml:"numFmts>numFmt"`
+		CellFormats []struct {
+			NumberFormat int `xml:"numFmtId,attr"`
+		} `xml:"cellXfs>xf"`
+	}
+	if err := decodeXMLFile(file, &styles); err != nil {
+		return nil, err
+	}
+
+	customDates := make(map[int]bool)
+	for _, format := range styles.NumberFormats {
+		customDates[format.ID] = isDateFormatCode(format.Code)
+	}
+
+	dateStyles := make([]bool, len(styles.CellFormats))
+	for i, format := range styles.CellFormats {
+		if custom, ok := customDates[format.NumberFormat]; ok {
+			dateStyles[i] = custom
+		} else {
+			dateStyles[i] = builtinDateFormats[format.NumberFormat]
+		}
+	}
+	return dateStyles, nil
+}
+
+// isDateFormatCode reports whether a custom number format shows a date or time.
+// Quoted text, escaped characters and [] sections such as colors and elapsed times are ignored.
+func isDateFormatCode(code string) bool {
+	inQuotes, inBrackets, escaped := false, false, false
+	for _, r := range strings.ToLower(code) {
+		switch {
+		case escaped:
+			escaped = false
+		case inQuotes:
+			inQuotes = r != '"'
+		case inBrackets:
+			inBrackets = r != ']'
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			inQuotes = true
+		case r == '[':
+			inBrackets = true
+		case r == 'y' || r == 'm' || r == 'd' || r == 'h' || r == 's':
+			return true
+		}
+	}
+	return false
+}
+
+// columnIndex converts the column letters of a cell reference such as AB12 to an index counted from 0
+func columnIndex(reference string) (int, bool) {
+	index := 0
+	letters := 0
+	for _, r := range reference {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		index = index*26 + int(r-'A') + 1
+		letters++
+	}
+	if letters == 0 || letters > 3 {
+		return 0, false
+	}
+	return index - 1, true
+}
+
+// resolvePart resolves the target of a workbook relationship to the name of its zip entry
+func resolvePart(target string) string {
+	if strings.HasPrefix(target, "/") {
+		return path.Clean(strings.TrimPrefix(target, "/"))
+	}
+	return path.Join("xl", target)
+}
+
+// decodeXMLFile decodes a whole zip entry, a missing entry is an error
+func decodeXMLFile(file *zip.File, v interface{}) error {
+	if file == nil {
+		return fmt.Errorf("missing part")
+	}
+
+	content, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	return xml.NewDecoder(content).Decode(v)
+}
+
+// xmlAttr returns the value of an attribute by its local name
+func xmlAttr(element xml.StartElement, name string) string {
+	for _, attr := range element.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
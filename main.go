@@ -1,15 +1,24 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/spf13/viper"
 
+	"csv-handler/api"
+	"csv-handler/broker"
 	"csv-handler/consumer"
+	"csv-handler/dataset"
+	"csv-handler/postgres"
 	"csv-handler/rabbitmq"
+	redisclient "csv-handler/redis"
 	"csv-handler/routes"
+	"csv-handler/uploads"
 )
 
 func main() {
@@ -19,17 +28,101 @@ func main() {
 		log.Fatalf("Failed to read configuration file: %v", err)
 	}
 
-	err := rabbitmq.InitializeRabbitMQ()
+	// Run the schema migrations instead of the server, see runMigrate
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
+	}
+
+	// Select the message broker
+	var messageBroker broker.Broker
+	switch brokerType := viper.GetString("broker.type"); brokerType {
+	case "", "rabbitmq":
+		err := rabbitmq.InitializeRabbitMQ()
+		if err != nil {
+			log.Fatalf("Failed to initialize RabbitMQ: %v", err)
+		}
+		messageBroker = rabbitmq.GetRabbitMQInstance()
+	case "memory":
+		log.Println("Using the in-memory broker, queued rows are lost when the process exits")
+		messageBroker = broker.NewMemory(viper.GetInt("broker.memory_queue_size"))
+	default:
+		log.Fatalf("Unknown broker type %q", brokerType)
+	}
+	defer messageBroker.Close()
+
+	// Load the dataset definitions
+	datasets, err := dataset.Load()
 	if err != nil {
-		log.Fatalf("Failed to initialize RabbitMQ: %v", err)
+		log.Fatalf("Failed to load datasets: %v", err)
 	}
 
-	go consumer.StartWorker()
+	// Create the PostgreSQL pool and Redis client shared by every worker and request
+	pgClient, err := postgres.NewClient()
+	if err != nil {
+		log.Fatalf("Failed to initialize PostgreSQL client: %v", err)
+	}
+	defer pgClient.Close()
+
+	// Bring the schema up to date, so a fresh database needs no manual steps
+	if viper.GetBool("postgres.auto_migrate") {
+		applied, err := pgClient.MigrateUp(context.Background())
+		if err != nil {
+			log.Fatalf("Failed to migrate database: %v", err)
+		}
+		log.Printf("Applied %d migrations", len(applied))
+
+		if err := createDatasetTables(pgClient, datasets); err != nil {
+			log.Fatalf("Failed to create dataset tables: %v", err)
+		}
+	}
+
+	rdb, err := redisclient.NewClient()
+	if err != nil {
+		log.Fatalf("Failed to create Redis client: %v", err)
+	}
+	defer rdb.Close()
+
+	// Declare the queues once before the workers start consuming from them
+	err = messageBroker.DeclareTopology(viper.GetString("rabbitmq.csv_rabbitmq"))
+	if err != nil {
+		log.Fatalf("Failed to declare queue: %v", err)
+	}
+
+	// Start the consumer workers
+	concurrency := viper.GetInt("worker.concurrency")
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	for i := 1; i <= concurrency; i++ {
+		go consumer.StartWorker(i, messageBroker, pgClient, rdb, datasets)
+	}
+
+	// Select the store of resumable uploads and delete the ones left unfinished
+	var uploadStore uploads.Store
+	switch storeType := viper.GetString("uploads.store"); storeType {
+	case "", "disk":
+		ttl := time.Duration(viper.GetInt("uploads.ttl_s")) * time.Second
+		if ttl <= 0 {
+			ttl = 24 * time.Hour
+		}
+		uploadStore, err = uploads.NewDisk(viper.GetString("uploads.dir"), ttl)
+		if err != nil {
+			log.Fatalf("Failed to initialize upload store: %v", err)
+		}
+	default:
+		log.Fatalf("Unknown upload store %q", storeType)
+	}
+	cleanupInterval := time.Duration(viper.GetInt("uploads.cleanup_interval_s")) * time.Second
+	if cleanupInterval <= 0 {
+		cleanupInterval = 10 * time.Minute
+	}
+	go uploads.StartCleanup(uploadStore, cleanupInterval)
 
 	router := mux.NewRouter()
 
 	// Setup the API routes
-	routes.SetupRoutes(router, "/api/v1")
+	routes.SetupRoutes(router, "/api/v1", api.NewHandler(messageBroker, pgClient, rdb, datasets, uploadStore))
 
 	// Start the server
 	log.Fatal(http.ListenAndServe(":8080", router))
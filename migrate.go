@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+
+	"csv-handler/dataset"
+	"csv-handler/postgres"
+)
+
+// runMigrate runs the migrate subcommand: migrate up, migrate down [steps] or migrate status.
+// migrate up also creates the tables of the configured datasets that don't exist yet.
+func runMigrate(args []string) {
+	if len(args) == 0 {
+		log.Fatal("Usage: migrate up|down [steps]|status")
+	}
+
+	pgClient, err := postgres.NewClient()
+	if err != nil {
+		log.Fatalf("Failed to initialize PostgreSQL client: %v", err)
+	}
+	defer pgClient.Close()
+
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		applied, err := pgClient.MigrateUp(ctx)
+		for _, migration := range applied {
+			fmt.Printf("Applied %04d_%s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			log.Fatalf("Failed to migrate: %v", err)
+		}
+		if len(applied) == 0 {
+			fmt.Println("No pending migrations")
+		}
+
+		// Create the tables of datasets defined in the config
+		datasets, err := dataset.Load()
+		if err != nil {
+			log.Fatalf("Failed to load datasets: %v", err)
+		}
+		if err := createDatasetTables(pgClient, datasets); err != nil {
+			log.Fatalf("Failed to create dataset tables: %v", err)
+		}
+
+	case "down":
+		// Revert the latest migration unless a number of steps is given
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatalf("Invalid number of steps %q", args[1])
+			}
+		}
+
+		reverted, err := pgClient.MigrateDown(ctx, steps)
+		for _, migration := range reverted {
+			fmt.Printf("Reverted %04d_%s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			log.Fatalf("Failed to migrate: %v", err)
+		}
+		if len(reverted) == 0 {
+			fmt.Println("No applied migrations")
+		}
+
+	case "status":
+		statuses, err := pgClient.MigrationStatus(ctx)
+		if err != nil {
+			log.Fatalf("Failed to read migration status: %v", err)
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.AppliedAt != nil {
+				state = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, state)
+		}
+
+	default:
+		log.Fatalf("Unknown migrate command %q, expected up, down or status", args[0])
+	}
+}
+
+// createDatasetTables creates the table of every dataset that doesn't have one yet
+// and converts the timestamp columns of existing tables to TIMESTAMPTZ
+func createDatasetTables(pgClient *postgres.Client, datasets *dataset.Registry) error {
+	for _, ds := range datasets.All() {
+		if err := pgClient.CreateDatasetTable(context.Background(), ds); err != nil {
+			return err
+		}
+	}
+	return nil
+}
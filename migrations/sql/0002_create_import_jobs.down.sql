@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS import_rejects;
+DROP TABLE IF EXISTS import_jobs;
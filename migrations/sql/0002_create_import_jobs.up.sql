@@ -0,0 +1,26 @@
+-- Import jobs track the progress of each uploaded file
+CREATE TABLE IF NOT EXISTS import_jobs (
+    id BIGSERIAL PRIMARY KEY,
+    state VARCHAR(20) NOT NULL DEFAULT 'queued', -- queued, processing, completed, failed
+    file_name VARCHAR(255),
+    headers TEXT[], -- header row of the file, used to rebuild the rejects file
+    total_rows BIGINT, -- set once every row of the file has been published
+    published_rows BIGINT NOT NULL DEFAULT 0,
+    inserted_rows BIGINT NOT NULL DEFAULT 0,
+    failed_rows BIGINT NOT NULL DEFAULT 0,
+    error TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- Rows the consumer could not insert, kept so they can be fixed and uploaded again
+CREATE TABLE IF NOT EXISTS import_rejects (
+    id BIGSERIAL PRIMARY KEY,
+    job_id BIGINT REFERENCES import_jobs (id) ON DELETE CASCADE, -- NULL when the message could not be decoded
+    line_number INT,
+    raw_values TEXT NOT NULL, -- JSON object of the original row, or the raw message body
+    error TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_import_rejects_job_id ON import_rejects (job_id, line_number);
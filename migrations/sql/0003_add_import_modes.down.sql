@@ -0,0 +1,16 @@
+ALTER TABLE import_jobs
+    DROP COLUMN IF EXISTS skipped_rows,
+    DROP COLUMN IF EXISTS updated_rows,
+    DROP COLUMN IF EXISTS mode;
+
+CREATE INDEX IF NOT EXISTS idx_id ON csv_data (id);
+
+-- Only the key 0003 added is dropped, databases created from the former schema.sql keep theirs
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM pg_constraint WHERE conrelid = 'csv_data'::regclass AND conname = 'csv_data_pkey'
+            AND obj_description(oid, 'pg_constraint') = 'added by migration 0003') THEN
+        ALTER TABLE csv_data DROP CONSTRAINT csv_data_pkey;
+    END IF;
+END
+$$;
@@ -0,0 +1,29 @@
+-- Import modes need a unique id. Databases created from the former schema.sql already have
+-- the primary key, the others get it once their ids are checked.
+DO $$
+DECLARE
+    duplicated BIGINT;
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conrelid = 'csv_data'::regclass AND contype = 'p') THEN
+        SELECT COUNT(*) INTO duplicated FROM (SELECT id FROM csv_data GROUP BY id HAVING COUNT(*) > 1) AS ids;
+        IF duplicated > 0 THEN
+            RAISE EXCEPTION 'csv_data has % duplicated ids, remove the duplicated rows before running this migration', duplicated;
+        END IF;
+        IF EXISTS (SELECT 1 FROM csv_data WHERE id IS NULL) THEN
+            RAISE EXCEPTION 'csv_data has rows without an id, remove them before running this migration';
+        END IF;
+
+        ALTER TABLE csv_data ADD PRIMARY KEY (id);
+        -- The down migration only drops the key it finds this comment on
+        COMMENT ON CONSTRAINT csv_data_pkey ON csv_data IS 'added by migration 0003';
+    END IF;
+END
+$$;
+
+-- The primary key index replaces idx_id
+DROP INDEX IF EXISTS idx_id;
+
+ALTER TABLE import_jobs
+    ADD COLUMN IF NOT EXISTS mode VARCHAR(20) NOT NULL DEFAULT 'insert', -- insert, upsert, skip_existing, fail_on_conflict
+    ADD COLUMN IF NOT EXISTS updated_rows BIGINT NOT NULL DEFAULT 0, -- existing rows replaced by a newer row in upsert mode
+    ADD COLUMN IF NOT EXISTS skipped_rows BIGINT NOT NULL DEFAULT 0; -- rows left out because the existing row was kept
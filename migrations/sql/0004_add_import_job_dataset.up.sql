@@ -0,0 +1,2 @@
+-- Jobs created before datasets existed belong to the default dataset, stored as NULL
+ALTER TABLE import_jobs ADD COLUMN IF NOT EXISTS dataset VARCHAR(100);
@@ -0,0 +1,2 @@
+-- Dataset column of each header, empty for ignored headers. NULL for jobs whose headers were the column names
+ALTER TABLE import_jobs ADD COLUMN IF NOT EXISTS header_columns TEXT[];
@@ -0,0 +1,4 @@
+ALTER TABLE csv_data
+    ALTER COLUMN created_at TYPE TIMESTAMP USING created_at AT TIME ZONE 'UTC',
+    ALTER COLUMN deleted_at TYPE TIMESTAMP USING deleted_at AT TIME ZONE 'UTC',
+    ALTER COLUMN merged_at TYPE TIMESTAMP USING merged_at AT TIME ZONE 'UTC';
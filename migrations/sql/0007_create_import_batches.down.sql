@@ -0,0 +1,3 @@
+ALTER TABLE import_jobs DROP COLUMN IF EXISTS compression;
+ALTER TABLE import_jobs DROP COLUMN IF EXISTS batch_id;
+DROP TABLE IF EXISTS import_batches;
@@ -0,0 +1,12 @@
+-- An import batch groups the import jobs of the files of one zip archive
+CREATE TABLE IF NOT EXISTS import_batches (
+    id BIGSERIAL PRIMARY KEY,
+    file_name VARCHAR(255),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE import_jobs ADD COLUMN IF NOT EXISTS batch_id BIGINT REFERENCES import_batches (id) ON DELETE CASCADE;
+-- Compression of the uploaded file, empty for plain files
+ALTER TABLE import_jobs ADD COLUMN IF NOT EXISTS compression VARCHAR(10) NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_import_jobs_batch_id ON import_jobs (batch_id);
@@ -0,0 +1,2 @@
+-- Delimiter, quote, line terminator and charset the file was parsed with, NULL for older jobs
+ALTER TABLE import_jobs ADD COLUMN IF NOT EXISTS dialect JSONB;
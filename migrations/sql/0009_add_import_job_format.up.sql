@@ -0,0 +1,3 @@
+-- csv, ndjson or json, or xlsx and ods for spreadsheets (the longest name fits VARCHAR(10)), and the sheet a spreadsheet was read from
+ALTER TABLE import_jobs ADD COLUMN IF NOT EXISTS format VARCHAR(10) NOT NULL DEFAULT 'csv';
+ALTER TABLE import_jobs ADD COLUMN IF NOT EXISTS sheet VARCHAR(255);
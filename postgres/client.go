@@ -1,22 +1,33 @@
 package postgres
 
 import (
+	"context"
+	"csv-handler/dataset"
+	"csv-handler/query"
 	"database/sql"
+	"encoding/json"
 	"fmt"
-	"log"
 	"strconv"
+	"sync"
 	"time"
 
-	_ "github.com/lib/pq" // Import the PostgreSQL driver package
+	"github.com/lib/pq" // Import the PostgreSQL driver package
 	"github.com/spf13/viper"
 )
 
-// Client is a PostgreSQL client
+// Client is a PostgreSQL client. It holds a connection pool and is meant
+// to be created once and shared by every handler and worker.
 type Client struct {
 	db *sql.DB
+
+	// stmts caches prepared statements by their query
+	stmtsMu sync.Mutex
+	stmts   map[string]*sql.Stmt
 }
 
-// NewClient creates a new PostgreSQL client
+// NewClient creates a new PostgreSQL client.
+// The pool is sized with the postgres.max_open_conns, postgres.max_idle_conns,
+// postgres.conn_max_lifetime_s and postgres.conn_max_idle_time_s settings.
 func NewClient() (*Client, error) {
 	host := viper.GetString("postgres.host")
 	port := viper.GetString("postgres.port")
@@ -30,94 +41,164 @@ func NewClient() (*Client, error) {
 		return nil, fmt.Errorf("failed to open database connection: %w", err)
 	}
 
+	// Configure the pool, unset values keep the database/sql defaults
+	db.SetMaxOpenConns(viper.GetInt("postgres.max_open_conns"))
+	if maxIdle := viper.GetInt("postgres.max_idle_conns"); maxIdle > 0 {
+		db.SetMaxIdleConns(maxIdle)
+	}
+	db.SetConnMaxLifetime(time.Duration(viper.GetInt("postgres.conn_max_lifetime_s")) * time.Second)
+	db.SetConnMaxIdleTime(time.Duration(viper.GetInt("postgres.conn_max_idle_time_s")) * time.Second)
+
 	// Check if the connection is successful
 	err = db.Ping()
 	if err != nil {
+		db.Close()
 		return nil, fmt.Errorf("failed to connect to the database: %w", err)
 	}
 
-	return &Client{db: db}, nil
+	return &Client{
+		db:    db,
+		stmts: make(map[string]*sql.Stmt),
+	}, nil
 }
 
-// Close closes the PostgreSQL client connection
+// Close closes the cached statements and the PostgreSQL connection pool
 func (c *Client) Close() error {
+	c.stmtsMu.Lock()
+	for _, stmt := range c.stmts {
+		stmt.Close()
+	}
+	c.stmts = nil
+	c.stmtsMu.Unlock()
+
 	if c.db != nil {
 		return c.db.Close()
 	}
 	return nil
 }
 
-// InsertData inserts the data into the PostgreSQL database
-func (c *Client) InsertCsvData(data map[string]interface{}) error {
-	query := "INSERT INTO csv_data (id, first_name, last_name, email_address, " +
-		"created_at, deleted_at, merged_at, parent_user_id) VALUES" +
-		" ($1, $2, $3, $4, $5, $6, $7, $8)"
-	// Prepare the SQL statement
-	stmt, err := c.db.Prepare(query)
+// WithQueryTimeout returns a context that is cancelled after postgres.query_timeout_ms,
+// or only when parent is cancelled if no timeout is configured
+func WithQueryTimeout(parent context.Context) (context.Context, context.CancelFunc) {
+	timeout := time.Duration(viper.GetInt("postgres.query_timeout_ms")) * time.Millisecond
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// stmt returns the prepared statement for a query, preparing it on first use.
+// Only queries built from constants are cached, queries that embed request
+// parameters would grow the cache without bound.
+func (c *Client) stmt(ctx context.Context, query string) (*sql.Stmt, error) {
+	c.stmtsMu.Lock()
+	defer c.stmtsMu.Unlock()
+
+	if stmt, ok := c.stmts[query]; ok {
+		return stmt, nil
+	}
+	if c.stmts == nil {
+		return nil, fmt.Errorf("failed to prepare SQL statement: client is closed")
+	}
+
+	stmt, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare SQL statement: %w", err)
+	}
+	c.stmts[query] = stmt
+	return stmt, nil
+}
+
+// exec runs a cached statement
+func (c *Client) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	stmt, err := c.stmt(ctx, query)
 	if err != nil {
-		return fmt.Errorf("failed to prepare SQL statement: %w", err)
-	}
-	defer stmt.Close()
-
-	// Extract the values from the data map
-	value1 := data["id"]
-	value2 := data["first_name"]
-	value3 := data["last_name"]
-	value4 := data["email_address"]
-
-	// Parse the string as a float64
-	value5 := convertFloatTimestamp(data["created_at"].(string))
-	value6 := convertFloatTimestamp(data["deleted_at"].(string))
-	value7 := convertFloatTimestamp(data["merged_at"].(string))
-	value8 := data["parent_user_id"]
-	if value8 == "-1" {
-		value8 = nil
-	}
-	// Execute the SQL statement with the values
-	_, err = stmt.Exec(value1, value2, value3, value4, value5, value6, value7, value8)
+		return nil, err
+	}
+	return stmt.ExecContext(ctx, args...)
+}
+
+// CopyRecords writes a batch of rows produced by Dataset.Values with a single COPY in one transaction.
+// Either every row is inserted or none are.
+func (c *Client) CopyRecords(ctx context.Context, ds *dataset.Dataset, rows [][]interface{}) error {
+	tx, err := c.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to execute SQL statement: %w", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback()
 
+	if err := copyRows(ctx, tx, ds.Table, ds.ColumnNames(), rows); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
 	return nil
 }
 
-// GetData retrieves data from the PostgreSQL database based on the provided filters, limit, and offset.
-func (c *Client) GetData(filters map[string]interface{}, limit, offset int) ([]map[string]interface{}, error) {
-	query := "SELECT id, first_name, last_name, email_address, created_at, deleted_at, merged_at, parent_user_id FROM csv_data WHERE 1=1"
-	var args []interface{}
-
-	// Add filters to the query
-	i := 1
-	for key, value := range filters {
-		if value != nil {
-			query += fmt.Sprintf(" AND %s = $%d", key, i)
-			args = append(args, value)
-			i++
+// copyRows writes rows with values in columns order to table with a single COPY
+func copyRows(ctx context.Context, tx *sql.Tx, table string, columns []string, rows [][]interface{}) error {
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(table, columns...))
+	if err != nil {
+		return fmt.Errorf("failed to prepare COPY statement: %w", err)
+	}
+
+	// Buffer every row, the data is sent when the statement is flushed
+	for _, values := range rows {
+		if _, err := stmt.ExecContext(ctx, values...); err != nil {
+			stmt.Close()
+			return fmt.Errorf("failed to copy row: %w", err)
 		}
 	}
 
-	// Add limit and offset to the query
-	query += " LIMIT " + strconv.Itoa(limit) + " OFFSET " + strconv.Itoa(offset)
-	// args = append(args, limit, offset)
-	log.Println(query)
-	log.Println(args...)
+	// Flush the buffered rows
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return fmt.Errorf("failed to execute COPY statement: %w", err)
+	}
 
-	// Prepare the SQL statement
-	stmt, err := c.db.Prepare(query)
-	if err != nil {
-		return nil, fmt.Errorf("failed to prepare SQL statement: %w", err)
+	if err := stmt.Close(); err != nil {
+		return fmt.Errorf("failed to close COPY statement: %w", err)
 	}
-	defer stmt.Close()
+	return nil
+}
+
+// GetData retrieves a page of rows of a dataset based on the provided filters.
+// The filters and page must be parsed against the dataset FilterColumns.
+func (c *Client) GetData(ctx context.Context, ds *dataset.Dataset, filters []query.Filter, page *query.Page) ([]map[string]interface{}, *query.PageInfo, error) {
+	// Add filters to the query, every value is passed as a parameter
+	where, args := query.BuildWhere(filters, 1)
+	dataQuery := selectQuery(ds) + " WHERE 1=1" + where
+
+	// Start after the cursor row, if any
+	keyset, keysetArgs := page.BuildKeyset(len(args) + 1)
+	dataQuery += keyset
+	args = append(args, keysetArgs...)
 
-	// Execute the SQL statement with the provided values
-	rows, err := stmt.Query(args...)
+	// Add the sort order, limit and offset to the query
+	dataQuery += page.BuildOrderBy()
+	dataQuery += " LIMIT " + strconv.Itoa(page.FetchLimit()) + " OFFSET " + strconv.Itoa(page.Offset)
+
+	// Execute the SQL statement with the provided values, it is not cached
+	// because the limit and offset are part of the query
+	rows, err := c.db.QueryContext(ctx, dataQuery, args...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute SQL statement: %w", err)
+		return nil, nil, fmt.Errorf("failed to execute SQL statement: %w", err)
 	}
 	defer rows.Close()
 
 	// Fetch the result rows
+	results, err := scanRows(rows)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return page.Result(results)
+}
+
+// scanRows maps every row to its column values
+func scanRows(rows *sql.Rows) ([]map[string]interface{}, error) {
 	columns, err := rows.Columns()
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch result columns: %w", err)
@@ -160,23 +241,43 @@ func (c *Client) GetData(filters map[string]interface{}, limit, offset int) ([]m
 	return results, nil
 }
 
-func convertFloatTimestamp(timestamp string) *string {
-	// Convert the timestamp value to a float64
-	f, err := strconv.ParseFloat(timestamp, 64)
-	if err != nil {
-		return nil
-	}
+// CountData returns the number of rows matching the filters using the given count mode.
+// It returns nil for query.CountNone.
+func (c *Client) CountData(ctx context.Context, ds *dataset.Dataset, filters []query.Filter, mode string) (*int64, error) {
+	where, args := query.BuildWhere(filters, 1)
 
-	// Check if the timestamp is -1
-	if f == -1 {
-		return nil
-	}
+	var total int64
+	switch mode {
+	case query.CountExact:
+		err := c.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+pq.QuoteIdentifier(ds.Table)+" WHERE 1=1"+where, args...).Scan(&total)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count rows: %w", err)
+		}
+
+	case query.CountEstimate:
+		// The planner estimate comes from the table statistics, so the table isn't scanned
+		var plan []byte
+		err := c.db.QueryRowContext(ctx, "EXPLAIN (FORMAT JSON) SELECT 1 FROM "+pq.QuoteIdentifier(ds.Table)+" WHERE 1=1"+where, args...).Scan(&plan)
+		if err != nil {
+			return nil, fmt.Errorf("failed to estimate row count: %w", err)
+		}
 
-	// Convert the float64 to a time.Time
-	t := time.Unix(int64(f)/1000, 0) // Divide by 1000 to convert from milliseconds to seconds
+		var explain []struct {
+			Plan struct {
+				Rows float64 `json:"Plan Rows"`
+			} `json:"Plan"`
+		}
+		if err := json.Unmarshal(plan, &explain); err != nil {
+			return nil, fmt.Errorf("failed to parse query plan: %w", err)
+		}
+		if len(explain) == 0 {
+			return nil, fmt.Errorf("failed to parse query plan: the plan is empty")
+		}
+		total = int64(explain[0].Plan.Rows)
 
-	// Format the time as a string
-	timestampStr := t.Format("2006-01-02 15:04:05")
+	default:
+		return nil, nil
+	}
 
-	return &timestampStr
+	return &total, nil
 }
@@ -0,0 +1,70 @@
+package postgres
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// temporaryErrorClasses are the PostgreSQL error classes that can succeed when retried
+var temporaryErrorClasses = []string{
+	"08", // Connection exception
+	"53", // Insufficient resources
+	"57", // Operator intervention (e.g. admin shutdown, cannot connect now)
+	"58", // System error
+}
+
+// temporaryErrorCodes are individual PostgreSQL errors that can succeed when retried
+var temporaryErrorCodes = []pq.ErrorCode{
+	"40001", // serialization_failure
+	"40P01", // deadlock_detected
+	"55P03", // lock_not_available
+}
+
+// IsTemporary reports whether err is caused by the database being unavailable
+// rather than by the data, so the same operation may succeed later
+func IsTemporary(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// 57014 is query_canceled, which is caused by the statement itself
+		if pqErr.Code == "57014" {
+			return false
+		}
+		for _, class := range temporaryErrorClasses {
+			if strings.HasPrefix(string(pqErr.Code), class) {
+				return true
+			}
+		}
+		for _, code := range temporaryErrorCodes {
+			if pqErr.Code == code {
+				return true
+			}
+		}
+		return false
+	}
+
+	// The connection dropped or could not be opened
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// IsUniqueViolation reports whether err is caused by a row whose key already exists
+func IsUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
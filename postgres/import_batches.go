@@ -0,0 +1,115 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// ImportBatch groups the import jobs of the files of a zip archive
+type ImportBatch struct {
+	ID       int64  `json:"id"`
+	FileName string `json:"file_name"`
+	// State is derived from the jobs: failed if any job failed, completed once every job is,
+	// queued while no job has started and processing otherwise
+	State     string       `json:"state"`
+	Jobs      []*ImportJob `json:"jobs"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+// CreateImportBatch creates an import batch for an archive, its jobs are added with CreateImportJob
+func (c *Client) CreateImportBatch(ctx context.Context, fileName string) (*ImportBatch, error) {
+	query := "INSERT INTO import_batches (file_name) VALUES ($1) RETURNING id, created_at"
+
+	stmt, err := c.stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := &ImportBatch{FileName: fileName, State: ImportStateQueued, Jobs: []*ImportJob{}}
+	if err := stmt.QueryRowContext(ctx, fileName).Scan(&batch.ID, &batch.CreatedAt); err != nil {
+		return nil, fmt.Errorf("failed to create import batch: %w", err)
+	}
+	return batch, nil
+}
+
+// GetImportBatch retrieves an import batch and its jobs by the batch ID
+func (c *Client) GetImportBatch(ctx context.Context, id int64) (*ImportBatch, error) {
+	query := "SELECT id, file_name, created_at FROM import_batches WHERE id = $1"
+
+	stmt, err := c.stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var batch ImportBatch
+	var fileName sql.NullString
+	err = stmt.QueryRowContext(ctx, id).Scan(&batch.ID, &fileName, &batch.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("import batch %d: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get import batch: %w", err)
+	}
+	batch.FileName = fileName.String
+
+	batch.Jobs, err = c.batchJobs(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	batch.State = batchState(batch.Jobs)
+	return &batch, nil
+}
+
+// batchJobs retrieves the import jobs of a batch in the order they were created
+func (c *Client) batchJobs(ctx context.Context, batchID int64) ([]*ImportJob, error) {
+	query := "SELECT " + importJobColumns + " FROM import_jobs WHERE batch_id = $1 ORDER BY id"
+
+	stmt, err := c.stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.QueryContext(ctx, batchID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get import batch jobs: %w", err)
+	}
+	defer rows.Close()
+
+	jobs := []*ImportJob{}
+	for rows.Next() {
+		job, err := scanImportJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan import job: %w", err)
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed during row iteration: %w", err)
+	}
+	return jobs, nil
+}
+
+// batchState derives the state of a batch from the states of its jobs
+func batchState(jobs []*ImportJob) string {
+	queued, completed := 0, 0
+	for _, job := range jobs {
+		switch job.State {
+		case ImportStateFailed:
+			return ImportStateFailed
+		case ImportStateQueued:
+			queued++
+		case ImportStateCompleted:
+			completed++
+		}
+	}
+
+	switch {
+	case completed == len(jobs) && len(jobs) > 0:
+		return ImportStateCompleted
+	case queued == len(jobs):
+		return ImportStateQueued
+	}
+	return ImportStateProcessing
+}
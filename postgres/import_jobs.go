@@ -0,0 +1,235 @@
+package postgres
+
+import (
+	"context"
+	"csv-handler/ingest"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Import job states
+const (
+	ImportStateQueued     = "queued"
+	ImportStateProcessing = "processing"
+	ImportStateCompleted  = "completed"
+	ImportStateFailed     = "failed"
+)
+
+// Import modes decide what happens to rows whose value in the dataset's key column already exists
+const (
+	// ImportModeInsert rejects rows whose key already exists
+	ImportModeInsert = "insert"
+	// ImportModeUpsert updates existing rows when the incoming row is newer
+	ImportModeUpsert = "upsert"
+	// ImportModeSkipExisting leaves existing rows untouched
+	ImportModeSkipExisting = "skip_existing"
+	// ImportModeFailOnConflict rejects rows whose key already exists and fails the import job
+	ImportModeFailOnConflict = "fail_on_conflict"
+)
+
+// ParseImportMode validates an import mode, an empty mode is ImportModeInsert
+func ParseImportMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return ImportModeInsert, nil
+	case ImportModeInsert, ImportModeUpsert, ImportModeSkipExisting, ImportModeFailOnConflict:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid import mode %q, expected %s, %s, %s or %s", mode,
+		ImportModeInsert, ImportModeUpsert, ImportModeSkipExisting, ImportModeFailOnConflict)
+}
+
+// ErrNotFound is returned when a requested record does not exist
+var ErrNotFound = errors.New("record not found")
+
+// ImportJob tracks the progress of a single uploaded file
+type ImportJob struct {
+	ID    int64  `json:"id"`
+	State string `json:"state"`
+	// Dataset is the dataset the rows are written to, empty for the default dataset
+	Dataset  string `json:"dataset"`
+	FileName string `json:"file_name"`
+	Mode     string `json:"mode"`
+	// BatchID is the import batch of the zip archive the file came from, nil for single files
+	BatchID *int64 `json:"batch_id,omitempty"`
+	// Compression is gzip, zstd or zip, empty for a plain file
+	Compression string `json:"compression"`
+	// Format is csv, ndjson or json, or xlsx and ods for spreadsheets
+	Format string `json:"format"`
+	// Sheet is the name of the sheet a spreadsheet was read from, nil for CSV files
+	Sheet *string `json:"sheet,omitempty"`
+	// Dialect is how a CSV file was parsed, nil for spreadsheets and jobs created before dialects were detected
+	Dialect *ingest.Dialect `json:"dialect"`
+	// Headers is the header row of the uploaded file
+	Headers []string `json:"headers"`
+	// Columns holds the dataset column each header was mapped to, empty for ignored headers.
+	// It is nil for jobs created before headers were mapped, their headers are the column names.
+	Columns []string `json:"columns"`
+	// TotalRows stays nil until every row of the file has been published
+	TotalRows     *int64    `json:"total_rows"`
+	PublishedRows int64     `json:"published_rows"`
+	InsertedRows  int64     `json:"inserted_rows"`
+	UpdatedRows   int64     `json:"updated_rows"`
+	SkippedRows   int64     `json:"skipped_rows"`
+	FailedRows    int64     `json:"failed_rows"`
+	Error         *string   `json:"error,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// ImportProgress counts the rows of an import job handled by the consumer
+type ImportProgress struct {
+	Inserted int64
+	Updated  int64
+	Skipped  int64
+	Failed   int64
+}
+
+// Add counts a single row with the given outcome
+func (p *ImportProgress) Add(outcome string) {
+	switch outcome {
+	case RowInserted:
+		p.Inserted++
+	case RowUpdated:
+		p.Updated++
+	case RowSkipped:
+		p.Skipped++
+	}
+}
+
+const importJobColumns = "id, state, dataset, file_name, mode, batch_id, compression, format, sheet, dialect, headers, header_columns, total_rows, published_rows, " +
+	"inserted_rows, updated_rows, skipped_rows, failed_rows, error, created_at, updated_at"
+
+// importJobHandledRows is the number of rows of an import job the consumer has handled
+const importJobHandledRows = "inserted_rows + updated_rows + skipped_rows + failed_rows"
+
+// CreateImportJob creates a new queued import job from the Dataset, FileName, Mode, BatchID,
+// Compression, Format, Sheet, Dialect, Headers and Columns of job. The other fields are ignored.
+func (c *Client) CreateImportJob(ctx context.Context, job ImportJob) (*ImportJob, error) {
+	query := "INSERT INTO import_jobs (state, dataset, file_name, mode, batch_id, compression, format, sheet, dialect, headers, header_columns) " +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING " + importJobColumns
+
+	// The dialect is stored as JSON, NULL if it isn't known
+	var dialect []byte
+	if job.Dialect != nil {
+		var err error
+		dialect, err = json.Marshal(job.Dialect)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode import job dialect: %w", err)
+		}
+	}
+
+	stmt, err := c.stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := scanImportJob(stmt.QueryRowContext(ctx, ImportStateQueued, job.Dataset, job.FileName, job.Mode,
+		job.BatchID, job.Compression, job.Format, job.Sheet, dialect, pq.Array(job.Headers), pq.Array(job.Columns)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create import job: %w", err)
+	}
+	return created, nil
+}
+
+// GetImportJob retrieves an import job by its ID
+func (c *Client) GetImportJob(ctx context.Context, id int64) (*ImportJob, error) {
+	query := "SELECT " + importJobColumns + " FROM import_jobs WHERE id = $1"
+
+	stmt, err := c.stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := scanImportJob(stmt.QueryRowContext(ctx, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("import job %d: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get import job: %w", err)
+	}
+	return job, nil
+}
+
+// AddPublishedRows increases the published row count of an import job
+func (c *Client) AddPublishedRows(ctx context.Context, id int64, count int64) error {
+	query := "UPDATE import_jobs SET published_rows = published_rows + $2, updated_at = NOW() WHERE id = $1"
+
+	_, err := c.exec(ctx, query, id, count)
+	if err != nil {
+		return fmt.Errorf("failed to update published rows: %w", err)
+	}
+	return nil
+}
+
+// FinishPublishing records the total row count once the whole file has been published.
+// The job is completed right away if the consumer has already handled every row.
+func (c *Client) FinishPublishing(ctx context.Context, id int64, total int64) error {
+	query := "UPDATE import_jobs SET total_rows = $2, published_rows = $2, " +
+		"state = CASE " +
+		"WHEN state = '" + ImportStateFailed + "' THEN state " +
+		"WHEN " + importJobHandledRows + " >= $2 THEN '" + ImportStateCompleted + "' " +
+		"ELSE state END, " +
+		"updated_at = NOW() WHERE id = $1"
+
+	_, err := c.exec(ctx, query, id, total)
+	if err != nil {
+		return fmt.Errorf("failed to finish publishing import job: %w", err)
+	}
+	return nil
+}
+
+// FailImportJob marks an import job as failed with the given reason
+func (c *Client) FailImportJob(ctx context.Context, id int64, reason string) error {
+	query := "UPDATE import_jobs SET state = $2, error = $3, updated_at = NOW() WHERE id = $1"
+
+	_, err := c.exec(ctx, query, id, ImportStateFailed, reason)
+	if err != nil {
+		return fmt.Errorf("failed to mark import job as failed: %w", err)
+	}
+	return nil
+}
+
+// RecordImportProgress adds the rows handled by the consumer to an import job
+// and moves it to processing, or to completed once every row has been handled.
+func (c *Client) RecordImportProgress(ctx context.Context, id int64, progress ImportProgress) error {
+	query := "UPDATE import_jobs SET inserted_rows = inserted_rows + $2, updated_rows = updated_rows + $3, " +
+		"skipped_rows = skipped_rows + $4, failed_rows = failed_rows + $5, " +
+		"state = CASE " +
+		"WHEN state = '" + ImportStateFailed + "' THEN state " +
+		"WHEN total_rows IS NOT NULL AND " + importJobHandledRows + " + $2 + $3 + $4 + $5 >= total_rows THEN '" + ImportStateCompleted + "' " +
+		"ELSE '" + ImportStateProcessing + "' END, " +
+		"updated_at = NOW() WHERE id = $1"
+
+	_, err := c.exec(ctx, query, id, progress.Inserted, progress.Updated, progress.Skipped, progress.Failed)
+	if err != nil {
+		return fmt.Errorf("failed to record import progress: %w", err)
+	}
+	return nil
+}
+
+// scanImportJob scans a row of importJobColumns, row is a *sql.Row or *sql.Rows
+func scanImportJob(row interface{ Scan(...interface{}) error }) (*ImportJob, error) {
+	var job ImportJob
+	var datasetName, fileName sql.NullString
+	var dialect []byte
+	err := row.Scan(&job.ID, &job.State, &datasetName, &fileName, &job.Mode, &job.BatchID, &job.Compression, &job.Format, &job.Sheet, &dialect, pq.Array(&job.Headers), pq.Array(&job.Columns), &job.TotalRows, &job.PublishedRows,
+		&job.InsertedRows, &job.UpdatedRows, &job.SkippedRows, &job.FailedRows, &job.Error, &job.CreatedAt, &job.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	job.Dataset = datasetName.String
+	job.FileName = fileName.String
+	if dialect != nil {
+		job.Dialect = &ingest.Dialect{}
+		if err := json.Unmarshal(dialect, job.Dialect); err != nil {
+			return nil, fmt.Errorf("failed to decode import job dialect: %w", err)
+		}
+	}
+	return &job, nil
+}
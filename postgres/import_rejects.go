@@ -0,0 +1,79 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// ImportReject is a row the consumer failed to insert
+type ImportReject struct {
+	ID    int64 `json:"id"`
+	JobID int64 `json:"job_id"`
+	Line  int   `json:"line_number"`
+	// RawValues is the JSON object of the original row
+	RawValues string    `json:"raw_values"`
+	Error     string    `json:"error"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// InsertImportReject saves a failed row together with the reason it failed.
+// A jobID of 0 stores the reject without an import job.
+func (c *Client) InsertImportReject(ctx context.Context, jobID int64, line int, rawValues string, reason string) error {
+	query := "INSERT INTO import_rejects (job_id, line_number, raw_values, error) VALUES ($1, $2, $3, $4)"
+
+	var job, lineNumber interface{}
+	if jobID != 0 {
+		job = jobID
+		lineNumber = line
+	}
+
+	stmt, err := c.stmt(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.ExecContext(ctx, job, lineNumber, rawValues, reason)
+	if err != nil {
+		return fmt.Errorf("failed to insert import reject: %w", err)
+	}
+	return nil
+}
+
+// EachImportReject calls fn for every reject of an import job, ordered by line number
+func (c *Client) EachImportReject(ctx context.Context, jobID int64, fn func(reject *ImportReject) error) error {
+	query := "SELECT id, job_id, line_number, raw_values, error, created_at FROM import_rejects " +
+		"WHERE job_id = $1 ORDER BY line_number, id"
+
+	stmt, err := c.stmt(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	rows, err := stmt.QueryContext(ctx, jobID)
+	if err != nil {
+		return fmt.Errorf("failed to query import rejects: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var reject ImportReject
+		var line sql.NullInt64
+		err := rows.Scan(&reject.ID, &reject.JobID, &line, &reject.RawValues, &reject.Error, &reject.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to scan import reject: %w", err)
+		}
+		reject.Line = int(line.Int64)
+
+		if err := fn(&reject); err != nil {
+			return err
+		}
+	}
+
+	// Check for any errors during row iteration
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed during row iteration: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package postgres
+
+import (
+	"context"
+	"csv-handler/dataset"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Row outcomes reported by WriteRecord and MergeRecords
+const (
+	RowInserted = "inserted"
+	RowUpdated  = "updated"
+	RowSkipped  = "skipped"
+)
+
+// WriteRecord writes a single row produced by Dataset.Values using the given import mode
+// and reports whether it was inserted, updated or skipped.
+// In ImportModeInsert and ImportModeFailOnConflict an existing key is a unique violation error.
+func (c *Client) WriteRecord(ctx context.Context, ds *dataset.Dataset, mode string, values []interface{}) (string, error) {
+	placeholders := make([]string, len(ds.Columns))
+	for i := range placeholders {
+		placeholders[i] = "$" + strconv.Itoa(i+1)
+	}
+
+	// xmax is only set on rows that already existed, so it tells inserts and updates apart
+	query := "INSERT INTO " + pq.QuoteIdentifier(ds.Table) + " (" + strings.Join(quoteColumns(ds), ", ") + ") VALUES (" +
+		strings.Join(placeholders, ", ") + ")" + conflictClause(ds, mode) + " RETURNING (xmax = 0)"
+
+	stmt, err := c.stmt(ctx, query)
+	if err != nil {
+		return "", err
+	}
+
+	var inserted bool
+	err = stmt.QueryRowContext(ctx, values...).Scan(&inserted)
+	if err == sql.ErrNoRows {
+		// The conflict clause left the existing row as it was
+		return RowSkipped, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to execute SQL statement: %w", err)
+	}
+
+	if inserted {
+		return RowInserted, nil
+	}
+	return RowUpdated, nil
+}
+
+// MergeRecords writes a batch of rows produced by Dataset.Values in one transaction using
+// the given import mode, and returns the outcome of every row in the same order.
+//
+// In ImportModeInsert and ImportModeFailOnConflict the rows are copied straight into the table,
+// so a single existing key fails the whole batch. Otherwise the rows are copied into a temporary
+// table and merged from there. When a key appears more than once in the batch only one row is
+// written and the others are skipped: the newest one for ImportModeUpsert, the first one otherwise.
+func (c *Client) MergeRecords(ctx context.Context, ds *dataset.Dataset, mode string, rows [][]interface{}) ([]string, error) {
+	outcomes := make([]string, len(rows))
+
+	if mode != ImportModeUpsert && mode != ImportModeSkipExisting {
+		if err := c.CopyRecords(ctx, ds, rows); err != nil {
+			return nil, err
+		}
+		for i := range outcomes {
+			outcomes[i] = RowInserted
+		}
+		return outcomes, nil
+	}
+
+	// Pick one row per key, the others are skipped
+	keep := dedupeRows(ds, mode, rows)
+	batch := make([][]interface{}, 0, len(keep))
+	for i := range rows {
+		outcomes[i] = RowSkipped
+		if keep[i] {
+			batch = append(batch, rows[i])
+		}
+	}
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The temporary table has the dataset columns without the primary key
+	_, err = tx.ExecContext(ctx, "CREATE TEMP TABLE dataset_batch (LIKE "+pq.QuoteIdentifier(ds.Table)+" INCLUDING DEFAULTS) ON COMMIT DROP")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary table: %w", err)
+	}
+
+	if err := copyRows(ctx, tx, "dataset_batch", ds.ColumnNames(), batch); err != nil {
+		return nil, err
+	}
+
+	columns := strings.Join(quoteColumns(ds), ", ")
+	query := "INSERT INTO " + pq.QuoteIdentifier(ds.Table) + " (" + columns + ") SELECT " + columns + " FROM dataset_batch" +
+		conflictClause(ds, mode) + " RETURNING " + pq.QuoteIdentifier(ds.Key) + ", (xmax = 0)"
+
+	result, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to merge rows: %w", err)
+	}
+	defer result.Close()
+
+	// Rows that are not returned were left as they were
+	written := make(map[int64]string)
+	for result.Next() {
+		var id int64
+		var inserted bool
+		if err := result.Scan(&id, &inserted); err != nil {
+			return nil, fmt.Errorf("failed to scan merged row: %w", err)
+		}
+		written[id] = RowUpdated
+		if inserted {
+			written[id] = RowInserted
+		}
+	}
+	if err := result.Err(); err != nil {
+		return nil, fmt.Errorf("failed to merge rows: %w", err)
+	}
+	result.Close()
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	keyIndex := ds.Index(ds.Key)
+	for i, values := range rows {
+		if outcome, ok := written[values[keyIndex].(int64)]; ok && keep[i] {
+			outcomes[i] = outcome
+		}
+	}
+	return outcomes, nil
+}
+
+// conflictClause returns the ON CONFLICT clause used to insert dataset rows in the given import mode.
+// Upserts only replace a row when at least one column changed and, if the dataset has
+// version columns, the incoming row is newer.
+func conflictClause(ds *dataset.Dataset, mode string) string {
+	key := pq.QuoteIdentifier(ds.Key)
+	table := pq.QuoteIdentifier(ds.Table)
+
+	switch mode {
+	case ImportModeSkipExisting:
+		return " ON CONFLICT (" + key + ") DO NOTHING"
+
+	case ImportModeUpsert:
+		var assignments, existing, incoming []string
+		for _, column := range ds.Columns {
+			if column.Name == ds.Key {
+				continue
+			}
+			name := pq.QuoteIdentifier(column.Name)
+			assignments = append(assignments, name+" = EXCLUDED."+name)
+			existing = append(existing, table+"."+name)
+			incoming = append(incoming, "EXCLUDED."+name)
+		}
+
+		condition := "(" + strings.Join(existing, ", ") + ") IS DISTINCT FROM (" + strings.Join(incoming, ", ") + ")"
+		if len(ds.VersionColumns) > 0 {
+			var existingVersion, incomingVersion []string
+			for _, name := range ds.VersionColumns {
+				existingVersion = append(existingVersion, table+"."+pq.QuoteIdentifier(name))
+				incomingVersion = append(incomingVersion, "EXCLUDED."+pq.QuoteIdentifier(name))
+			}
+			condition = "COALESCE(GREATEST(" + strings.Join(incomingVersion, ", ") + "), '-infinity')" +
+				" > COALESCE(GREATEST(" + strings.Join(existingVersion, ", ") + "), '-infinity') AND " + condition
+		}
+
+		if len(assignments) == 0 {
+			// Only the key is stored, there is nothing to update
+			return " ON CONFLICT (" + key + ") DO NOTHING"
+		}
+		return " ON CONFLICT (" + key + ") DO UPDATE SET " + strings.Join(assignments, ", ") + " WHERE " + condition
+	}
+
+	return ""
+}
+
+// dedupeRows marks the single row to write for each key.
+// Upserts keep the newest row by the version columns, the last one on a tie,
+// every other mode keeps the first row.
+func dedupeRows(ds *dataset.Dataset, mode string, rows [][]interface{}) []bool {
+	keep := make([]bool, len(rows))
+	chosen := make(map[int64]int)
+	keyIndex := ds.Index(ds.Key)
+
+	for i, values := range rows {
+		id := values[keyIndex].(int64)
+
+		previous, ok := chosen[id]
+		if ok && (mode != ImportModeUpsert || ds.Version(values).Before(ds.Version(rows[previous]))) {
+			continue
+		}
+		if ok {
+			keep[previous] = false
+		}
+		chosen[id] = i
+		keep[i] = true
+	}
+
+	return keep
+}
@@ -0,0 +1,180 @@
+package postgres
+
+import (
+	"context"
+	"csv-handler/migrations"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// migrationLockID is the advisory lock held while migrations run,
+// so several instances starting with auto_migrate don't apply the same migration
+const migrationLockID = 7246811390
+
+// MigrationStatus is an embedded migration and when it was applied
+type MigrationStatus struct {
+	migrations.Migration
+	// AppliedAt is nil for pending migrations
+	AppliedAt *time.Time
+}
+
+// MigrateUp applies every pending migration in version order and returns the applied migrations.
+// Each migration runs in its own transaction.
+func (c *Client) MigrateUp(ctx context.Context) ([]migrations.Migration, error) {
+	all, err := migrations.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []migrations.Migration
+	err = c.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range all {
+			if _, ok := versions[migration.Version]; ok {
+				continue
+			}
+			err := runMigration(ctx, conn, migration.Up,
+				"INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", migration.Version, migration.Name)
+			if err != nil {
+				return fmt.Errorf("failed to apply migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// MigrateDown reverts the latest steps applied migrations and returns the reverted migrations
+func (c *Client) MigrateDown(ctx context.Context, steps int) ([]migrations.Migration, error) {
+	all, err := migrations.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	var reverted []migrations.Migration
+	err = c.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		// Revert from the newest migration down
+		for i := len(all) - 1; i >= 0 && len(reverted) < steps; i-- {
+			migration := all[i]
+			if _, ok := versions[migration.Version]; !ok {
+				continue
+			}
+			err := runMigration(ctx, conn, migration.Down,
+				"DELETE FROM schema_migrations WHERE version = $1", migration.Version)
+			if err != nil {
+				return fmt.Errorf("failed to revert migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			reverted = append(reverted, migration)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// MigrationStatus lists every embedded migration and whether it has been applied
+func (c *Client) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	all, err := migrations.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []MigrationStatus
+	err = c.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range all {
+			status := MigrationStatus{Migration: migration}
+			if appliedAt, ok := versions[migration.Version]; ok {
+				status.AppliedAt = &appliedAt
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// withMigrationLock runs fn on a single connection that holds the migration lock,
+// after creating the schema_migrations table if it doesn't exist
+func (c *Client) withMigrationLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	// Advisory locks belong to a session, so every statement must use the same connection
+	conn, err := c.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open database connection: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockID)
+
+	query := "CREATE TABLE IF NOT EXISTS schema_migrations (" +
+		"version BIGINT PRIMARY KEY, " +
+		"name VARCHAR(255) NOT NULL, " +
+		"applied_at TIMESTAMP NOT NULL DEFAULT NOW())"
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
+	return fn(conn)
+}
+
+// appliedVersions returns when each applied migration version was applied
+func appliedVersions(ctx context.Context, conn *sql.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	versions := make(map[int64]time.Time)
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan schema_migrations: %w", err)
+		}
+		versions[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	return versions, nil
+}
+
+// runMigration runs the migration statements and the schema_migrations update in one transaction
+func runMigration(ctx context.Context, conn *sql.Conn, statements string, record string, args ...interface{}) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Without arguments the statements are sent as one simple query, so a file can hold several
+	if _, err := tx.ExecContext(ctx, statements); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return fmt.Errorf("failed to update schema_migrations: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
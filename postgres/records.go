@@ -0,0 +1,209 @@
+package postgres
+
+import (
+	"context"
+	"csv-handler/dataset"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// ErrNoSoftDelete is returned by SoftDeleteRecord for datasets without a soft delete column
+var ErrNoSoftDelete = errors.New("dataset has no soft delete column")
+
+// quoteColumns returns the quoted column names of a dataset, in definition order
+func quoteColumns(ds *dataset.Dataset) []string {
+	columns := make([]string, len(ds.Columns))
+	for i, column := range ds.Columns {
+		columns[i] = pq.QuoteIdentifier(column.Name)
+	}
+	return columns
+}
+
+// selectQuery selects every column of a dataset table
+func selectQuery(ds *dataset.Dataset) string {
+	return "SELECT " + strings.Join(quoteColumns(ds), ", ") + " FROM " + pq.QuoteIdentifier(ds.Table)
+}
+
+// GetRecord retrieves a single row of a dataset by its key
+func (c *Client) GetRecord(ctx context.Context, ds *dataset.Dataset, id int64) (map[string]interface{}, error) {
+	stmt, err := c.stmt(ctx, selectQuery(ds)+" WHERE "+pq.QuoteIdentifier(ds.Key)+" = $1 LIMIT 1")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.QueryContext(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute SQL statement: %w", err)
+	}
+	defer rows.Close()
+
+	return singleRecord(rows, id)
+}
+
+// UpdateRecord sets the given columns of a dataset row and returns the updated row.
+// The column names must be validated by the caller.
+func (c *Client) UpdateRecord(ctx context.Context, ds *dataset.Dataset, id int64, fields map[string]interface{}) (map[string]interface{}, error) {
+	// Sort the columns so the same fields always build the same query
+	columns := make([]string, 0, len(fields))
+	for column := range fields {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	var assignments []string
+	args := []interface{}{id}
+	for _, column := range columns {
+		args = append(args, fields[column])
+		assignments = append(assignments, fmt.Sprintf("%s = $%d", pq.QuoteIdentifier(column), len(args)))
+	}
+
+	query := "UPDATE " + pq.QuoteIdentifier(ds.Table) + " SET " + strings.Join(assignments, ", ") +
+		" WHERE " + pq.QuoteIdentifier(ds.Key) + " = $1 RETURNING " + strings.Join(quoteColumns(ds), ", ")
+
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update record: %w", err)
+	}
+	defer rows.Close()
+
+	return singleRecord(rows, id)
+}
+
+// SoftDeleteRecord marks a dataset row as deleted by setting its soft delete column.
+// Rows that are already deleted keep their original deletion time.
+func (c *Client) SoftDeleteRecord(ctx context.Context, ds *dataset.Dataset, id int64) error {
+	if ds.SoftDeleteColumn == "" {
+		return fmt.Errorf("dataset %s: %w", ds.Name, ErrNoSoftDelete)
+	}
+
+	column := pq.QuoteIdentifier(ds.SoftDeleteColumn)
+	query := "UPDATE " + pq.QuoteIdentifier(ds.Table) + " SET " + column + " = COALESCE(" + column + ", NOW()) " +
+		"WHERE " + pq.QuoteIdentifier(ds.Key) + " = $1"
+	return c.execRecord(ctx, query, id)
+}
+
+// HardDeleteRecord removes a dataset row
+func (c *Client) HardDeleteRecord(ctx context.Context, ds *dataset.Dataset, id int64) error {
+	query := "DELETE FROM " + pq.QuoteIdentifier(ds.Table) + " WHERE " + pq.QuoteIdentifier(ds.Key) + " = $1"
+	return c.execRecord(ctx, query, id)
+}
+
+// execRecord runs a statement on the row with the given id and reports ErrNotFound if there is none
+func (c *Client) execRecord(ctx context.Context, query string, id int64) error {
+	stmt, err := c.stmt(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	result, err := stmt.ExecContext(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to execute SQL statement: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	if affected == 0 {
+		return fmt.Errorf("record %d: %w", id, ErrNotFound)
+	}
+	return nil
+}
+
+// singleRecord scans the row of a single record query, or reports ErrNotFound if there is none
+func singleRecord(rows *sql.Rows, id int64) (map[string]interface{}, error) {
+	results, err := scanRows(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("record %d: %w", id, ErrNotFound)
+	}
+	return results[0], nil
+}
+
+// CreateDatasetTable creates the table of a dataset if it doesn't exist yet.
+// Timestamp columns of an existing table that are still TIMESTAMP are converted to TIMESTAMPTZ,
+// other changes to existing tables need a migration.
+func (c *Client) CreateDatasetTable(ctx context.Context, ds *dataset.Dataset) error {
+	definitions := make([]string, len(ds.Columns))
+	for i, column := range ds.Columns {
+		definition := pq.QuoteIdentifier(column.Name) + " " + sqlType(column)
+		if column.Required {
+			definition += " NOT NULL"
+		}
+		definitions[i] = definition
+	}
+	definitions = append(definitions, "PRIMARY KEY ("+pq.QuoteIdentifier(ds.Key)+")")
+
+	query := "CREATE TABLE IF NOT EXISTS " + pq.QuoteIdentifier(ds.Table) + " (" + strings.Join(definitions, ", ") + ")"
+	if _, err := c.db.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create table for dataset %s: %w", ds.Name, err)
+	}
+
+	return c.convertTimestampColumns(ctx, ds)
+}
+
+// convertTimestampColumns converts the timestamp columns of a dataset table created before timestamps
+// had a timezone. Their values hold the local time of the app server, UTC in the container image.
+func (c *Client) convertTimestampColumns(ctx context.Context, ds *dataset.Dataset) error {
+	var timestampColumns []string
+	for _, column := range ds.Columns {
+		if column.Type == dataset.TypeTimestamp {
+			timestampColumns = append(timestampColumns, column.Name)
+		}
+	}
+	if len(timestampColumns) == 0 {
+		return nil
+	}
+
+	rows, err := c.db.QueryContext(ctx, `SELECT column_name FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1 AND column_name = ANY($2)
+			AND data_type = 'timestamp without time zone'
+		ORDER BY ordinal_position`, ds.Table, pq.Array(timestampColumns))
+	if err != nil {
+		return fmt.Errorf("failed to read columns of dataset %s: %w", ds.Name, err)
+	}
+	var alterations []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read columns of dataset %s: %w", ds.Name, err)
+		}
+		column := pq.QuoteIdentifier(name)
+		alterations = append(alterations, "ALTER COLUMN "+column+" TYPE TIMESTAMPTZ USING "+column+" AT TIME ZONE 'UTC'")
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read columns of dataset %s: %w", ds.Name, err)
+	}
+	if len(alterations) == 0 {
+		return nil
+	}
+
+	query := "ALTER TABLE " + pq.QuoteIdentifier(ds.Table) + " " + strings.Join(alterations, ", ")
+	if _, err := c.db.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to convert timestamp columns of dataset %s: %w", ds.Name, err)
+	}
+	return nil
+}
+
+// sqlType returns the PostgreSQL type of a dataset column
+func sqlType(column dataset.Column) string {
+	switch column.Type {
+	case dataset.TypeInt:
+		return "BIGINT"
+	case dataset.TypeTimestamp:
+		return "TIMESTAMPTZ"
+	}
+	if column.MaxLength > 0 {
+		return fmt.Sprintf("VARCHAR(%d)", column.MaxLength)
+	}
+	return "TEXT"
+}
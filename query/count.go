@@ -0,0 +1,28 @@
+package query
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// Count modes for the total number of matching rows
+const (
+	// CountNone skips counting, the total is null
+	CountNone = "none"
+	// CountExact runs COUNT(*) with the filters
+	CountExact = "exact"
+	// CountEstimate uses the planner statistics, which is fast on large tables but approximate
+	CountEstimate = "estimate"
+)
+
+// ParseCount reads the count parameter, which defaults to CountNone
+func ParseCount(values url.Values) (string, error) {
+	switch mode := values.Get("count"); mode {
+	case "":
+		return CountNone, nil
+	case CountNone, CountExact, CountEstimate:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("count must be exact, estimate or none")
+	}
+}
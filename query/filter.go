@@ -0,0 +1,246 @@
+package query
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ColumnType is the type of a filterable column, it decides which operators are allowed
+type ColumnType int
+
+const (
+	Int ColumnType = iota
+	Text
+	Timestamp
+)
+
+// Filter operators
+const (
+	OpEq    = "eq"
+	OpNe    = "ne"
+	OpLt    = "lt"
+	OpLte   = "lte"
+	OpGt    = "gt"
+	OpGte   = "gte"
+	OpIn    = "in"
+	OpLike  = "like"
+	OpILike = "ilike"
+	// OpIs takes "null" or "not_null"
+	OpIs = "is"
+)
+
+// maxInValues limits the number of values of an "in" filter
+const maxInValues = 100
+
+// ReservedParams are query parameters that are not filters
+var ReservedParams = map[string]bool{
+	"limit":  true,
+	"offset": true,
+	"sort":   true,
+	"cursor": true,
+	"count":  true,
+}
+
+// operatorsByType lists the operators allowed for each column type
+var operatorsByType = map[ColumnType][]string{
+	Int:       {OpEq, OpNe, OpLt, OpLte, OpGt, OpGte, OpIn, OpIs},
+	Timestamp: {OpEq, OpNe, OpLt, OpLte, OpGt, OpGte, OpIn, OpIs},
+	Text:      {OpEq, OpNe, OpIn, OpLike, OpILike, OpIs},
+}
+
+// sqlOperators maps the comparison operators to SQL
+var sqlOperators = map[string]string{
+	OpEq:    "=",
+	OpNe:    "<>",
+	OpLt:    "<",
+	OpLte:   "<=",
+	OpGt:    ">",
+	OpGte:   ">=",
+	OpLike:  "LIKE",
+	OpILike: "ILIKE",
+}
+
+// timestampLayouts are the accepted formats of timestamp filter values
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// Columns is the whitelist of filterable columns and their types
+type Columns map[string]ColumnType
+
+// Filter is a single condition on a whitelisted column
+type Filter struct {
+	Column   string
+	Operator string
+	// Values holds one value, or several for OpIn. It is empty for OpIs.
+	Values []interface{}
+	// Null is set for OpIs, true for "is null" and false for "is not null"
+	Null bool
+}
+
+// ParseFilters builds filters from query parameters such as
+// created_at[gte]=2023-01-01, id[in]=1,2,3, first_name[ilike]=jo* or deleted_at=null.
+//
+// A parameter without an operator is an equality filter, the values "null" and
+// "not_null" are shorthands for the "is" operator. In like/ilike patterns * matches
+// any characters. Parameters that are not whitelisted columns are rejected,
+// except for ReservedParams.
+func ParseFilters(values url.Values, columns Columns) ([]Filter, error) {
+	var filters []Filter
+
+	// Sort the keys so the same parameters always build the same SQL
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		rawValues := values[key]
+		if ReservedParams[key] {
+			continue
+		}
+
+		// Split "column[operator]" into its parts
+		column, operator := key, OpEq
+		if open := strings.Index(key, "["); open != -1 && strings.HasSuffix(key, "]") {
+			column = key[:open]
+			operator = strings.ToLower(key[open+1 : len(key)-1])
+		}
+
+		columnType, ok := columns[column]
+		if !ok {
+			return nil, fmt.Errorf("unknown filter column %q", column)
+		}
+		if !allowsOperator(columnType, operator) {
+			return nil, fmt.Errorf("operator %q is not supported for column %q", operator, column)
+		}
+
+		for _, rawValue := range rawValues {
+			filter, err := parseFilter(column, columnType, operator, rawValue)
+			if err != nil {
+				return nil, fmt.Errorf("invalid filter %s: %w", key, err)
+			}
+			filters = append(filters, filter)
+		}
+	}
+
+	return filters, nil
+}
+
+// parseFilter validates the value of a single filter against the column type
+func parseFilter(column string, columnType ColumnType, operator string, rawValue string) (Filter, error) {
+	filter := Filter{Column: column, Operator: operator}
+
+	// The null shorthands work with eq (deleted_at=null) and is (deleted_at[is]=not_null)
+	if operator == OpEq || operator == OpIs {
+		switch strings.ToLower(rawValue) {
+		case "null":
+			filter.Operator, filter.Null = OpIs, true
+			return filter, nil
+		case "not_null":
+			filter.Operator, filter.Null = OpIs, false
+			return filter, nil
+		}
+		if operator == OpIs {
+			return filter, fmt.Errorf("expected null or not_null, got %q", rawValue)
+		}
+	}
+
+	rawValues := []string{rawValue}
+	if operator == OpIn {
+		rawValues = strings.Split(rawValue, ",")
+		if len(rawValues) > maxInValues {
+			return filter, fmt.Errorf("at most %d values are allowed", maxInValues)
+		}
+	}
+
+	for _, raw := range rawValues {
+		value, err := ParseValue(columnType, strings.TrimSpace(raw))
+		if err != nil {
+			return filter, err
+		}
+		if operator == OpLike || operator == OpILike {
+			value = strings.ReplaceAll(value.(string), "*", "%")
+		}
+		filter.Values = append(filter.Values, value)
+	}
+
+	return filter, nil
+}
+
+// ParseValue converts a raw value to the column type
+func ParseValue(columnType ColumnType, raw string) (interface{}, error) {
+	switch columnType {
+	case Int:
+		value, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an integer", raw)
+		}
+		return value, nil
+
+	case Timestamp:
+		for _, layout := range timestampLayouts {
+			if value, err := time.Parse(layout, raw); err == nil {
+				return value, nil
+			}
+		}
+		return nil, fmt.Errorf("%q is not a timestamp, use RFC 3339 or YYYY-MM-DD", raw)
+
+	default:
+		return raw, nil
+	}
+}
+
+// allowsOperator reports whether the operator can be used on the column type
+func allowsOperator(columnType ColumnType, operator string) bool {
+	for _, allowed := range operatorsByType[columnType] {
+		if allowed == operator {
+			return true
+		}
+	}
+	return false
+}
+
+// BuildWhere turns filters into SQL conditions joined with AND, each starting with " AND ".
+// Values are always passed as parameters, numbered from firstArg.
+func BuildWhere(filters []Filter, firstArg int) (string, []interface{}) {
+	var sql strings.Builder
+	var args []interface{}
+
+	for _, filter := range filters {
+		column := pq.QuoteIdentifier(filter.Column)
+
+		switch filter.Operator {
+		case OpIs:
+			if filter.Null {
+				fmt.Fprintf(&sql, " AND %s IS NULL", column)
+			} else {
+				fmt.Fprintf(&sql, " AND %s IS NOT NULL", column)
+			}
+
+		case OpIn:
+			placeholders := make([]string, len(filter.Values))
+			for i, value := range filter.Values {
+				args = append(args, value)
+				placeholders[i] = "$" + strconv.Itoa(firstArg+len(args)-1)
+			}
+			fmt.Fprintf(&sql, " AND %s IN (%s)", column, strings.Join(placeholders, ", "))
+
+		default:
+			args = append(args, filter.Values[0])
+			fmt.Fprintf(&sql, " AND %s %s $%d", column, sqlOperators[filter.Operator], firstArg+len(args)-1)
+		}
+	}
+
+	return sql.String(), args
+}
@@ -0,0 +1,353 @@
+package query
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// DefaultLimit is the page size when no limit is given
+	DefaultLimit = 100
+	// MaxLimit is the largest page size, larger limits are lowered to it
+	MaxLimit = 1000
+)
+
+// Cursor directions
+const (
+	directionNext = "next"
+	directionPrev = "prev"
+)
+
+// SortField is a column to sort by
+type SortField struct {
+	Column string
+	Desc   bool
+}
+
+// Page describes which page of results to fetch
+type Page struct {
+	Limit  int
+	Offset int
+	Sort   []SortField
+	// Cursor is set when paging from a next_cursor or prev_cursor
+	Cursor *Cursor
+}
+
+// Cursor is the decoded form of an opaque keyset cursor.
+// It holds the sort values of the row the page starts after.
+type Cursor struct {
+	Direction string        `json:"d"`
+	Sort      string        `json:"s"`
+	Values    []interface{} `json:"v"`
+}
+
+// PageInfo describes the returned page and how to get the pages next to it
+type PageInfo struct {
+	Limit int    `json:"limit"`
+	Sort  string `json:"sort"`
+	// Count is how the total was computed, see ParseCount
+	Count      string  `json:"count"`
+	NextCursor *string `json:"next_cursor"`
+	PrevCursor *string `json:"prev_cursor"`
+}
+
+// ParsePage reads limit, offset, sort and cursor from query parameters.
+//
+// sort is a comma separated list of whitelisted columns, a leading "-" sorts
+// descending, e.g. sort=-created_at,last_name. The key column is always added
+// as the last sort field so the order is stable. cursor is a next_cursor or
+// prev_cursor from a previous page and can't be combined with offset.
+func ParsePage(values url.Values, columns Columns, key string) (*Page, error) {
+	page := &Page{Limit: DefaultLimit}
+
+	if limitStr := values.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 {
+			return nil, fmt.Errorf("limit must be a positive integer")
+		}
+		if limit > MaxLimit {
+			limit = MaxLimit
+		}
+		page.Limit = limit
+	}
+
+	if offsetStr := values.Get("offset"); offsetStr != "" {
+		offset, err := strconv.Atoi(offsetStr)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("offset must be a non-negative integer")
+		}
+		page.Offset = offset
+	}
+
+	sortFields, err := parseSort(values.Get("sort"), columns, key)
+	if err != nil {
+		return nil, err
+	}
+	page.Sort = sortFields
+
+	if cursorStr := values.Get("cursor"); cursorStr != "" {
+		if page.Offset > 0 {
+			return nil, fmt.Errorf("cursor can't be combined with offset")
+		}
+
+		cursor, err := decodeCursor(cursorStr)
+		if err != nil {
+			return nil, err
+		}
+		if cursor.Sort != page.SortString() || len(cursor.Values) != len(page.Sort) {
+			return nil, fmt.Errorf("cursor was created with a different sort")
+		}
+		// The values are sent to PostgreSQL as text, so they must parse as their column type
+		for i, value := range cursor.Values {
+			if text, ok := value.(string); ok {
+				if _, err := ParseValue(columns[page.Sort[i].Column], text); err != nil {
+					return nil, fmt.Errorf("invalid cursor")
+				}
+			}
+		}
+		page.Cursor = cursor
+	}
+
+	return page, nil
+}
+
+// parseSort parses the sort parameter and appends the key column
+func parseSort(raw string, columns Columns, key string) ([]SortField, error) {
+	var fields []SortField
+	seen := make(map[string]bool)
+
+	if raw != "" {
+		for _, part := range strings.Split(raw, ",") {
+			part = strings.TrimSpace(part)
+			field := SortField{Column: part}
+			if strings.HasPrefix(part, "-") {
+				field = SortField{Column: part[1:], Desc: true}
+			}
+
+			if _, ok := columns[field.Column]; !ok {
+				return nil, fmt.Errorf("unknown sort column %q", field.Column)
+			}
+			if seen[field.Column] {
+				return nil, fmt.Errorf("sort column %q is repeated", field.Column)
+			}
+			seen[field.Column] = true
+			fields = append(fields, field)
+		}
+	}
+
+	// The key column breaks ties so every row has a distinct position
+	if !seen[key] {
+		fields = append(fields, SortField{Column: key})
+	}
+	return fields, nil
+}
+
+// SortString returns the normalized sort parameter
+func (p *Page) SortString() string {
+	parts := make([]string, len(p.Sort))
+	for i, field := range p.Sort {
+		parts[i] = field.Column
+		if field.Desc {
+			parts[i] = "-" + field.Column
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// backwards reports whether the page is fetched in reverse order, from a prev_cursor
+func (p *Page) backwards() bool {
+	return p.Cursor != nil && p.Cursor.Direction == directionPrev
+}
+
+// BuildOrderBy returns the ORDER BY clause. NULLs sort as the largest value,
+// matching the PostgreSQL default. Pages fetched backwards use the reverse order.
+func (p *Page) BuildOrderBy() string {
+	parts := make([]string, len(p.Sort))
+	for i, field := range p.Sort {
+		if field.Desc != p.backwards() {
+			parts[i] = pq.QuoteIdentifier(field.Column) + " DESC NULLS FIRST"
+		} else {
+			parts[i] = pq.QuoteIdentifier(field.Column) + " ASC NULLS LAST"
+		}
+	}
+	return " ORDER BY " + strings.Join(parts, ", ")
+}
+
+// BuildKeyset returns the condition selecting the rows after the cursor in the
+// fetch order, starting with " AND ", or an empty string without a cursor.
+// Values are passed as parameters numbered from firstArg.
+func (p *Page) BuildKeyset(firstArg int) (string, []interface{}) {
+	if p.Cursor == nil {
+		return "", nil
+	}
+
+	var args []interface{}
+	var alternatives []string
+
+	// A row comes after the cursor if it is equal on the first i sort fields
+	// and after it on field i, for any i
+	for i, field := range p.Sort {
+		var conditions []string
+		for j := 0; j < i; j++ {
+			conditions = append(conditions, p.equal(p.Sort[j], p.Cursor.Values[j], firstArg, &args))
+		}
+
+		after, ok := p.after(field, p.Cursor.Values[i], firstArg, &args)
+		if !ok {
+			continue
+		}
+		conditions = append(conditions, after)
+		alternatives = append(alternatives, "("+strings.Join(conditions, " AND ")+")")
+	}
+
+	if len(alternatives) == 0 {
+		return " AND FALSE", nil
+	}
+	return " AND (" + strings.Join(alternatives, " OR ") + ")", args
+}
+
+// equal builds the condition for a column equal to the cursor value
+func (p *Page) equal(field SortField, value interface{}, firstArg int, args *[]interface{}) string {
+	column := pq.QuoteIdentifier(field.Column)
+	if value == nil {
+		return column + " IS NULL"
+	}
+
+	*args = append(*args, value)
+	return fmt.Sprintf("%s = $%d", column, firstArg+len(*args)-1)
+}
+
+// after builds the condition for a column coming after the cursor value in the fetch order.
+// It returns false when no value can come after it.
+func (p *Page) after(field SortField, value interface{}, firstArg int, args *[]interface{}) (string, bool) {
+	column := pq.QuoteIdentifier(field.Column)
+	desc := field.Desc != p.backwards()
+
+	// NULLs come last in ascending order and first in descending order
+	if value == nil {
+		if desc {
+			return column + " IS NOT NULL", true
+		}
+		return "", false
+	}
+
+	*args = append(*args, value)
+	placeholder := "$" + strconv.Itoa(firstArg+len(*args)-1)
+	if desc {
+		return fmt.Sprintf("%s < %s", column, placeholder), true
+	}
+	return fmt.Sprintf("(%s > %s OR %s IS NULL)", column, placeholder, column), true
+}
+
+// FetchLimit is the number of rows to query, one more than the limit to know if another page exists
+func (p *Page) FetchLimit() int {
+	return p.Limit + 1
+}
+
+// Result trims the rows fetched with FetchLimit to the page, puts them in sort order
+// and builds the cursors of the pages before and after it
+func (p *Page) Result(rows []map[string]interface{}) ([]map[string]interface{}, *PageInfo, error) {
+	hasMore := len(rows) > p.Limit
+	if hasMore {
+		rows = rows[:p.Limit]
+	}
+
+	// Rows fetched backwards are in reverse order
+	if p.backwards() {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+
+	info := &PageInfo{Limit: p.Limit, Sort: p.SortString()}
+	if len(rows) == 0 {
+		return rows, info, nil
+	}
+
+	// There is a next page if more rows were found going forwards,
+	// or if this page was reached going backwards
+	if hasMore || p.backwards() {
+		cursor, err := p.encodeCursor(directionNext, rows[len(rows)-1])
+		if err != nil {
+			return nil, nil, err
+		}
+		info.NextCursor = &cursor
+	}
+
+	// There is a previous page if more rows were found going backwards,
+	// or if this page didn't start at the beginning
+	if (hasMore && p.backwards()) || (!p.backwards() && (p.Cursor != nil || p.Offset > 0)) {
+		cursor, err := p.encodeCursor(directionPrev, rows[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		info.PrevCursor = &cursor
+	}
+
+	return rows, info, nil
+}
+
+// encodeCursor builds an opaque cursor from the sort values of a row
+func (p *Page) encodeCursor(direction string, row map[string]interface{}) (string, error) {
+	cursor := Cursor{
+		Direction: direction,
+		Sort:      p.SortString(),
+		Values:    make([]interface{}, len(p.Sort)),
+	}
+
+	for i, field := range p.Sort {
+		value := row[field.Column]
+		// Keep full precision, the value is compared against the column again
+		if t, ok := value.(time.Time); ok {
+			value = t.Format(time.RFC3339Nano)
+		}
+		cursor.Values[i] = value
+	}
+
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode cursor: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeCursor parses an opaque cursor
+func decodeCursor(raw string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	// Keep numbers as json.Number so large ids don't lose precision
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var cursor Cursor
+	if err := decoder.Decode(&cursor); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	if cursor.Direction != directionNext && cursor.Direction != directionPrev {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	// Only scalar values can be compared against a column
+	for i, value := range cursor.Values {
+		switch v := value.(type) {
+		case nil, string:
+		case json.Number:
+			cursor.Values[i] = v.String()
+		default:
+			return nil, fmt.Errorf("invalid cursor")
+		}
+	}
+
+	return &cursor, nil
+}
@@ -0,0 +1,157 @@
+package rabbitmq
+
+import (
+	"csv-handler/broker"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// maxUnconfirmed is how many messages a Publisher sends before waiting for confirms
+const maxUnconfirmed = 10000
+
+// Publisher publishes persistent messages on its own channel in confirm mode.
+// Publish only hands the message to the broker, Wait blocks until the broker
+// has confirmed every message published so far.
+type Publisher struct {
+	channel *amqp.Channel
+
+	lock      sync.Mutex
+	cond      *sync.Cond
+	published uint64
+	confirmed uint64
+	nacked    uint64
+	// closed is set once the channel closed and no more confirms will arrive
+	closed bool
+}
+
+// NewPublisher opens a channel in confirm mode for publishing
+func (r *RabbitMQ) NewPublisher() (broker.Publisher, error) {
+	err := r.CheckConnection()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create publisher: %v", err)
+	}
+
+	ch, err := r.getConnection().Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open RabbitMQ channel: %v", err)
+	}
+
+	err = ch.Confirm(false)
+	if err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("failed to put RabbitMQ channel in confirm mode: %v", err)
+	}
+
+	p := &Publisher{channel: ch}
+	p.cond = sync.NewCond(&p.lock)
+
+	// Confirms must be read continuously, the client blocks when the buffer is full
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 100))
+	go p.trackConfirms(confirms)
+
+	return p, nil
+}
+
+// trackConfirms counts broker confirms until the channel is closed
+func (p *Publisher) trackConfirms(confirms <-chan amqp.Confirmation) {
+	for confirm := range confirms {
+		p.lock.Lock()
+		p.confirmed++
+		if !confirm.Ack {
+			p.nacked++
+		}
+		p.cond.Broadcast()
+		p.lock.Unlock()
+	}
+
+	p.lock.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	p.lock.Unlock()
+}
+
+// Publish sends a persistent message to the RabbitMQ queue
+func (p *Publisher) Publish(routingKey string, payload interface{}) error {
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON payload: %v", err)
+	}
+
+	return p.PublishRaw(routingKey, jsonPayload, nil)
+}
+
+// PublishRaw sends an already encoded persistent message with the given headers
+func (p *Publisher) PublishRaw(routingKey string, body []byte, headers map[string]interface{}) error {
+	// Wait while too many messages are unconfirmed
+	p.lock.Lock()
+	for p.published-p.confirmed >= maxUnconfirmed && !p.closed {
+		p.cond.Wait()
+	}
+	closed := p.closed
+	p.published++
+	p.lock.Unlock()
+
+	if closed {
+		return fmt.Errorf("failed to publish message: channel closed")
+	}
+
+	err := p.channel.Publish(
+		"",         // Exchange
+		routingKey, // Routing key
+		false,      // Mandatory
+		false,      // Immediate
+		amqp.Publishing{
+			Headers:      amqp.Table(headers),
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			Body:         body,
+		},
+	)
+	if err != nil {
+		// The message was never sent, so no confirm will arrive for it
+		p.lock.Lock()
+		p.published--
+		p.cond.Broadcast()
+		p.lock.Unlock()
+		return fmt.Errorf("failed to publish message: %v", err)
+	}
+	return nil
+}
+
+// Wait blocks until every published message has been confirmed by the broker.
+// It returns an error if any message was rejected since the last call to Wait,
+// or if the channel closed first.
+func (p *Publisher) Wait() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for p.confirmed < p.published && !p.closed {
+		p.cond.Wait()
+	}
+
+	if p.nacked > 0 {
+		nacked := p.nacked
+		p.nacked = 0
+		return fmt.Errorf("%d of %d messages were rejected by RabbitMQ", nacked, p.published)
+	}
+	if p.confirmed < p.published {
+		return fmt.Errorf("channel closed before %d of %d messages were confirmed", p.published-p.confirmed, p.published)
+	}
+	return nil
+}
+
+// IsClosed reports whether the publisher channel has closed, e.g. because the connection dropped.
+// A closed publisher can't be used again.
+func (p *Publisher) IsClosed() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.closed
+}
+
+// Close closes the publisher channel
+func (p *Publisher) Close() error {
+	return p.channel.Close()
+}
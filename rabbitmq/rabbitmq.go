@@ -1,51 +1,207 @@
 package rabbitmq
 
 import (
+	"csv-handler/broker"
 	"encoding/json"
 	"fmt"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/spf13/viper"
 	"github.com/streadway/amqp"
 )
 
+// RabbitMQ is the production broker
+var _ broker.Broker = (*RabbitMQ)(nil)
+
 var (
 	rabbitMQInstance *RabbitMQ
 	rabbitMQLock     sync.Mutex
 	rabbitMQInit     sync.Once
 )
 
-// RabbitMQ represents a RabbitMQ client
+const (
+	// minReconnectDelay and maxReconnectDelay bound the backoff between reconnect attempts
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+
+	// connectTimeout is how long an operation waits for a dropped connection to come back
+	connectTimeout = time.Minute
+)
+
+// RabbitMQ represents a RabbitMQ client, it implements broker.Broker.
+// When the connection or channel drops it reconnects with backoff, declares the
+// topology again and re-subscribes every consumer created through Consume.
 type RabbitMQ struct {
+	amqpURI  string
+	username string
+	password string
+
+	lock       sync.RWMutex
 	connection *amqp.Connection
 	channel    *amqp.Channel
 	queue      amqp.Queue
+
+	// connected is closed while a connection is available and replaced when it drops
+	connected chan struct{}
+	// done is closed by Close, which stops reconnecting
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// declarations are run again on every reconnect
+	declarations []func() error
+
+	// consumerChannels are the channels opened by Consume, one per consumer
+	consumerChannels map[*amqp.Channel]struct{}
+	consumerLock     sync.Mutex
 }
 
 // NewRabbitMQ creates a new instance of RabbitMQ
 func NewRabbitMQ(amqpURI, username, password string) (*RabbitMQ, error) {
-	conn, err := amqp.DialConfig(amqpURI, amqp.Config{
+	r := &RabbitMQ{
+		amqpURI:          amqpURI,
+		username:         username,
+		password:         password,
+		connected:        make(chan struct{}),
+		done:             make(chan struct{}),
+		consumerChannels: make(map[*amqp.Channel]struct{}),
+	}
+
+	conn, ch, err := r.dial()
+	if err != nil {
+		return nil, err
+	}
+	r.setConnection(conn, ch)
+
+	return r, nil
+}
+
+// dial opens a new connection and channel
+func (r *RabbitMQ) dial() (*amqp.Connection, *amqp.Channel, error) {
+	conn, err := amqp.DialConfig(r.amqpURI, amqp.Config{
 		SASL: []amqp.Authentication{
 			&amqp.PlainAuth{
-				Username: username,
-				Password: password,
+				Username: r.username,
+				Password: r.password,
 			},
 		},
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to RabbitMQ: %v", err)
+		return nil, nil, fmt.Errorf("failed to connect to RabbitMQ: %v", err)
 	}
 
 	ch, err := conn.Channel()
 	if err != nil {
-		return nil, fmt.Errorf("failed to open RabbitMQ channel: %v", err)
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to open RabbitMQ channel: %v", err)
 	}
 
-	return &RabbitMQ{
-		connection: conn,
-		channel:    ch,
-	}, nil
+	return conn, ch, nil
+}
+
+// setConnection makes a new connection available and starts watching it for close events
+func (r *RabbitMQ) setConnection(conn *amqp.Connection, ch *amqp.Channel) {
+	r.lock.Lock()
+	r.connection = conn
+	r.channel = ch
+	close(r.connected)
+	r.lock.Unlock()
+
+	go r.watch(conn, ch)
+}
+
+// watch waits for the connection or the shared channel to close.
+// A closed channel is reopened, a closed connection is reconnected.
+func (r *RabbitMQ) watch(conn *amqp.Connection, ch *amqp.Channel) {
+	connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	chanClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	for {
+		select {
+		case <-r.done:
+			return
+
+		case err := <-connClosed:
+			if r.isClosed() {
+				return
+			}
+			log.Printf("RabbitMQ connection closed: %v, reconnecting", err)
+
+			// Make new operations wait until the connection is back
+			r.lock.Lock()
+			r.connected = make(chan struct{})
+			r.lock.Unlock()
+
+			r.reconnect()
+			return
+
+		case err, ok := <-chanClosed:
+			// Channels also close when the connection does, that is handled above
+			chanClosed = nil
+			if !ok || r.isClosed() || conn.IsClosed() {
+				continue
+			}
+			log.Printf("RabbitMQ channel closed: %v, reopening", err)
+
+			newCh, openErr := conn.Channel()
+			if openErr != nil {
+				log.Printf("Failed to reopen RabbitMQ channel: %v", openErr)
+				continue
+			}
+
+			r.lock.Lock()
+			r.channel = newCh
+			r.lock.Unlock()
+			chanClosed = newCh.NotifyClose(make(chan *amqp.Error, 1))
+		}
+	}
+}
+
+// reconnect dials until a connection is established, backing off between attempts,
+// and declares the topology again before the connection is made available
+func (r *RabbitMQ) reconnect() {
+	delay := minReconnectDelay
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-time.After(delay):
+		}
+
+		conn, ch, err := r.dial()
+		if err == nil {
+			err = r.redeclare(conn, ch)
+			if err == nil {
+				r.setConnection(conn, ch)
+				log.Println("Reconnected to RabbitMQ")
+				return
+			}
+			conn.Close()
+		}
+
+		delay = delay * 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+		log.Printf("Failed to reconnect to RabbitMQ: %v, retrying in %s", err, delay)
+	}
+}
+
+// redeclare runs every recorded declaration on the new connection and channel
+func (r *RabbitMQ) redeclare(conn *amqp.Connection, ch *amqp.Channel) error {
+	r.lock.Lock()
+	r.connection = conn
+	r.channel = ch
+	declarations := r.declarations
+	r.lock.Unlock()
+
+	for _, declare := range declarations {
+		if err := declare(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // GetRabbitMQInstance returns the singleton instance of RabbitMQ
@@ -92,35 +248,144 @@ func InitializeRabbitMQ() error {
 	return nil
 }
 
+// CheckConnection waits for a dropped connection to be re-established
 func (r *RabbitMQ) CheckConnection() error {
-	if r.connection == nil || r.connection.IsClosed() {
-		// Reestablish the RabbitMQ connection
-		err := InitializeRabbitMQ()
-		if err != nil {
-			return fmt.Errorf("failed to reconnect to RabbitMQ: %v", err)
-		}
+	err := r.waitConnected(connectTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to reconnect to RabbitMQ: %v", err)
 	}
 	return nil
 }
 
-// DeclareQueue declares a new queue in RabbitMQ
-func (r *RabbitMQ) DeclareQueue(queueName string) error {
-	q, err := r.channel.QueueDeclare(
+// waitConnected blocks until a connection is available. A timeout of 0 waits forever.
+func (r *RabbitMQ) waitConnected(timeout time.Duration) error {
+	r.lock.RLock()
+	connected := r.connected
+	r.lock.RUnlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-connected:
+		return nil
+	case <-r.done:
+		return fmt.Errorf("RabbitMQ client closed")
+	case <-expired:
+		return fmt.Errorf("timed out after %s waiting for the connection", timeout)
+	}
+}
+
+// isClosed reports whether Close has been called
+func (r *RabbitMQ) isClosed() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// getConnection returns the current connection
+func (r *RabbitMQ) getConnection() *amqp.Connection {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.connection
+}
+
+// getChannel returns the current shared channel
+func (r *RabbitMQ) getChannel() *amqp.Channel {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.channel
+}
+
+// addDeclaration runs declare now and records it so it runs again after a reconnect
+func (r *RabbitMQ) addDeclaration(declare func() error) error {
+	err := declare()
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	r.declarations = append(r.declarations, declare)
+	r.lock.Unlock()
+	return nil
+}
+
+// replaceIncompatibleQueue deletes a queue that an earlier version declared with other properties,
+// such as the non-durable queue of the first releases, so it can be declared again. RabbitMQ rejects
+// a declare that doesn't match the existing queue with PRECONDITION_FAILED and closes the channel,
+// so the check runs on channels of its own. A queue that still holds messages is kept and
+// an error is returned, it has to be drained or deleted by hand before starting again.
+func (r *RabbitMQ) replaceIncompatibleQueue(queueName string, args amqp.Table) error {
+	conn := r.getConnection()
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open RabbitMQ channel: %v", err)
+	}
+	_, err = ch.QueueDeclare(queueName, true, false, false, false, args)
+	if err == nil {
+		ch.Close()
+		return nil
+	}
+	if amqpErr, ok := err.(*amqp.Error); !ok || amqpErr.Code != amqp.PreconditionFailed {
+		ch.Close()
+		return fmt.Errorf("failed to declare RabbitMQ queue %s: %v", queueName, err)
+	}
+
+	// The channel was closed by the failed declare
+	ch, err = conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open RabbitMQ channel: %v", err)
+	}
+	defer ch.Close()
+
+	_, err = ch.QueueDelete(
 		queueName, // Name of the queue
-		false,     // Durable (queue survives server restart)
-		false,     // Delete when unused
-		false,     // Exclusive (for this connection only)
+		false,     // If unused
+		true,      // If empty
 		false,     // No-wait
-		nil,       // Arguments
 	)
 	if err != nil {
-		return fmt.Errorf("failed to declare RabbitMQ queue: %v", err)
+		return fmt.Errorf("RabbitMQ queue %s was declared with other properties by an earlier version and is not empty, "+
+			"drain or delete it before starting: %v", queueName, err)
 	}
-
-	r.queue = q
+	log.Printf("Deleted empty RabbitMQ queue %s declared with other properties by an earlier version", queueName)
 	return nil
 }
 
+// DeclareQueue declares a new queue in RabbitMQ
+func (r *RabbitMQ) DeclareQueue(queueName string) error {
+	return r.addDeclaration(func() error {
+		err := r.replaceIncompatibleQueue(queueName, nil)
+		if err != nil {
+			return err
+		}
+
+		q, err := r.getChannel().QueueDeclare(
+			queueName, // Name of the queue
+			true,      // Durable (queue survives server restart)
+			false,     // Delete when unused
+			false,     // Exclusive (for this connection only)
+			false,     // No-wait
+			nil,       // Arguments
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare RabbitMQ queue: %v", err)
+		}
+
+		r.lock.Lock()
+		r.queue = q
+		r.lock.Unlock()
+		return nil
+	})
+}
+
 // Publish sends a message to the RabbitMQ queue
 func (r *RabbitMQ) Publish(routingKey string, payload interface{}) error {
 	err := r.CheckConnection()
@@ -133,14 +398,15 @@ func (r *RabbitMQ) Publish(routingKey string, payload interface{}) error {
 		return fmt.Errorf("failed to marshal JSON payload: %v", err)
 	}
 
-	err = r.channel.Publish(
+	err = r.getChannel().Publish(
 		"",         // Exchange
 		routingKey, // Routing key
 		false,      // Mandatory
 		false,      // Immediate
 		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        jsonPayload,
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			Body:         jsonPayload,
 		},
 	)
 	if err != nil {
@@ -149,9 +415,47 @@ func (r *RabbitMQ) Publish(routingKey string, payload interface{}) error {
 	return nil
 }
 
-// Consume consumes messages from the RabbitMQ queue with manual acknowledgment
-func (r *RabbitMQ) Consume(queueName string) (<-chan amqp.Delivery, error) {
-	msgs, err := r.channel.Consume(
+// Consume consumes messages from the RabbitMQ queue with manual acknowledgment.
+// Every consumer gets its own channel so a slow consumer doesn't hold up the others,
+// and the broker sends at most prefetch unacknowledged messages to it (0 means unlimited).
+//
+// The returned channel stays open across reconnects, the consumer is subscribed again
+// whenever its channel or the connection drops. It is only closed by Close.
+func (r *RabbitMQ) Consume(queueName string, prefetch int) (<-chan broker.Delivery, error) {
+	ch, msgs, err := r.subscribe(queueName, prefetch)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make(chan broker.Delivery)
+	go r.forward(queueName, prefetch, ch, msgs, deliveries)
+
+	return deliveries, nil
+}
+
+// subscribe opens a consumer channel and starts consuming from the queue
+func (r *RabbitMQ) subscribe(queueName string, prefetch int) (*amqp.Channel, <-chan amqp.Delivery, error) {
+	err := r.CheckConnection()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to consume from RabbitMQ queue: %v", err)
+	}
+
+	ch, err := r.getConnection().Channel()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open RabbitMQ channel: %v", err)
+	}
+
+	err = ch.Qos(
+		prefetch, // Prefetch count
+		0,        // Prefetch size
+		false,    // Global (apply to the whole connection)
+	)
+	if err != nil {
+		ch.Close()
+		return nil, nil, fmt.Errorf("failed to set RabbitMQ channel QoS: %v", err)
+	}
+
+	msgs, err := ch.Consume(
 		queueName, // Name of the queue
 		"",        // Consumer name (empty string for auto-generated name)
 		false,     // Auto-acknowledgment set to false
@@ -161,14 +465,80 @@ func (r *RabbitMQ) Consume(queueName string) (<-chan amqp.Delivery, error) {
 		nil,       // Arguments
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to consume from RabbitMQ queue: %v", err)
+		ch.Close()
+		return nil, nil, fmt.Errorf("failed to consume from RabbitMQ queue: %v", err)
 	}
-	return msgs, nil
+
+	r.consumerLock.Lock()
+	r.consumerChannels[ch] = struct{}{}
+	r.consumerLock.Unlock()
+
+	return ch, msgs, nil
+}
+
+// forward copies deliveries to the consumer and subscribes again when the subscription ends
+func (r *RabbitMQ) forward(queueName string, prefetch int, ch *amqp.Channel, msgs <-chan amqp.Delivery, deliveries chan<- broker.Delivery) {
+	defer close(deliveries)
+
+	for {
+		for delivery := range msgs {
+			deliveries <- broker.NewDelivery(delivery.Body, delivery.Headers, amqpAcknowledger{delivery})
+		}
+
+		// The subscription ended, release its channel
+		r.consumerLock.Lock()
+		delete(r.consumerChannels, ch)
+		r.consumerLock.Unlock()
+		ch.Close()
+
+		if r.isClosed() {
+			return
+		}
+		log.Printf("Consumer on %s stopped, subscribing again", queueName)
+
+		// Deliveries that were not acknowledged are redelivered by the broker
+		delay := minReconnectDelay
+		for {
+			var err error
+			ch, msgs, err = r.subscribe(queueName, prefetch)
+			if err == nil {
+				break
+			}
+			if r.isClosed() {
+				return
+			}
+
+			log.Printf("Failed to subscribe to %s: %v, retrying in %s", queueName, err, delay)
+			select {
+			case <-r.done:
+				return
+			case <-time.After(delay):
+			}
+
+			delay = delay * 2
+			if delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+		}
+	}
+}
+
+// amqpAcknowledger settles a single RabbitMQ delivery on the channel it arrived on
+type amqpAcknowledger struct {
+	delivery amqp.Delivery
+}
+
+func (a amqpAcknowledger) Ack() error {
+	return a.delivery.Ack(false)
+}
+
+func (a amqpAcknowledger) Nack(requeue bool) error {
+	return a.delivery.Nack(false, requeue)
 }
 
 // Ack acknowledges a message to RabbitMQ
 func (r *RabbitMQ) Ack(deliveryTag uint64) error {
-	err := r.channel.Ack(deliveryTag, false)
+	err := r.getChannel().Ack(deliveryTag, false)
 	if err != nil {
 		return fmt.Errorf("failed to acknowledge message: %v", err)
 	}
@@ -177,15 +547,28 @@ func (r *RabbitMQ) Ack(deliveryTag uint64) error {
 
 // Nack sends a negative acknowledgment to RabbitMQ, rejecting the message(s)
 func (r *RabbitMQ) Nack(deliveryTag uint64, multiple bool, requeue bool) error {
-	err := r.channel.Nack(deliveryTag, multiple, requeue)
+	err := r.getChannel().Nack(deliveryTag, multiple, requeue)
 	if err != nil {
 		return fmt.Errorf("failed to send negative acknowledgment: %v", err)
 	}
 	return nil
 }
 
-// Close closes the RabbitMQ connection and channel
+// Close closes the RabbitMQ connection and channels and stops reconnecting
 func (r *RabbitMQ) Close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+
+	r.consumerLock.Lock()
+	for ch := range r.consumerChannels {
+		ch.Close()
+	}
+	r.consumerLock.Unlock()
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
 	if r.channel != nil {
 		r.channel.Close()
 	}
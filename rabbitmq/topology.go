@@ -0,0 +1,72 @@
+package rabbitmq
+
+import (
+	"csv-handler/broker"
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// DeclareTopology declares the work queue together with its retry and dead-letter queues.
+//
+// Messages rejected from the work queue are dead-lettered to <queue>.dead. Every retry
+// queue <queue>.retry.N holds messages for its delay and then dead-letters them back to
+// the work queue, so messages published there are retried after that delay.
+func (r *RabbitMQ) DeclareTopology(queueName string) error {
+	return r.addDeclaration(func() error {
+		return r.declareTopology(queueName)
+	})
+}
+
+// declareTopology declares the queues of DeclareTopology on the current channel
+func (r *RabbitMQ) declareTopology(queueName string) error {
+	deadLetterQueue := broker.DeadLetterQueueName(queueName)
+	err := r.declareQueue(deadLetterQueue, nil)
+	if err != nil {
+		return err
+	}
+
+	err = r.declareQueue(queueName, amqp.Table{
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": deadLetterQueue,
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, delay := range broker.RetryDelays() {
+		err = r.declareQueue(broker.RetryQueueName(queueName, i+1), amqp.Table{
+			"x-message-ttl":             int64(delay / time.Millisecond),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queueName,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// declareQueue declares a durable queue with the given arguments. A work queue declared
+// by an earlier version without the dead-letter arguments is replaced when it is empty.
+func (r *RabbitMQ) declareQueue(queueName string, args amqp.Table) error {
+	err := r.replaceIncompatibleQueue(queueName, args)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.getChannel().QueueDeclare(
+		queueName, // Name of the queue
+		true,      // Durable (queue survives server restart)
+		false,     // Delete when unused
+		false,     // Exclusive (for this connection only)
+		false,     // No-wait
+		args,      // Arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare RabbitMQ queue %s: %v", queueName, err)
+	}
+	return nil
+}
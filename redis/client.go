@@ -3,6 +3,7 @@ package redisclient
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -12,6 +13,9 @@ import (
 
 var ctx = context.Background()
 
+// ErrCacheMiss is returned by Get when the key does not exist
+var ErrCacheMiss = errors.New("key not found in Redis")
+
 // Client is a Redis client
 type Client struct {
 	rdb *redis.Client
@@ -54,12 +58,24 @@ func (c *Client) Set(key string, value string, expiration time.Duration) error {
 // Example function: Get a value from Redis by key
 func (c *Client) Get(key string) (string, error) {
 	value, err := c.rdb.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", ErrCacheMiss
+	}
 	if err != nil {
 		return "", fmt.Errorf("failed to get value from Redis: %w", err)
 	}
 	return value, nil
 }
 
+// Del removes keys from Redis
+func (c *Client) Del(keys ...string) error {
+	err := c.rdb.Del(ctx, keys...).Err()
+	if err != nil {
+		return fmt.Errorf("failed to delete keys from Redis: %w", err)
+	}
+	return nil
+}
+
 // ZAdd adds a member with a score to a sorted set in Redis
 func (c *Client) ZAdd(key string, score float64, member interface{}) error {
 	// Marshal the member into a JSON string
@@ -7,11 +7,34 @@ import (
 )
 
 // SetupRoutes sets up the API routes with a global prefix
-func SetupRoutes(router *mux.Router, prefix string) {
+func SetupRoutes(router *mux.Router, prefix string, handler *api.Handler) {
 	apiRouter := router.PathPrefix(prefix).Subrouter()
 
 	// Register the API routes
-	apiRouter.HandleFunc("/data", api.HandleGetData).Methods("GET")
-	apiRouter.HandleFunc("/upload", api.HandleFileUpload).Methods("POST")
+	apiRouter.HandleFunc("/datasets", handler.HandleListDatasets).Methods("GET")
+	apiRouter.HandleFunc("/datasets/{name}/records", handler.HandleGetData).Methods("GET")
+	apiRouter.HandleFunc("/datasets/{name}/records/{id}", handler.HandleGetRecord).Methods("GET")
+	apiRouter.HandleFunc("/datasets/{name}/records/{id}", handler.HandlePatchRecord).Methods("PATCH")
+	apiRouter.HandleFunc("/datasets/{name}/records/{id}", handler.HandleDeleteRecord).Methods("DELETE")
+
+	// The /data routes serve the default dataset
+	apiRouter.HandleFunc("/data", handler.HandleGetData).Methods("GET")
+	apiRouter.HandleFunc("/data/{id}", handler.HandleGetRecord).Methods("GET")
+	apiRouter.HandleFunc("/data/{id}", handler.HandlePatchRecord).Methods("PATCH")
+	apiRouter.HandleFunc("/data/{id}", handler.HandleDeleteRecord).Methods("DELETE")
+
+	apiRouter.HandleFunc("/upload", handler.HandleFileUpload).Methods("POST")
+	apiRouter.HandleFunc("/upload/validate", handler.HandleValidateUpload).Methods("POST")
+	apiRouter.HandleFunc("/imports/{id}", handler.HandleGetImport).Methods("GET")
+	apiRouter.HandleFunc("/imports/{id}/rejects", handler.HandleGetImportRejects).Methods("GET")
+	apiRouter.HandleFunc("/batches/{id}", handler.HandleGetImportBatch).Methods("GET")
+
+	// Resumable uploads follow the tus protocol, finalize imports the complete file
+	apiRouter.HandleFunc("/uploads", handler.HandleCreateUpload).Methods("POST")
+	apiRouter.HandleFunc("/uploads", handler.HandleUploadOptions).Methods("OPTIONS")
+	apiRouter.HandleFunc("/uploads/{id}", handler.HandleGetUpload).Methods("GET", "HEAD")
+	apiRouter.HandleFunc("/uploads/{id}", handler.HandlePatchUpload).Methods("PATCH")
+	apiRouter.HandleFunc("/uploads/{id}", handler.HandleDeleteUpload).Methods("DELETE")
+	apiRouter.HandleFunc("/uploads/{id}/finalize", handler.HandleFinalizeUpload).Methods("POST")
 
 }
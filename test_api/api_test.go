@@ -2,6 +2,8 @@ package test_api
 
 import (
 	"csv-handler/api"
+	"csv-handler/dataset"
+	"csv-handler/postgres"
 	"log"
 	"net/http"
 	"net/http/httptest"
@@ -17,6 +19,15 @@ func TestHandleGetData(t *testing.T) {
 	if err := viper.ReadInConfig(); err != nil {
 		log.Fatalf("Failed to read configuration file: %v", err)
 	}
+	datasets, err := dataset.Load()
+	assert.NoError(t, err)
+
+	pgClient, err := postgres.NewClient()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pgClient.Close()
+
 	// Create a new request with query parameters
 	req, err := http.NewRequest("GET", "/data?limit=1&offset=5", nil)
 	assert.NoError(t, err)
@@ -25,7 +36,7 @@ func TestHandleGetData(t *testing.T) {
 	res := httptest.NewRecorder()
 
 	// Call the handler function
-	api.HandleGetData(res, req)
+	api.NewHandler(nil, pgClient, nil, datasets, nil).HandleGetData(res, req)
 
 	// Check the response status code
 	assert.Equal(t, http.StatusOK, res.Code)
@@ -0,0 +1,52 @@
+package test_api
+
+import (
+	"csv-handler/api"
+	"csv-handler/dataset"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPatchRecordValidation checks that invalid PATCH bodies are rejected before PostgreSQL is queried
+func TestPatchRecordValidation(t *testing.T) {
+	// Load the configuration file
+	viper.SetConfigFile("./../config.yaml")
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatalf("Failed to read configuration file: %v", err)
+	}
+
+	datasets, err := dataset.Load()
+	assert.NoError(t, err)
+
+	handler := api.NewHandler(nil, nil, nil, datasets, nil)
+	router := mux.NewRouter()
+	router.HandleFunc("/data/{id}", handler.HandlePatchRecord).Methods("PATCH")
+
+	tests := map[string]string{
+		`{}`:                          "no columns to update",
+		`{"id": 2}`:                   `column "id" can't be updated`,
+		`{"nickname": "Jo"}`:          `column "nickname" can't be updated`,
+		`{"created_at": null}`:        `column "created_at" can't be null`,
+		`{"created_at": "-1"}`:        `column "created_at" can't be null`,
+		`{"created_at": "yesterday"}`: `invalid created_at: "yesterday" is not a timestamp in any of the formats epoch_ms`,
+		`{"first_name": "` + strings.Repeat("a", 101) + `"}`: "invalid first_name: value is longer than 100 characters",
+		`{"email_address": "not-an-email"}`:                  `invalid email_address: "not-an-email" is not a valid email address`,
+		`{"parent_user_id": true}`:                           `column "parent_user_id" must be a string, number or null`,
+	}
+	for body, expected := range tests {
+		req, err := http.NewRequest("PATCH", "/data/1", strings.NewReader(body))
+		assert.NoError(t, err)
+
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusBadRequest, res.Code, body)
+		assert.Equal(t, expected, strings.TrimSpace(res.Body.String()), body)
+	}
+}
@@ -0,0 +1,114 @@
+package test_api
+
+import (
+	"csv-handler/api"
+	"csv-handler/dataset"
+	"csv-handler/routes"
+	"csv-handler/uploads"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestResumableUpload sends a file in two chunks, resuming from the offset HEAD reports,
+// and validates it with a dry run finalize so no PostgreSQL or broker is needed
+func TestResumableUpload(t *testing.T) {
+	// Load the configuration file
+	viper.SetConfigFile("./../config.yaml")
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatalf("Failed to read configuration file: %v", err)
+	}
+
+	datasets, err := dataset.Load()
+	assert.NoError(t, err)
+	store, err := uploads.NewDisk(t.TempDir(), time.Hour)
+	assert.NoError(t, err)
+
+	router := mux.NewRouter()
+	routes.SetupRoutes(router, "/api/v1", api.NewHandler(nil, nil, nil, datasets, store))
+
+	send := func(method, url string, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res
+	}
+
+	csvData := "id,first_name,created_at\n1,John,1672531200000\n2,Jane,1672531200000\n"
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("users.csv")) + ",mode " + base64.StdEncoding.EncodeToString([]byte("upsert"))
+
+	res := send("POST", "/api/v1/uploads", "", map[string]string{
+		"Upload-Length":   strconv.Itoa(len(csvData)),
+		"Upload-Metadata": metadata,
+	})
+	if !assert.Equal(t, http.StatusCreated, res.Code, res.Body.String()) {
+		return
+	}
+	location := res.Header().Get("Location")
+	assert.True(t, strings.HasPrefix(location, "/api/v1/uploads/"))
+
+	// The first chunk, then a retry of it that is rejected
+	chunk := map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": "0"}
+	res = send("PATCH", location, csvData[:20], chunk)
+	assert.Equal(t, http.StatusNoContent, res.Code, res.Body.String())
+	assert.Equal(t, "20", res.Header().Get("Upload-Offset"))
+	res = send("PATCH", location, csvData[:20], chunk)
+	assert.Equal(t, http.StatusConflict, res.Code)
+
+	// Finalizing an incomplete upload fails
+	res = send("POST", location+"/finalize?dry_run=true", "", nil)
+	assert.Equal(t, http.StatusConflict, res.Code)
+
+	// Resume from the offset the server has
+	res = send("HEAD", location, "", nil)
+	assert.Equal(t, http.StatusOK, res.Code)
+	offset := res.Header().Get("Upload-Offset")
+	assert.Equal(t, "20", offset)
+	start, _ := strconv.Atoi(offset)
+	res = send("PATCH", location, csvData[start:], map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": offset})
+	assert.Equal(t, http.StatusNoContent, res.Code, res.Body.String())
+	assert.Equal(t, strconv.Itoa(len(csvData)), res.Header().Get("Upload-Offset"))
+
+	// Another request is finalizing the upload
+	claim, err := store.Claim(strings.TrimPrefix(location, "/api/v1/uploads/"))
+	assert.NoError(t, err)
+	res = send("POST", location+"/finalize?dry_run=true", "", nil)
+	assert.Equal(t, http.StatusLocked, res.Code)
+	res = send("DELETE", location, "", nil)
+	assert.Equal(t, http.StatusLocked, res.Code)
+	claim.Release()
+
+	res = send("POST", location+"/finalize?dry_run=true", "", nil)
+	if !assert.Equal(t, http.StatusOK, res.Code, res.Body.String()) {
+		return
+	}
+	var report struct {
+		FileName  string `json:"file_name"`
+		Mode      string `json:"mode"`
+		ValidRows int64  `json:"valid_rows"`
+	}
+	assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &report))
+	assert.Equal(t, "users.csv", report.FileName)
+	assert.Equal(t, "upsert", report.Mode)
+	assert.Equal(t, int64(2), report.ValidRows)
+
+	res = send("DELETE", location, "", nil)
+	assert.Equal(t, http.StatusNoContent, res.Code)
+	res = send("HEAD", location, "", nil)
+	assert.Equal(t, http.StatusNotFound, res.Code)
+}
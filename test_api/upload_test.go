@@ -0,0 +1,94 @@
+package test_api
+
+import (
+	"bytes"
+	"csv-handler/api"
+	"csv-handler/broker"
+	"csv-handler/consumer"
+	"csv-handler/dataset"
+	"csv-handler/postgres"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestUploadEndToEnd uploads a file through the in-memory broker and waits
+// for the consumer to insert every row. It needs the configured PostgreSQL.
+func TestUploadEndToEnd(t *testing.T) {
+	// Load the configuration file
+	viper.SetConfigFile("./../config.yaml")
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatalf("Failed to read configuration file: %v", err)
+	}
+
+	datasets, err := dataset.Load()
+	assert.NoError(t, err)
+
+	pgClient, err := postgres.NewClient()
+	if err != nil {
+		t.Skipf("PostgreSQL is not available: %v", err)
+	}
+	defer pgClient.Close()
+
+	// Start a worker on the in-memory broker
+	memory := broker.NewMemory(0)
+	defer memory.Close()
+	assert.NoError(t, memory.DeclareTopology(viper.GetString("rabbitmq.csv_rabbitmq")))
+	go consumer.StartWorker(1, memory, pgClient, nil, datasets)
+
+	handler := api.NewHandler(memory, pgClient, nil, datasets, nil)
+	router := mux.NewRouter()
+	router.HandleFunc("/upload", handler.HandleFileUpload).Methods("POST")
+	router.HandleFunc("/imports/{id}", handler.HandleGetImport).Methods("GET")
+
+	// Build a multipart request with two rows and a malformed one, which is rejected
+	id := time.Now().UnixNano()
+	csvData := "id,first_name,last_name,email_address,created_at,deleted_at,merged_at,parent_user_id\n" +
+		fmt.Sprintf("%d,\"Doe, John\",Doe,john@example.com,1672531200000,-1,-1,-1\n", id) +
+		"malformed,row\n" +
+		fmt.Sprintf("%d,Jane,Doe,jane@example.com,1672531200000,-1,-1,%d\n", id+1, id)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "users.csv")
+	assert.NoError(t, err)
+	part.Write([]byte(csvData))
+	writer.Close()
+
+	req, err := http.NewRequest("POST", "/upload", body)
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusAccepted, res.Code)
+
+	var job postgres.ImportJob
+	assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &job))
+
+	// Wait for the consumer to finish the import job
+	deadline := time.Now().Add(10 * time.Second)
+	for job.State != postgres.ImportStateCompleted && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+
+		req, err := http.NewRequest("GET", fmt.Sprintf("/imports/%d", job.ID), nil)
+		assert.NoError(t, err)
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &job))
+	}
+
+	assert.Equal(t, postgres.ImportStateCompleted, job.State)
+	assert.Equal(t, int64(2), job.InsertedRows)
+	assert.Equal(t, int64(1), job.FailedRows)
+}
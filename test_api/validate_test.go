@@ -0,0 +1,91 @@
+package test_api
+
+import (
+	"bytes"
+	"csv-handler/api"
+	"csv-handler/dataset"
+	"encoding/json"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestValidateUpload checks that a dry run reports the row errors without needing PostgreSQL or a broker
+func TestValidateUpload(t *testing.T) {
+	// Load the configuration file
+	viper.SetConfigFile("./../config.yaml")
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatalf("Failed to read configuration file: %v", err)
+	}
+
+	datasets, err := dataset.Load()
+	assert.NoError(t, err)
+
+	handler := api.NewHandler(nil, nil, nil, datasets, nil)
+	router := mux.NewRouter()
+	router.HandleFunc("/upload", handler.HandleFileUpload).Methods("POST")
+
+	// One valid row, one with an invalid id, one with a missing field and one with an invalid email
+	csvData := "ID,First Name,surname,email,created_at,notes\n" +
+		"1,John,Doe,john@example.com,1672531200000,hello\n" +
+		"x,Jane,Doe,jane@example.com,1672531200000,\n" +
+		"3,Jim,Doe,jim@example.com,1672531200000\n" +
+		"4,Joe,Doe,not-an-email,1672531200000,\n"
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "users.csv")
+	assert.NoError(t, err)
+	part.Write([]byte(csvData))
+	writer.Close()
+
+	req, err := http.NewRequest("POST", "/upload?dry_run=true&sample_size=5", body)
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	if !assert.Equal(t, http.StatusOK, res.Code, res.Body.String()) {
+		return
+	}
+
+	var report struct {
+		Columns        []string         `json:"columns"`
+		IgnoredHeaders []string         `json:"ignored_headers"`
+		TotalRows      int64            `json:"total_rows"`
+		ValidRows      int64            `json:"valid_rows"`
+		InvalidRows    int64            `json:"invalid_rows"`
+		MalformedRows  int64            `json:"malformed_rows"`
+		ColumnErrors   map[string]int64 `json:"column_errors"`
+		Errors         []struct {
+			Line   int    `json:"line"`
+			Column string `json:"column"`
+		} `json:"errors"`
+		Sample []map[string]interface{} `json:"sample"`
+	}
+	assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &report))
+
+	assert.Equal(t, []string{"id", "first_name", "last_name", "email_address", "created_at", ""}, report.Columns)
+	assert.Equal(t, []string{"notes"}, report.IgnoredHeaders)
+	assert.Equal(t, int64(4), report.TotalRows)
+	assert.Equal(t, int64(1), report.ValidRows)
+	assert.Equal(t, int64(2), report.InvalidRows)
+	assert.Equal(t, int64(1), report.MalformedRows)
+	assert.Equal(t, map[string]int64{"id": 1, "email_address": 1}, report.ColumnErrors)
+	if assert.Len(t, report.Errors, 3) {
+		assert.Equal(t, 3, report.Errors[0].Line)
+		assert.Equal(t, "id", report.Errors[0].Column)
+		assert.Equal(t, 4, report.Errors[1].Line)
+		assert.Equal(t, "", report.Errors[1].Column)
+		assert.Equal(t, 5, report.Errors[2].Line)
+	}
+	if assert.Len(t, report.Sample, 1) {
+		assert.Equal(t, "John", report.Sample[0]["first_name"])
+	}
+}
@@ -0,0 +1,104 @@
+package test_broker
+
+import (
+	"csv-handler/broker"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// receive waits for the next delivery or fails the test
+func receive(t *testing.T, deliveries <-chan broker.Delivery) broker.Delivery {
+	select {
+	case delivery := <-deliveries:
+		return delivery
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a delivery")
+		return broker.Delivery{}
+	}
+}
+
+func TestMemoryPublishConsume(t *testing.T) {
+	memory := broker.NewMemory(10)
+	defer memory.Close()
+	assert.NoError(t, memory.DeclareTopology("rows"))
+
+	publisher, err := memory.NewPublisher()
+	assert.NoError(t, err)
+	assert.NoError(t, publisher.Publish("rows", map[string]string{"id": "1"}))
+	assert.NoError(t, publisher.Wait())
+
+	deliveries, err := memory.Consume("rows", 1)
+	assert.NoError(t, err)
+
+	delivery := receive(t, deliveries)
+	assert.JSONEq(t, `{"id":"1"}`, string(delivery.Body))
+	assert.NoError(t, delivery.Ack())
+	assert.Error(t, delivery.Ack())
+}
+
+func TestMemoryRetryAndDeadLetter(t *testing.T) {
+	viper.Set("broker.retry_delays_ms", []int{10})
+	defer viper.Set("broker.retry_delays_ms", nil)
+
+	memory := broker.NewMemory(10)
+	defer memory.Close()
+	assert.NoError(t, memory.DeclareTopology("rows"))
+
+	publisher, err := memory.NewPublisher()
+	assert.NoError(t, err)
+	assert.NoError(t, publisher.PublishRaw("rows", []byte("row"), nil))
+
+	deliveries, err := memory.Consume("rows", 1)
+	assert.NoError(t, err)
+	dead, err := memory.Consume(broker.DeadLetterQueueName("rows"), 1)
+	assert.NoError(t, err)
+
+	retrier, err := broker.NewRetrier(memory, "rows")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, retrier.MaxAttempts())
+
+	// The first failure is retried after the delay
+	retried, err := retrier.Retry(receive(t, deliveries))
+	assert.NoError(t, err)
+	assert.True(t, retried)
+
+	delivery := receive(t, deliveries)
+	assert.Equal(t, 1, delivery.RetryCount())
+
+	// The retries are used up, so the rejected delivery is dead-lettered
+	retried, err = retrier.Retry(delivery)
+	assert.NoError(t, err)
+	assert.False(t, retried)
+	assert.NoError(t, delivery.Nack(false))
+
+	assert.Equal(t, "row", string(receive(t, dead).Body))
+}
+
+func TestMemoryDeadLetterFull(t *testing.T) {
+	memory := broker.NewMemory(1)
+	defer memory.Close()
+	assert.NoError(t, memory.DeclareTopology("rows"))
+
+	publisher, err := memory.NewPublisher()
+	assert.NoError(t, err)
+	deliveries, err := memory.Consume("rows", 1)
+	assert.NoError(t, err)
+
+	// Nothing consumes the dead-letter queue, once it is full rejected messages are dropped
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, publisher.PublishRaw("rows", []byte("row"), nil))
+		assert.NoError(t, receive(t, deliveries).Nack(false))
+	}
+
+	dead, err := memory.Consume(broker.DeadLetterQueueName("rows"), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "row", string(receive(t, dead).Body))
+	select {
+	case <-dead:
+		t.Fatal("expected the other dead-lettered messages to be dropped")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,96 @@
+package test_consumer
+
+import (
+	"context"
+	"csv-handler/broker"
+	"csv-handler/consumer"
+	"csv-handler/dataset"
+	"csv-handler/ingest"
+	"csv-handler/postgres"
+	"log"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestFailOnConflict checks that the rows of a fail_on_conflict job that come after an
+// existing key are not written. It needs the configured PostgreSQL.
+func TestFailOnConflict(t *testing.T) {
+	// Load the configuration file
+	viper.SetConfigFile("./../config.yaml")
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatalf("Failed to read configuration file: %v", err)
+	}
+
+	datasets, err := dataset.Load()
+	assert.NoError(t, err)
+	users, err := datasets.Get("")
+	assert.NoError(t, err)
+
+	pgClient, err := postgres.NewClient()
+	if err != nil {
+		t.Skipf("PostgreSQL is not available: %v", err)
+	}
+	defer pgClient.Close()
+	ctx := context.Background()
+
+	row := func(id int64) map[string]string {
+		return map[string]string{"id": strconv.FormatInt(id, 10), "first_name": "Jane", "created_at": "1672531200000"}
+	}
+
+	// The row that the job conflicts with
+	id := time.Now().UnixNano()
+	values, err := users.Values(row(id))
+	assert.NoError(t, err)
+	_, err = pgClient.WriteRecord(ctx, users, postgres.ImportModeInsert, values)
+	assert.NoError(t, err)
+
+	job, err := pgClient.CreateImportJob(ctx, postgres.ImportJob{
+		Dataset:  users.Name,
+		FileName: "users.csv",
+		Mode:     postgres.ImportModeFailOnConflict,
+		Format:   ingest.FormatCSV,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	memory := broker.NewMemory(0)
+	defer memory.Close()
+	queueName := viper.GetString("rabbitmq.csv_rabbitmq")
+	assert.NoError(t, memory.DeclareTopology(queueName))
+	go consumer.StartWorker(1, memory, pgClient, nil, datasets)
+
+	publisher, err := memory.NewPublisher()
+	assert.NoError(t, err)
+	for line, rowID := range []int64{id + 1, id, id + 2} {
+		assert.NoError(t, publisher.Publish(queueName, ingest.Message{
+			JobID:   job.ID,
+			Dataset: users.Name,
+			Mode:    postgres.ImportModeFailOnConflict,
+			Line:    line + 2,
+			Data:    row(rowID),
+		}))
+	}
+	assert.NoError(t, pgClient.FinishPublishing(ctx, job.ID, 3))
+
+	// Wait for the worker to handle the three rows
+	deadline := time.Now().Add(10 * time.Second)
+	for job.InsertedRows+job.FailedRows < 3 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		job, err = pgClient.GetImportJob(ctx, job.ID)
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, postgres.ImportStateFailed, job.State)
+	assert.Equal(t, int64(1), job.InsertedRows)
+	assert.Equal(t, int64(2), job.FailedRows)
+
+	_, err = pgClient.GetRecord(ctx, users, id+1)
+	assert.NoError(t, err)
+	_, err = pgClient.GetRecord(ctx, users, id+2)
+	assert.ErrorIs(t, err, postgres.ErrNotFound)
+}
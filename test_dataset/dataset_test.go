@@ -0,0 +1,187 @@
+package test_dataset
+
+import (
+	"csv-handler/dataset"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// loadUsers loads the users dataset from the configuration file
+func loadUsers(t *testing.T) *dataset.Dataset {
+	viper.SetConfigFile("./../config.yaml")
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatalf("Failed to read configuration file: %v", err)
+	}
+
+	datasets, err := dataset.Load()
+	assert.NoError(t, err)
+
+	users, err := datasets.Get("")
+	assert.NoError(t, err)
+	assert.Equal(t, "users", users.Name)
+	return users
+}
+
+func TestValues(t *testing.T) {
+	users := loadUsers(t)
+
+	values, err := users.Values(map[string]string{
+		"id":             "7",
+		"first_name":     "Jane",
+		"email_address":  "jane@example.com",
+		"created_at":     "1672531200000",
+		"merged_at":      "-1",
+		"parent_user_id": "-1",
+	})
+	assert.NoError(t, err)
+
+	record := users.Record(values)
+	assert.Equal(t, int64(7), record["id"])
+	assert.Equal(t, "Jane", record["first_name"])
+	assert.Equal(t, time.Unix(1672531200, 0).UTC(), record["created_at"])
+	assert.Nil(t, record["merged_at"])
+	assert.Nil(t, record["parent_user_id"])
+	assert.Equal(t, "users:7", users.CacheKey(7))
+}
+
+func TestValuesErrors(t *testing.T) {
+	users := loadUsers(t)
+
+	_, err := users.Values(map[string]string{"created_at": "1672531200000"})
+	assert.EqualError(t, err, "missing required column id")
+
+	_, err = users.Values(map[string]string{"id": "x", "created_at": "1672531200000"})
+	assert.EqualError(t, err, `invalid id: "x" is not an integer`)
+
+	_, err = users.Values(map[string]string{"id": "1", "created_at": "-1"})
+	assert.EqualError(t, err, "column created_at can't be empty")
+
+	_, err = users.Values(map[string]string{"id": "1", "created_at": "soon"})
+	assert.EqualError(t, err, `invalid created_at: "soon" is not a timestamp in any of the formats epoch_ms`)
+
+	_, err = users.Values(map[string]string{"id": "1", "created_at": "1", "email_address": "nope"})
+	assert.EqualError(t, err, `invalid email_address: "nope" is not a valid email address`)
+}
+
+func TestTimestampFormats(t *testing.T) {
+	events, err := dataset.NewRegistry("events", &dataset.Dataset{
+		Name:  "events",
+		Table: "events",
+		Key:   "id",
+		Columns: []dataset.Column{
+			{Name: "id", Type: dataset.TypeInt, Required: true},
+			{Name: "at", Type: dataset.TypeTimestamp, Timezone: "America/New_York",
+				Formats: []string{dataset.FormatEpochSeconds, dataset.FormatRFC3339, "2006-01-02 15:04:05"}},
+			{Name: "at_us", Type: dataset.TypeTimestamp, Formats: []string{dataset.FormatEpochMicros}},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ds, _ := events.Get("")
+
+	tests := map[string]time.Time{
+		"1672531200.25":               time.Date(2023, 1, 1, 0, 0, 0, 250000000, time.UTC),
+		"-1":                          time.Date(1969, 12, 31, 23, 59, 59, 0, time.UTC),
+		"2023-01-01T12:00:00.5+02:00": time.Date(2023, 1, 1, 10, 0, 0, 500000000, time.UTC),
+		"2023-07-01 08:00:00":         time.Date(2023, 7, 1, 12, 0, 0, 0, time.UTC),
+		"2023-01-01 08:00:00":         time.Date(2023, 1, 1, 13, 0, 0, 0, time.UTC),
+	}
+	for raw, expected := range tests {
+		values, err := ds.Values(map[string]string{"id": "1", "at": raw})
+		if assert.NoError(t, err, raw) {
+			assert.Equal(t, expected, values[1], raw)
+		}
+	}
+
+	values, err := ds.Values(map[string]string{"id": "1", "at_us": "1672531200123456"})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2023, 1, 1, 0, 0, 0, 123456000, time.UTC), values[2])
+
+	// Spreadsheet dates are wall times in the column timezone
+	headerMap, err := ds.MapHeaders([]string{"id", "at"}, nil)
+	assert.NoError(t, err)
+	row := headerMap.Apply(map[string]string{"id": "1", "at": "2023-07-01 08:00:00"})
+	headerMap.ApplyDates(row, map[string]time.Time{"at": time.Date(2023, 7, 1, 8, 0, 0, 0, time.UTC)})
+	assert.Equal(t, "1688212800", row["at"])
+
+	_, err = ds.Values(map[string]string{"id": "1", "at": "yesterday"})
+	assert.EqualError(t, err, `invalid at: "yesterday" is not a timestamp in any of the formats epoch_s, rfc3339, 2006-01-02 15:04:05`)
+
+	_, err = dataset.NewRegistry("", &dataset.Dataset{
+		Name:  "bad",
+		Table: "bad",
+		Key:   "id",
+		Columns: []dataset.Column{
+			{Name: "id", Type: dataset.TypeInt, Required: true},
+			{Name: "at", Type: dataset.TypeTimestamp, Timezone: "Mars/Olympus"},
+		},
+	})
+	assert.Error(t, err)
+}
+
+func TestInvalidDefinitions(t *testing.T) {
+	_, err := dataset.NewRegistry("", &dataset.Dataset{
+		Name:    "bad",
+		Table:   "bad; DROP TABLE csv_data",
+		Key:     "id",
+		Columns: []dataset.Column{{Name: "id", Type: dataset.TypeInt, Required: true}},
+	})
+	assert.Error(t, err)
+
+	_, err = dataset.NewRegistry("", &dataset.Dataset{
+		Name:    "keyless",
+		Table:   "keyless",
+		Key:     "name",
+		Columns: []dataset.Column{{Name: "name", Type: dataset.TypeText, Required: true}},
+	})
+	assert.EqualError(t, err, `dataset keyless: key "name" must be a required int column`)
+
+	_, err = dataset.NewRegistry("missing")
+	assert.EqualError(t, err, "default dataset missing is not defined")
+}
+
+func TestMapHeaders(t *testing.T) {
+	users := loadUsers(t)
+
+	headers := []string{"ID", "fname", "E-mail Address", "Created At", "Notes"}
+	headerMap, err := users.MapHeaders(headers, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"id", "first_name", "email_address", "created_at", ""}, headerMap.Columns)
+
+	row := headerMap.Apply(map[string]string{"ID": "1", "fname": "Jane", "E-mail Address": "jane@example.com",
+		"Created At": "1672531200000", "Notes": "ignored"})
+	assert.Equal(t, map[string]string{"id": "1", "first_name": "Jane", "email_address": "jane@example.com",
+		"created_at": "1672531200000"}, row)
+
+	// Fields that aren't headers, as later objects of a JSON file have, are matched by name
+	// unless a header already maps to their column
+	row = headerMap.Apply(map[string]string{"ID": "2", "created_at": "1672531200000", "last_name": "Doe",
+		"email": "other@example.com", "Unknown": "ignored"})
+	assert.Equal(t, map[string]string{"id": "2", "last_name": "Doe"}, row)
+
+	// The mapping overrides the match and can ignore a header
+	headerMap, err = users.MapHeaders(headers, map[string]string{"notes": "last_name", "fname": ""})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"id", "", "email_address", "created_at", "last_name"}, headerMap.Columns)
+}
+
+func TestMapHeadersErrors(t *testing.T) {
+	users := loadUsers(t)
+
+	_, err := users.MapHeaders([]string{"first_name", "email"}, nil)
+	assert.EqualError(t, err, "missing required columns: created_at, id")
+
+	_, err = users.MapHeaders([]string{"id", "created_at", "email", "E-mail Address"}, nil)
+	assert.EqualError(t, err, `headers "email" and "E-mail Address" both map to column email_address`)
+
+	_, err = users.MapHeaders([]string{"id", "created_at"}, map[string]string{"id": "user_id"})
+	assert.EqualError(t, err, `mapping of "id": unknown column "user_id"`)
+
+	_, err = users.MapHeaders([]string{"id", "created_at"}, map[string]string{"surname": "last_name"})
+	assert.EqualError(t, err, `mapping of "surname": the file has no such header`)
+}
@@ -0,0 +1,85 @@
+package test_ingest
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"csv-handler/ingest"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+const compressCSV = "id,first_name\n1,Jane\n"
+
+// readFiles reads the content of every file of an upload
+func readFiles(t *testing.T, data []byte) (map[string]string, string) {
+	files, compression, err := ingest.UploadFiles(bytes.NewReader(data), int64(len(data)), "upload")
+	if !assert.NoError(t, err) {
+		return nil, compression
+	}
+
+	contents := make(map[string]string)
+	for _, file := range files {
+		content, err := file.Open()
+		if !assert.NoError(t, err) {
+			continue
+		}
+		body, err := io.ReadAll(content)
+		assert.NoError(t, err)
+		content.Close()
+		contents[file.Name] = string(body)
+	}
+	return contents, compression
+}
+
+func TestUploadFilesCompressed(t *testing.T) {
+	contents, compression := readFiles(t, []byte(compressCSV))
+	assert.Equal(t, ingest.CompressionNone, compression)
+	assert.Equal(t, map[string]string{"upload": compressCSV}, contents)
+
+	var gzipped bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipped)
+	gzipWriter.Write([]byte(compressCSV))
+	gzipWriter.Close()
+
+	contents, compression = readFiles(t, gzipped.Bytes())
+	assert.Equal(t, ingest.CompressionGzip, compression)
+	assert.Equal(t, map[string]string{"upload": compressCSV}, contents)
+
+	var zstded bytes.Buffer
+	zstdWriter, err := zstd.NewWriter(&zstded)
+	assert.NoError(t, err)
+	zstdWriter.Write([]byte(compressCSV))
+	zstdWriter.Close()
+
+	contents, compression = readFiles(t, zstded.Bytes())
+	assert.Equal(t, ingest.CompressionZstd, compression)
+	assert.Equal(t, map[string]string{"upload": compressCSV}, contents)
+}
+
+func TestUploadFilesZip(t *testing.T) {
+	var archive bytes.Buffer
+	zipWriter := zip.NewWriter(&archive)
+	for _, name := range []string{"exports/", "exports/users.csv", "__MACOSX/exports/._users.csv", "exports/.DS_Store"} {
+		entry, err := zipWriter.Create(name)
+		assert.NoError(t, err)
+		if name != "exports/" {
+			entry.Write([]byte(compressCSV))
+		}
+	}
+
+	// Entries can be compressed themselves
+	entry, err := zipWriter.Create("more.csv.gz")
+	assert.NoError(t, err)
+	gzipWriter := gzip.NewWriter(entry)
+	gzipWriter.Write([]byte(compressCSV))
+	gzipWriter.Close()
+	zipWriter.Close()
+
+	contents, compression := readFiles(t, archive.Bytes())
+	assert.Equal(t, ingest.CompressionZip, compression)
+	assert.Equal(t, map[string]string{"exports/users.csv": compressCSV, "more.csv.gz": compressCSV}, contents)
+}
@@ -0,0 +1,53 @@
+package test_ingest
+
+import (
+	"csv-handler/ingest"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSVReaderQuotedFields(t *testing.T) {
+	input := "\ufeffid,first_name,last_name\r\n" +
+		"1,\"Smith, Jr.\",\"O\"\"Brien\"\n" +
+		"2,\"multi\nline\",Doe\n"
+
+	reader, err := ingest.NewCSVReader(strings.NewReader(input))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"id", "first_name", "last_name"}, reader.Headers())
+
+	record, err := reader.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, record.Line)
+	assert.Equal(t, "Smith, Jr.", record.Values["first_name"])
+	assert.Equal(t, "O\"Brien", record.Values["last_name"])
+
+	record, err = reader.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, record.Line)
+	assert.Equal(t, "multi\nline", record.Values["first_name"])
+
+	_, err = reader.Read()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestCSVReaderFieldCountMismatch(t *testing.T) {
+	input := "id,first_name,last_name\n1,John,Doe\n2,\"Jane, Doe\"\n"
+
+	reader, err := ingest.NewCSVReader(strings.NewReader(input))
+	assert.NoError(t, err)
+
+	_, err = reader.Read()
+	assert.NoError(t, err)
+
+	_, err = reader.Read()
+	var rowErr *ingest.RowError
+	assert.True(t, errors.As(err, &rowErr))
+	assert.Equal(t, 3, rowErr.Line)
+	assert.Equal(t, "line 3: expected 3 fields, got 2", err.Error())
+	// The text of the row is kept for its reject
+	assert.Equal(t, `2,"Jane, Doe"`, rowErr.Raw)
+}
@@ -0,0 +1,111 @@
+package test_ingest
+
+import (
+	"csv-handler/ingest"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+)
+
+func TestCSVReaderDetectsDialect(t *testing.T) {
+	// Semicolons with a comma inside a value, in Windows-1252
+	windows1252, err := charmap.Windows1252.NewEncoder().String("id;name\r\n1;\"Müller, Jörg\"\r\n2;Café\r\n")
+	assert.NoError(t, err)
+
+	// Tabs in UTF-16 with a BOM, as Excel exports them
+	utf16, err := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder().String("id\tname\n1\tMüller\n")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		input    string
+		dialect  ingest.Dialect
+		expected []string
+	}{
+		{windows1252, ingest.Dialect{Delimiter: ";", Quote: `"`, LineTerminator: "\r\n", Charset: ingest.CharsetWindows1252}, []string{"Müller, Jörg", "Café"}},
+		{utf16, ingest.Dialect{Delimiter: "\t", Quote: `"`, LineTerminator: "\n", Charset: ingest.CharsetUTF16LE}, []string{"Müller"}},
+		{"id|name\r1|'O''Brien \"Jr\"'\r", ingest.Dialect{Delimiter: "|", Quote: "'", LineTerminator: "\r", Charset: ingest.CharsetUTF8}, []string{`O'Brien "Jr"`}},
+	}
+
+	for _, test := range tests {
+		reader, err := ingest.NewCSVReader(strings.NewReader(test.input))
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, test.dialect, reader.Dialect())
+		assert.Equal(t, []string{"id", "name"}, reader.Headers())
+
+		for i, name := range test.expected {
+			record, err := reader.Read()
+			if assert.NoError(t, err) {
+				assert.Equal(t, i+2, record.Line)
+				assert.Equal(t, name, record.Values["name"])
+			}
+		}
+	}
+}
+
+func TestCSVReaderDialectQuotedFields(t *testing.T) {
+	tests := []struct {
+		input    string
+		dialect  ingest.Dialect
+		expected []string
+		lines    []int
+	}{
+		// The other quote is a literal inside a quoted field
+		{"id,name\n1,'Say \"hi\"'\n2,Jane\n", ingest.Dialect{Delimiter: ",", Quote: "'", LineTerminator: "\n", Charset: ingest.CharsetUTF8}, []string{`Say "hi"`, "Jane"}, []int{2, 3}},
+		// A \r\n inside a quoted field doesn't end the record, encoding/csv reads it as \n as in any other file
+		{"id,name\r1,\"line one\r\nline two\"\r2,Jane\r", ingest.Dialect{Delimiter: ",", Quote: `"`, LineTerminator: "\r", Charset: ingest.CharsetUTF8}, []string{"line one\nline two", "Jane"}, []int{2, 4}},
+	}
+
+	for _, test := range tests {
+		reader, err := ingest.NewCSVReader(strings.NewReader(test.input))
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, test.dialect, reader.Dialect())
+		assert.Equal(t, []string{"id", "name"}, reader.Headers())
+
+		for i, name := range test.expected {
+			record, err := reader.Read()
+			if assert.NoError(t, err) {
+				assert.Equal(t, test.lines[i], record.Line)
+				assert.Equal(t, name, record.Values["name"])
+			}
+		}
+		_, err = reader.Read()
+		assert.Equal(t, io.EOF, err)
+	}
+}
+
+func TestCSVReaderDialectOverride(t *testing.T) {
+	dialect, err := ingest.ParseDialect("tab", "", "", ingest.CharsetISO88591)
+	assert.NoError(t, err)
+
+	// Semicolons and tabs are as consistent, so without the override the semicolon is detected
+	input := "id;code\tname\n1;2\tJane\n"
+	reader, err := ingest.NewCSVReader(strings.NewReader(input))
+	assert.NoError(t, err)
+	assert.Equal(t, ";", reader.Dialect().Delimiter)
+
+	reader, err = ingest.NewCSVReaderDialect(strings.NewReader(input), dialect)
+	assert.NoError(t, err)
+	assert.Equal(t, "\t", reader.Dialect().Delimiter)
+	assert.Equal(t, []string{"id;code", "name"}, reader.Headers())
+
+	record, err := reader.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, "Jane", record.Values["name"])
+
+	_, err = ingest.ParseDialect(";;", "", "", "")
+	assert.EqualError(t, err, `invalid delimiter ";;", expected a single character`)
+
+	_, err = ingest.ParseDialect("", "`", "", "")
+	assert.Error(t, err)
+
+	_, err = ingest.ParseDialect("", "", "", "ebcdic")
+	assert.Error(t, err)
+}
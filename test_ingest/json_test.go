@@ -0,0 +1,120 @@
+package test_ingest
+
+import (
+	"bytes"
+	"csv-handler/ingest"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readJSON detects the format of a file and reads every record and row error
+func readJSON(t *testing.T, content string) (string, []string, []*ingest.Record, []error) {
+	files, _, err := ingest.UploadFiles(strings.NewReader(content), int64(len(content)), "upload")
+	if !assert.NoError(t, err) {
+		return "", nil, nil, nil
+	}
+
+	reader, closer, err := files[0].Rows(ingest.ReadOptions{})
+	if !assert.NoError(t, err) {
+		return files[0].Format, nil, nil, nil
+	}
+	defer closer.Close()
+
+	var records []*ingest.Record
+	var rowErrors []error
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var rowErr *ingest.RowError
+		if errors.As(err, &rowErr) {
+			rowErrors = append(rowErrors, err)
+			continue
+		}
+		if !assert.NoError(t, err) {
+			break
+		}
+		records = append(records, record)
+	}
+	return files[0].Format, reader.Headers(), records, rowErrors
+}
+
+func TestJSONReaderNDJSON(t *testing.T) {
+	content := "\ufeff{\"id\": 1, \"name\": \"Jane\", \"active\": true}\n" +
+		"\n" +
+		"{\"id\": 2.5e1, \"tags\": [\"a\", \"b\"], \"name\": null, \"meta\": {\"k\": 1}}\r\n" +
+		"[1]\n" +
+		"{\"id\": 4,\n" +
+		"{\"id\": 5, \"id\": 6}\n" +
+		"{\"id\": 7}"
+
+	format, headers, records, rowErrors := readJSON(t, content)
+	assert.Equal(t, ingest.FormatNDJSON, format)
+	assert.Equal(t, []string{"id", "name", "active", "tags", "meta"}, headers)
+	if assert.Len(t, records, 3) {
+		assert.Equal(t, &ingest.Record{Line: 1, Values: map[string]string{"id": "1", "name": "Jane", "active": "true"}}, records[0])
+		assert.Equal(t, &ingest.Record{Line: 3, Values: map[string]string{"id": "2.5e1", "tags": `["a","b"]`, "name": "", "meta": `{"k":1}`}}, records[1])
+		assert.Equal(t, 7, records[2].Line)
+	}
+
+	// Malformed lines don't stop the file
+	if assert.Len(t, rowErrors, 3) {
+		assert.EqualError(t, rowErrors[0], "line 4: expected a JSON object")
+		assert.Contains(t, rowErrors[1].Error(), "line 5: ")
+		assert.EqualError(t, rowErrors[2], `line 6: duplicate field "id"`)
+
+		var rowErr *ingest.RowError
+		errors.As(rowErrors[0], &rowErr)
+		assert.Equal(t, "[1]", rowErr.Raw)
+	}
+}
+
+func TestJSONReaderArray(t *testing.T) {
+	content := "[\n  {\"id\": 1, \"name\": \"Jane\"},\n  {\n    \"id\": 2\n  },\n  \"x\",\n  {\"id\": 3}\n]\n"
+
+	format, headers, records, rowErrors := readJSON(t, content)
+	assert.Equal(t, ingest.FormatJSON, format)
+	assert.Equal(t, []string{"id", "name"}, headers)
+	if assert.Len(t, records, 3) {
+		assert.Equal(t, 2, records[0].Line)
+		assert.Equal(t, 3, records[1].Line)
+		assert.Equal(t, map[string]string{"id": "2"}, records[1].Values)
+		assert.Equal(t, 7, records[2].Line)
+	}
+	if assert.Len(t, rowErrors, 1) {
+		assert.EqualError(t, rowErrors[0], "line 6: expected a JSON object")
+	}
+
+	// A syntax error ends the array
+	_, _, records, rowErrors = readJSON(t, "[{\"id\": 1},\n{\"id\": }]")
+	assert.Len(t, records, 1)
+	if assert.Len(t, rowErrors, 1) {
+		assert.Contains(t, rowErrors[0].Error(), "line 2: ")
+		assert.Contains(t, rowErrors[0].Error(), "the rest of the file can't be read")
+	}
+}
+
+func TestJSONReaderLaterField(t *testing.T) {
+	// Headers are taken from the first 20 objects, fields of later objects are still read
+	var content bytes.Buffer
+	for i := 1; i <= 21; i++ {
+		fmt.Fprintf(&content, "{\"id\": %d}\n", i)
+	}
+	content.WriteString("{\"id\": 22, \"email\": \"jane@example.com\"}\n")
+
+	_, headers, records, rowErrors := readJSON(t, content.String())
+	assert.Equal(t, []string{"id"}, headers)
+	assert.Empty(t, rowErrors)
+	if assert.Len(t, records, 22) {
+		assert.Equal(t, map[string]string{"id": "22", "email": "jane@example.com"}, records[21].Values)
+	}
+
+	_, err := ingest.NewJSONReader(strings.NewReader("[]"), ingest.FormatJSON)
+	assert.Error(t, err)
+}
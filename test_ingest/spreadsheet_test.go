@@ -0,0 +1,195 @@
+package test_ingest
+
+import (
+	"archive/zip"
+	"bytes"
+	"csv-handler/ingest"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// buildZip writes the given entries, in order, to a zip archive
+func buildZip(t *testing.T, entries [][2]string) []byte {
+	var archive bytes.Buffer
+	zipWriter := zip.NewWriter(&archive)
+	for _, entry := range entries {
+		writer, err := zipWriter.Create(entry[0])
+		assert.NoError(t, err)
+		writer.Write([]byte(entry[1]))
+	}
+	assert.NoError(t, zipWriter.Close())
+	return archive.Bytes()
+}
+
+// readSheet opens the single file of a spreadsheet upload and reads every record
+func readSheet(t *testing.T, data []byte, format string, sheet string) ([]string, []*ingest.Record) {
+	files, compression, err := ingest.UploadFiles(bytes.NewReader(data), int64(len(data)), "upload")
+	if !assert.NoError(t, err) || !assert.Len(t, files, 1) {
+		return nil, nil
+	}
+	assert.Equal(t, ingest.CompressionNone, compression)
+	assert.Equal(t, format, files[0].Format)
+
+	reader, closer, err := files[0].Rows(ingest.ReadOptions{Sheet: sheet})
+	if !assert.NoError(t, err) {
+		return nil, nil
+	}
+	defer closer.Close()
+
+	var records []*ingest.Record
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			break
+		}
+		records = append(records, record)
+	}
+	return reader.Headers(), records
+}
+
+var xlsxWorkbook = [][2]string{
+	{"[Content_Types].xml", `<?xml version="1.0"?><Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"/>`},
+	{"xl/workbook.xml", `<?xml version="1.0"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="Summary" sheetId="1" r:id="rId1"/><sheet name="Users" sheetId="2" r:id="rId2"/></sheets>
+</workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>
+<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="/xl/worksheets/sheet2.xml"/>
+</Relationships>`},
+	{"xl/sharedStrings.xml", `<?xml version="1.0"?>
+<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<si><t>id</t></si><si><t>name</t></si><si><t>created_at</t></si><si><r><t>Ja</t></r><r><t>ne</t></r></si><si><t>total</t></si>
+</sst>`},
+	{"xl/styles.xml", `<?xml version="1.0"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<numFmts><numFmt numFmtId="164" formatCode="yyyy\-mm\-dd hh:mm"/><numFmt numFmtId="165" formatCode="&quot;USD&quot; 0.00"/></numFmts>
+<cellXfs><xf numFmtId="0"/><xf numFmtId="164"/><xf numFmtId="165"/><xf numFmtId="14"/></cellXfs>
+</styleSheet>`},
+	{"xl/worksheets/sheet1.xml", `<?xml version="1.0"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>
+<row r="1"><c r="A1" t="s"><v>4</v></c></row><row r="2"><c r="A2" s="2"><v>12.5</v></c></row>
+</sheetData></worksheet>`},
+	{"xl/worksheets/sheet2.xml", `<?xml version="1.0"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>
+<row r="2"><c r="A2" t="s"><v>0</v></c><c r="B2" t="s"><v>1</v></c><c r="C2" t="s"><v>2</v></c></row>
+<row r="3"><c r="A3"><v>1</v></c><c r="B3" t="s"><v>3</v></c><c r="C3" s="1"><v>44927.5</v></c></row>
+<row r="4"><c r="A4"/></row>
+<row r="6"><c r="A6"><v>2</v></c><c r="C6" s="3"><v>44928</v></c></row>
+<row r="7"><c r="A7" t="inlineStr"><is><t>3</t></is></c><c r="B7" t="b"><v>1</v></c></row>
+</sheetData></worksheet>`},
+}
+
+func TestXLSXReader(t *testing.T) {
+	data := buildZip(t, xlsxWorkbook)
+
+	headers, records := readSheet(t, data, ingest.FormatXLSX, "Users")
+	assert.Equal(t, []string{"id", "name", "created_at"}, headers)
+	if !assert.Len(t, records, 3) {
+		return
+	}
+
+	// Rows keep their sheet number, empty rows are skipped
+	assert.Equal(t, 3, records[0].Line)
+	assert.Equal(t, map[string]string{"id": "1", "name": "Jane", "created_at": "2023-01-01 12:00:00"}, records[0].Values)
+	assert.Equal(t, map[string]time.Time{"created_at": time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)}, records[0].Dates)
+	assert.Equal(t, 6, records[1].Line)
+	assert.Equal(t, map[string]string{"id": "2", "name": "", "created_at": "2023-01-02 00:00:00"}, records[1].Values)
+	assert.Equal(t, map[string]string{"id": "3", "name": "true", "created_at": ""}, records[2].Values)
+	assert.Nil(t, records[2].Dates)
+
+	// The first sheet is the default, numbers without a date format are kept as written
+	headers, records = readSheet(t, data, ingest.FormatXLSX, "")
+	assert.Equal(t, []string{"total"}, headers)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, map[string]string{"total": "12.5"}, records[0].Values)
+	}
+
+	files, _, err := ingest.UploadFiles(bytes.NewReader(data), int64(len(data)), "upload.xlsx")
+	assert.NoError(t, err)
+	_, _, err = files[0].Rows(ingest.ReadOptions{Sheet: "3"})
+	assert.EqualError(t, err, `sheet "3" not found`)
+}
+
+const odsContent = `<?xml version="1.0"?>
+<office:document-content xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:table="urn:oasis:names:tc:opendocument:xmlns:table:1.0" xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0">
+<office:body><office:spreadsheet>
+<table:table table:name="Summary"><table:table-row><table:table-cell><text:p>total</text:p></table:table-cell></table:table-row></table:table>
+<table:table table:name="Users">
+<table:table-row><table:table-cell office:value-type="string"><text:p>id</text:p></table:table-cell><table:table-cell office:value-type="string"><text:p>name</text:p></table:table-cell><table:table-cell office:value-type="string"><text:p>created_at</text:p></table:table-cell><table:table-cell table:number-columns-repeated="1020"/></table:table-row>
+<table:table-row><table:table-cell office:value-type="float" office:value="1"><text:p>1.00</text:p></table:table-cell><table:table-cell office:value-type="string"><text:p>Jane<text:s text:c="2"/>Doe</text:p></table:table-cell><table:table-cell office:value-type="date" office:date-value="2023-01-01T12:00:00"><text:p>01/01/23 12:00</text:p></table:table-cell></table:table-row>
+<table:table-row table:number-rows-repeated="1000"><table:table-cell table:number-columns-repeated="1024"/></table:table-row>
+<table:table-row table:number-rows-repeated="2"><table:table-cell office:value-type="float" office:value="2"><text:p>2</text:p></table:table-cell><table:table-cell table:number-columns-repeated="2"/></table:table-row>
+</table:table>
+<table:table table:name="Other"><table:table-row><table:table-cell><text:p>ignored</text:p></table:table-cell></table:table-row></table:table>
+</office:spreadsheet></office:body>
+</office:document-content>`
+
+func TestODSReader(t *testing.T) {
+	data := buildZip(t, [][2]string{
+		{"mimetype", "application/vnd.oasis.opendocument.spreadsheet"},
+		{"content.xml", odsContent},
+	})
+
+	headers, records := readSheet(t, data, ingest.FormatODS, "2")
+	assert.Equal(t, []string{"id", "name", "created_at"}, headers)
+	if !assert.Len(t, records, 3) {
+		return
+	}
+
+	assert.Equal(t, 2, records[0].Line)
+	assert.Equal(t, map[string]string{"id": "1", "name": "Jane  Doe", "created_at": "2023-01-01 12:00:00"}, records[0].Values)
+	assert.Equal(t, map[string]time.Time{"created_at": time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)}, records[0].Dates)
+
+	// Repeated rows are read once per copy, after the skipped empty rows
+	assert.Equal(t, 1003, records[1].Line)
+	assert.Equal(t, 1004, records[2].Line)
+	assert.Equal(t, map[string]string{"id": "2", "name": "", "created_at": ""}, records[2].Values)
+}
+
+func TestODSReaderRepeatLimits(t *testing.T) {
+	read := func(rows string) error {
+		data := buildZip(t, [][2]string{
+			{"mimetype", "application/vnd.oasis.opendocument.spreadsheet"},
+			{"content.xml", `<?xml version="1.0"?>
+<office:document-content xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:table="urn:oasis:names:tc:opendocument:xmlns:table:1.0" xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0">
+<office:body><office:spreadsheet><table:table table:name="Users">
+<table:table-row><table:table-cell><text:p>id</text:p></table:table-cell></table:table-row>` + rows + `
+</table:table></office:spreadsheet></office:body>
+</office:document-content>`},
+		})
+		files, _, err := ingest.UploadFiles(bytes.NewReader(data), int64(len(data)), "upload.ods")
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		reader, closer, err := files[0].Rows(ingest.ReadOptions{})
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer closer.Close()
+		for {
+			if _, err := reader.Read(); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Padding up to the size of a sheet is skipped
+	assert.Equal(t, io.EOF, read(`<table:table-row table:number-rows-repeated="1048575"><table:table-cell table:number-columns-repeated="16384"/></table:table-row>`))
+
+	err := read(`<table:table-row table:number-rows-repeated="1048576"><table:table-cell/></table:table-row>`)
+	assert.EqualError(t, err, "line 2: row repeated 1048576 times goes past the 1048576 rows of a sheet")
+
+	err = read(`<table:table-row><table:table-cell><text:p>1</text:p></table:table-cell><table:table-cell table:number-columns-repeated="999999999"><text:p>x</text:p></table:table-cell></table:table-row>`)
+	assert.EqualError(t, err, "line 2: cell repeated 999999999 times goes past the 16384 columns of a sheet")
+
+	err = read(`<table:table-row><table:table-cell><text:p><text:s text:c="999999999"/></text:p></table:table-cell></table:table-row>`)
+	assert.EqualError(t, err, "line 2: cell text goes past 32767 characters")
+}
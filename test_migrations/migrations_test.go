@@ -0,0 +1,22 @@
+package test_migrations
+
+import (
+	"csv-handler/migrations"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	all, err := migrations.Load()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, all)
+
+	// Versions start at 1 and have no gaps, so the order is clear to whoever adds the next one
+	for i, migration := range all {
+		assert.Equal(t, int64(i+1), migration.Version)
+		assert.NotEmpty(t, migration.Name)
+		assert.NotEmpty(t, migration.Up)
+		assert.NotEmpty(t, migration.Down)
+	}
+}
@@ -0,0 +1,140 @@
+package test_migrations
+
+import (
+	"context"
+	"csv-handler/migrations"
+	"database/sql"
+	"fmt"
+	"log"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// formerSchema is the start state of databases created from the schema.sql that the
+// migrations replaced, csv_data already has its primary key
+const formerSchema = `
+CREATE TABLE csv_data (
+    id BIGINT PRIMARY KEY,
+    first_name VARCHAR(100),
+    last_name VARCHAR(100),
+    email_address VARCHAR(320),
+    created_at TIMESTAMP,
+    deleted_at TIMESTAMP,
+    merged_at TIMESTAMP,
+    parent_user_id BIGINT
+);
+
+CREATE TABLE import_jobs (
+    id BIGSERIAL PRIMARY KEY,
+    state VARCHAR(20) NOT NULL DEFAULT 'queued',
+    file_name VARCHAR(255),
+    mode VARCHAR(20) NOT NULL DEFAULT 'insert',
+    headers TEXT[],
+    total_rows BIGINT,
+    published_rows BIGINT NOT NULL DEFAULT 0,
+    inserted_rows BIGINT NOT NULL DEFAULT 0,
+    updated_rows BIGINT NOT NULL DEFAULT 0,
+    skipped_rows BIGINT NOT NULL DEFAULT 0,
+    failed_rows BIGINT NOT NULL DEFAULT 0,
+    error TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE import_rejects (
+    id BIGSERIAL PRIMARY KEY,
+    job_id BIGINT REFERENCES import_jobs (id) ON DELETE CASCADE,
+    line_number INT,
+    raw_values TEXT NOT NULL,
+    error TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_import_rejects_job_id ON import_rejects (job_id, line_number);
+`
+
+// TestPrimaryKeyMigration checks that undoing 0003 only drops the csv_data primary key
+// when 0003 added it. It needs the configured PostgreSQL.
+func TestPrimaryKeyMigration(t *testing.T) {
+	// Load the configuration file
+	viper.SetConfigFile("./../config.yaml")
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatalf("Failed to read configuration file: %v", err)
+	}
+
+	connectionString := fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s sslmode=disable",
+		viper.GetString("postgres.host"), viper.GetString("postgres.port"), viper.GetString("postgres.dbname"),
+		viper.GetString("postgres.user"), viper.GetString("postgres.password"))
+	db, err := sql.Open("postgres", connectionString)
+	if err == nil {
+		err = db.Ping()
+	}
+	if err != nil {
+		t.Skipf("PostgreSQL is not available: %v", err)
+	}
+	defer db.Close()
+
+	all, err := migrations.Load()
+	if !assert.NoError(t, err) || !assert.GreaterOrEqual(t, len(all), 3) {
+		return
+	}
+
+	tests := []struct {
+		name  string
+		start string
+		// whether the key is still there once 0003 is undone
+		keepsKey bool
+	}{
+		{name: "former schema.sql", start: formerSchema, keepsKey: true},
+		{name: "empty database", start: "", keepsKey: false},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			tx, err := db.BeginTx(ctx, nil)
+			if !assert.NoError(t, err) {
+				return
+			}
+			// Everything happens in a schema of its own that the rollback removes
+			defer tx.Rollback()
+
+			schema := fmt.Sprintf("migrations_test_%d_%d", time.Now().UnixNano(), i)
+			_, err = tx.ExecContext(ctx, "CREATE SCHEMA "+schema)
+			assert.NoError(t, err)
+			_, err = tx.ExecContext(ctx, "SET LOCAL search_path TO "+schema)
+			assert.NoError(t, err)
+			if test.start != "" {
+				_, err = tx.ExecContext(ctx, test.start)
+				assert.NoError(t, err)
+			}
+
+			for _, migration := range all[:3] {
+				_, err = tx.ExecContext(ctx, migration.Up)
+				if !assert.NoError(t, err, migration.Name) {
+					return
+				}
+			}
+			assert.True(t, hasPrimaryKey(t, ctx, tx))
+
+			_, err = tx.ExecContext(ctx, all[2].Down)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, test.keepsKey, hasPrimaryKey(t, ctx, tx))
+		})
+	}
+}
+
+// hasPrimaryKey tells whether csv_data in the current search_path has a primary key
+func hasPrimaryKey(t *testing.T, ctx context.Context, tx *sql.Tx) bool {
+	var exists bool
+	err := tx.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM pg_constraint WHERE conrelid = 'csv_data'::regclass AND contype = 'p')").Scan(&exists)
+	assert.NoError(t, err)
+	return exists
+}
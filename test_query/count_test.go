@@ -0,0 +1,58 @@
+package test_query
+
+import (
+	"context"
+	"csv-handler/api"
+	"csv-handler/dataset"
+	"csv-handler/postgres"
+	"csv-handler/query"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCount(t *testing.T) {
+	tests := map[string]string{
+		"":         query.CountNone,
+		"none":     query.CountNone,
+		"exact":    query.CountExact,
+		"estimate": query.CountEstimate,
+	}
+	for value, expected := range tests {
+		mode, err := query.ParseCount(url.Values{"count": {value}})
+		assert.NoError(t, err, value)
+		assert.Equal(t, expected, mode, value)
+	}
+
+	for _, value := range []string{"all", "EXACT", "1"} {
+		_, err := query.ParseCount(url.Values{"count": {value}})
+		assert.EqualError(t, err, "count must be exact, estimate or none", value)
+	}
+}
+
+func TestCountNone(t *testing.T) {
+	// Rows aren't counted, so the total is null without querying PostgreSQL
+	total, err := (&postgres.Client{}).CountData(context.Background(), nil, nil, query.CountNone)
+	assert.NoError(t, err)
+	assert.Nil(t, total)
+
+	// An invalid count is rejected before PostgreSQL is queried
+	viper.SetConfigFile("./../config.yaml")
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatalf("Failed to read configuration file: %v", err)
+	}
+	datasets, err := dataset.Load()
+	assert.NoError(t, err)
+
+	req, err := http.NewRequest("GET", "/data?count=all", nil)
+	assert.NoError(t, err)
+	res := httptest.NewRecorder()
+	api.NewHandler(nil, nil, nil, datasets, nil).HandleGetData(res, req)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	assert.Equal(t, "count must be exact, estimate or none\n", res.Body.String())
+}
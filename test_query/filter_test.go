@@ -0,0 +1,49 @@
+package test_query
+
+import (
+	"csv-handler/query"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var columns = query.Columns{
+	"id":         query.Int,
+	"first_name": query.Text,
+	"created_at": query.Timestamp,
+	"deleted_at": query.Timestamp,
+}
+
+func TestParseFiltersBuildsParameterizedSQL(t *testing.T) {
+	values, err := url.ParseQuery("created_at[gte]=2023-01-01&deleted_at=null&first_name[ilike]=jo*&id[in]=1,2&limit=10")
+	assert.NoError(t, err)
+
+	filters, err := query.ParseFilters(values, columns)
+	assert.NoError(t, err)
+
+	where, args := query.BuildWhere(filters, 1)
+	assert.Equal(t, ` AND "created_at" >= $1 AND "deleted_at" IS NULL AND "first_name" ILIKE $2 AND "id" IN ($3, $4)`, where)
+	assert.Equal(t, []interface{}{time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), "jo%", int64(1), int64(2)}, args)
+}
+
+func TestParseFiltersRejectsInvalidFilters(t *testing.T) {
+	invalid := []string{
+		"password=secret",                    // not whitelisted
+		"id=1%3BDROP%20TABLE%20csv_data",     // not an integer
+		"first_name[gt]=a",                   // operator not allowed for text
+		"created_at[lt]=yesterday",           // not a timestamp
+		"deleted_at[is]=empty",               // is takes null or not_null
+		"id%3D1%20OR%201%3D1[eq]=1",          // column names can't be injected
+		"created_at[gte]=2023-01-01&x[eq]=1", // one bad filter fails the request
+	}
+
+	for _, rawQuery := range invalid {
+		values, err := url.ParseQuery(rawQuery)
+		assert.NoError(t, err)
+
+		_, err = query.ParseFilters(values, columns)
+		assert.Error(t, err, rawQuery)
+	}
+}
@@ -0,0 +1,67 @@
+package test_query
+
+import (
+	"csv-handler/query"
+	"encoding/base64"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePageDefaults(t *testing.T) {
+	page, err := query.ParsePage(url.Values{}, columns, "id")
+	assert.NoError(t, err)
+	assert.Equal(t, query.DefaultLimit, page.Limit)
+	assert.Equal(t, "id", page.SortString())
+	assert.Equal(t, ` ORDER BY "id" ASC NULLS LAST`, page.BuildOrderBy())
+
+	page, err = query.ParsePage(url.Values{"limit": {"100000"}}, columns, "id")
+	assert.NoError(t, err)
+	assert.Equal(t, query.MaxLimit, page.Limit)
+
+	_, err = query.ParsePage(url.Values{"limit": {"abc"}}, columns, "id")
+	assert.Error(t, err)
+	_, err = query.ParsePage(url.Values{"sort": {"password"}}, columns, "id")
+	assert.Error(t, err)
+}
+
+func TestPageCursors(t *testing.T) {
+	values := url.Values{"limit": {"2"}, "sort": {"-deleted_at"}}
+	page, err := query.ParsePage(values, columns, "id")
+	assert.NoError(t, err)
+	assert.Equal(t, "-deleted_at,id", page.SortString())
+
+	// Three rows were fetched for a limit of two, so there is a next page
+	deletedAt := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	rows := []map[string]interface{}{
+		{"id": int64(1), "deleted_at": nil},
+		{"id": int64(2), "deleted_at": deletedAt},
+		{"id": int64(3), "deleted_at": deletedAt},
+	}
+	rows, info, err := page.Result(rows)
+	assert.NoError(t, err)
+	assert.Len(t, rows, 2)
+	assert.Nil(t, info.PrevCursor)
+	assert.NotNil(t, info.NextCursor)
+
+	// The next page starts after (deleted_at 2023-01-01, id 2)
+	values.Set("cursor", *info.NextCursor)
+	next, err := query.ParsePage(values, columns, "id")
+	assert.NoError(t, err)
+
+	keyset, args := next.BuildKeyset(1)
+	assert.Equal(t, ` AND (("deleted_at" < $1) OR ("deleted_at" = $2 AND ("id" > $3 OR "id" IS NULL)))`, keyset)
+	assert.Equal(t, []interface{}{"2023-01-01T00:00:00Z", "2023-01-01T00:00:00Z", "2"}, args)
+
+	// A cursor can't be used with another sort
+	values.Set("sort", "id")
+	_, err = query.ParsePage(values, columns, "id")
+	assert.Error(t, err)
+
+	// Cursor values must parse as their column type
+	tampered := base64.RawURLEncoding.EncodeToString([]byte(`{"d":"next","s":"id","v":["abc"]}`))
+	_, err = query.ParsePage(url.Values{"cursor": {tampered}}, columns, "id")
+	assert.EqualError(t, err, "invalid cursor")
+}
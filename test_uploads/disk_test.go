@@ -0,0 +1,128 @@
+package test_uploads
+
+import (
+	"csv-handler/uploads"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskAppend(t *testing.T) {
+	store, err := uploads.NewDisk(t.TempDir(), time.Hour)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	upload, err := store.Create(10, map[string]string{"filename": "users.csv"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, int64(0), upload.Offset)
+
+	// Chunks are only accepted at the current offset
+	upload, err = store.Append(upload.ID, 0, strings.NewReader("0123"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), upload.Offset)
+
+	_, err = store.Append(upload.ID, 0, strings.NewReader("0123"))
+	assert.ErrorIs(t, err, uploads.ErrOffsetMismatch)
+
+	_, err = store.Open(upload.ID)
+	assert.ErrorIs(t, err, uploads.ErrIncomplete)
+
+	// A chunk past the length keeps the content up to it
+	upload, err = store.Append(upload.ID, 4, strings.NewReader("456789xyz"))
+	assert.ErrorIs(t, err, uploads.ErrTooLarge)
+	assert.True(t, upload.Complete())
+
+	// A claimed upload is imported by a single request
+	claim, err := store.Claim(upload.ID)
+	if assert.NoError(t, err) {
+		_, err = store.Claim(upload.ID)
+		assert.ErrorIs(t, err, uploads.ErrLocked)
+		_, err = store.Append(upload.ID, 10, strings.NewReader("x"))
+		assert.ErrorIs(t, err, uploads.ErrLocked)
+		// A claimed upload is only deleted through its claim
+		assert.ErrorIs(t, store.Delete(upload.ID), uploads.ErrLocked)
+		claim.Release()
+	}
+
+	file, err := store.Open(upload.ID)
+	if assert.NoError(t, err) {
+		content, _ := io.ReadAll(file)
+		file.Close()
+		assert.Equal(t, "0123456789", string(content))
+	}
+
+	upload, err = store.Get(upload.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "users.csv", upload.Metadata["filename"])
+
+	assert.NoError(t, store.Delete(upload.ID))
+	_, err = store.Get(upload.ID)
+	assert.ErrorIs(t, err, uploads.ErrNotFound)
+
+	// Ids that Create can't return are never looked up
+	_, err = store.Get("../secret")
+	assert.ErrorIs(t, err, uploads.ErrNotFound)
+}
+
+func TestDiskDeleteExpired(t *testing.T) {
+	store, err := uploads.NewDisk(t.TempDir(), time.Hour)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	upload, err := store.Create(10, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	deleted, err := store.DeleteExpired(time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+
+	deleted, err = store.DeleteExpired(time.Now().Add(2 * time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+
+	_, err = store.Get(upload.ID)
+	assert.ErrorIs(t, err, uploads.ErrNotFound)
+}
+
+func TestDiskDeleteLocked(t *testing.T) {
+	store, err := uploads.NewDisk(t.TempDir(), time.Hour)
+	if !assert.NoError(t, err) {
+		return
+	}
+	upload, err := store.Create(10, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The chunk is being written once its first bytes were read
+	reader, writer := io.Pipe()
+	appended := make(chan error)
+	go func() {
+		_, err := store.Append(upload.ID, 0, reader)
+		appended <- err
+	}()
+	writer.Write([]byte("0123"))
+
+	assert.ErrorIs(t, store.Delete(upload.ID), uploads.ErrLocked)
+	writer.Close()
+	assert.NoError(t, <-appended)
+
+	// A finished import deletes the upload through its claim
+	claim, err := store.Claim(upload.ID)
+	if assert.NoError(t, err) {
+		assert.NoError(t, claim.Delete())
+	}
+	_, err = store.Get(upload.ID)
+	assert.ErrorIs(t, err, uploads.ErrNotFound)
+	_, err = store.Claim(upload.ID)
+	assert.ErrorIs(t, err, uploads.ErrNotFound)
+}
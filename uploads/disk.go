@@ -0,0 +1,306 @@
+package uploads
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// idLength is the number of random bytes of an upload id
+const idLength = 16
+
+// Disk is a Store that keeps every upload in a directory, as a <id>.json file with its
+// length and metadata next to a <id>.bin file with the content received so far.
+// The offset of an upload is the size of its content, and it expires ttl after the last chunk.
+type Disk struct {
+	dir string
+	ttl time.Duration
+
+	lock sync.Mutex
+	// busy holds the uploads a chunk is being written to or that are claimed for an import
+	busy map[string]bool
+}
+
+// diskInfo is the content of the <id>.json file of an upload
+type diskInfo struct {
+	Length    int64             `json:"length"`
+	Metadata  map[string]string `json:"metadata"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// NewDisk creates a Store in dir, which is created if it doesn't exist
+func NewDisk(dir string, ttl time.Duration) (*Disk, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %w", err)
+	}
+
+	return &Disk{
+		dir:  dir,
+		ttl:  ttl,
+		busy: make(map[string]bool),
+	}, nil
+}
+
+// Create creates an empty upload of the given length
+func (d *Disk) Create(length int64, metadata map[string]string) (*Upload, error) {
+	idBytes := make([]byte, idLength)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, fmt.Errorf("failed to generate upload id: %w", err)
+	}
+	id := hex.EncodeToString(idBytes)
+
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	info, err := json.Marshal(diskInfo{Length: length, Metadata: metadata, CreatedAt: time.Now().UTC()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode upload info: %w", err)
+	}
+
+	// The content file is created first, an info file always has its content
+	content, err := os.OpenFile(d.contentPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload: %w", err)
+	}
+	content.Close()
+	if err := os.WriteFile(d.infoPath(id), info, 0o640); err != nil {
+		os.Remove(d.contentPath(id))
+		return nil, fmt.Errorf("failed to create upload: %w", err)
+	}
+
+	return d.Get(id)
+}
+
+// Get returns an upload with its current offset, ErrNotFound once it has expired
+func (d *Disk) Get(id string) (*Upload, error) {
+	upload, err := d.read(id)
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(upload.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+	return upload, nil
+}
+
+// Append writes the content of r at offset, content read before an error is kept
+func (d *Disk) Append(id string, offset int64, r io.Reader) (*Upload, error) {
+	// Chunks of an upload are written one at a time
+	release, err := d.acquire(id)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	upload, err := d.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if offset != upload.Offset {
+		return upload, ErrOffsetMismatch
+	}
+
+	content, err := os.OpenFile(d.contentPath(id), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upload content: %w", err)
+	}
+
+	// Write up to the length, then check that the chunk has nothing more
+	_, copyErr := io.Copy(content, io.LimitReader(r, upload.Length-upload.Offset))
+	if copyErr == nil {
+		if n, _ := r.Read(make([]byte, 1)); n > 0 {
+			copyErr = ErrTooLarge
+		}
+	}
+	if err := content.Close(); err != nil && copyErr == nil {
+		copyErr = fmt.Errorf("failed to write upload content: %w", err)
+	}
+
+	upload, err = d.read(id)
+	if err != nil {
+		return nil, err
+	}
+	return upload, copyErr
+}
+
+// Claim locks an upload for its import until the claim is released
+func (d *Disk) Claim(id string) (*Claim, error) {
+	if _, err := d.Get(id); err != nil {
+		return nil, err
+	}
+	release, err := d.acquire(id)
+	if err != nil {
+		return nil, err
+	}
+	return NewClaim(release, func() error { return d.remove(id) }), nil
+}
+
+// Open returns the content of a complete upload
+func (d *Disk) Open(id string) (File, error) {
+	upload, err := d.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if !upload.Complete() {
+		return nil, ErrIncomplete
+	}
+
+	content, err := os.Open(d.contentPath(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upload content: %w", err)
+	}
+	return content, nil
+}
+
+// Delete deletes an upload and its content, ErrLocked while it is written to or claimed
+func (d *Disk) Delete(id string) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+
+	release, err := d.acquire(id)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return d.remove(id)
+}
+
+// remove deletes the files of an upload, the caller holds its lock
+func (d *Disk) remove(id string) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+
+	// The info file goes first, so a half deleted upload is not found
+	err := os.Remove(d.infoPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete upload: %w", err)
+	}
+	if err := os.Remove(d.contentPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete upload content: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpired deletes the uploads that have expired at now, and content left without its info file
+func (d *Disk) DeleteExpired(now time.Time) (int, error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list uploads: %w", err)
+	}
+
+	deleted := 0
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".bin")
+		if id == entry.Name() || !validID(id) {
+			continue
+		}
+
+		upload, err := d.read(id)
+		if errors.Is(err, ErrNotFound) {
+			// A failed create or delete left the content behind, it expires like an upload
+			if stat, err := entry.Info(); err == nil && !now.Before(stat.ModTime().Add(d.ttl)) {
+				os.Remove(d.contentPath(id))
+			}
+			continue
+		}
+		if err != nil || now.Before(upload.ExpiresAt) {
+			continue
+		}
+
+		// An upload being imported is left until its import is done
+		release, err := d.acquire(id)
+		if err != nil {
+			continue
+		}
+		err = d.remove(id)
+		release()
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// acquire marks an upload busy and returns the function that releases it, ErrLocked if it already is
+func (d *Disk) acquire(id string) (func(), error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.busy[id] {
+		return nil, ErrLocked
+	}
+	d.busy[id] = true
+
+	return func() {
+		d.lock.Lock()
+		delete(d.busy, id)
+		d.lock.Unlock()
+	}, nil
+}
+
+// read returns an upload whether it has expired or not
+func (d *Disk) read(id string) (*Upload, error) {
+	// Ids are checked so they can't point outside the directory
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+
+	rawInfo, err := os.ReadFile(d.infoPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload info: %w", err)
+	}
+	var info diskInfo
+	if err := json.Unmarshal(rawInfo, &info); err != nil {
+		return nil, fmt.Errorf("failed to decode upload info: %w", err)
+	}
+
+	stat, err := os.Stat(d.contentPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload content: %w", err)
+	}
+
+	return &Upload{
+		ID:        id,
+		Length:    info.Length,
+		Offset:    stat.Size(),
+		Metadata:  info.Metadata,
+		CreatedAt: info.CreatedAt,
+		ExpiresAt: stat.ModTime().Add(d.ttl).UTC(),
+	}, nil
+}
+
+func (d *Disk) infoPath(id string) string {
+	return filepath.Join(d.dir, id+".json")
+}
+
+func (d *Disk) contentPath(id string) string {
+	return filepath.Join(d.dir, id+".bin")
+}
+
+// validID reports whether id is an id generated by Create
+func validID(id string) bool {
+	if len(id) != hex.EncodedLen(idLength) {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil && strings.ToLower(id) == id
+}
@@ -0,0 +1,116 @@
+package uploads
+
+import (
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Errors returned by a Store
+var (
+	// ErrNotFound is returned for an upload that doesn't exist or has expired
+	ErrNotFound = errors.New("upload not found")
+	// ErrOffsetMismatch is returned when a chunk doesn't start where the content received so far ends
+	ErrOffsetMismatch = errors.New("offset does not match the upload offset")
+	// ErrTooLarge is returned when a chunk goes past the length of the upload, the content up to the length is kept
+	ErrTooLarge = errors.New("chunk exceeds the upload length")
+	// ErrLocked is returned when a chunk is already being written to the upload, or it is being imported
+	ErrLocked = errors.New("upload is in use")
+	// ErrIncomplete is returned when the content of an upload is opened before all of it was received
+	ErrIncomplete = errors.New("upload is incomplete")
+)
+
+// Upload is a file sent in chunks that is imported once all of it has been received
+type Upload struct {
+	ID string `json:"id"`
+	// Length is the size of the whole file in bytes
+	Length int64 `json:"length"`
+	// Offset is how many bytes have been received
+	Offset int64 `json:"offset"`
+	// Metadata holds the values given when the upload was created, such as its filename
+	Metadata  map[string]string `json:"metadata"`
+	CreatedAt time.Time         `json:"created_at"`
+	// ExpiresAt is when the upload is deleted, it moves forward with every chunk received
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Complete reports whether all of the content has been received
+func (u *Upload) Complete() bool {
+	return u.Offset == u.Length
+}
+
+// File is the content of a complete upload
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+// Store keeps the content of resumable uploads until they are imported
+type Store interface {
+	// Create creates an empty upload of the given length
+	Create(length int64, metadata map[string]string) (*Upload, error)
+
+	// Get returns an upload with its current offset
+	Get(id string) (*Upload, error)
+
+	// Append writes the content of r at offset, which must be the offset of the upload.
+	// Content read before an error is kept, so the client can resume from the returned offset.
+	Append(id string, offset int64, r io.Reader) (*Upload, error)
+
+	// Claim locks an upload so a single request imports it. Chunks can't be written to a claimed
+	// upload, and another claim or a Delete returns ErrLocked, until the claim is released.
+	Claim(id string) (*Claim, error)
+
+	// Open returns the content of a complete upload
+	Open(id string) (File, error)
+
+	// Delete deletes an upload and its content, ErrLocked while a chunk is written or it is claimed
+	Delete(id string) error
+
+	// DeleteExpired deletes the uploads that have expired at now and returns how many it deleted
+	DeleteExpired(now time.Time) (int, error)
+}
+
+// Claim is the lock a request holds on an upload while it imports it
+type Claim struct {
+	release func()
+	remove  func() error
+	once    sync.Once
+}
+
+// NewClaim creates the claim a Store returns. release unlocks the upload,
+// remove deletes it while it is still locked.
+func NewClaim(release func(), remove func() error) *Claim {
+	return &Claim{release: release, remove: remove}
+}
+
+// Release unlocks the upload, calls after the first one do nothing
+func (c *Claim) Release() {
+	c.once.Do(c.release)
+}
+
+// Delete deletes the claimed upload once it has been imported, and releases it
+func (c *Claim) Delete() error {
+	defer c.Release()
+	return c.remove()
+}
+
+// StartCleanup deletes expired uploads every interval, it runs until the process exits
+func StartCleanup(store Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		deleted, err := store.DeleteExpired(now)
+		if err != nil {
+			log.Println("Failed to delete expired uploads:", err)
+		}
+		if deleted > 0 {
+			log.Printf("Deleted %d expired uploads", deleted)
+		}
+	}
+}